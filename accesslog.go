@@ -0,0 +1,89 @@
+package plugin_simpleforcecache
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+var errHijackUnsupported = errors.New("response writer does not support hijacking")
+
+type accessLogEntry struct {
+	Time               string `json:"time"`
+	Method             string `json:"method"`
+	Path               string `json:"path"`
+	CacheStatus        string `json:"cacheStatus"`
+	UpstreamDurationMs int64  `json:"upstreamDurationMs"`
+	ResponseSizeBytes  int64  `json:"responseSizeBytes"`
+	CacheKeyHash       string `json:"cacheKeyHash,omitempty"`
+}
+
+// countingWriter counts the body bytes written to the client.
+type countingWriter struct {
+	http.ResponseWriter
+
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+
+	return n, err //nolint:wrapcheck // pass through the client's error unchanged
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over for protocol upgrades. Bytes written to
+// a hijacked connection are not counted.
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack() //nolint:wrapcheck // pass through the client's error unchanged
+	}
+
+	return nil, nil, errHijackUnsupported
+}
+
+// CloseNotify implements the deprecated http.CloseNotifier for handlers that
+// still rely on it.
+func (w *countingWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok { //nolint:staticcheck // kept for backward compatibility
+		return cn.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// logAccess writes one JSON line describing how a request was served. The
+// cache key is hashed so that the log does not leak request details.
+func (m *cache) logAccess(r *http.Request, out requestOutcome, size int64) {
+	entry := accessLogEntry{
+		Time:               m.cfg.now().UTC().Format(time.RFC3339),
+		Method:             r.Method,
+		Path:               r.URL.Path,
+		CacheStatus:        out.status,
+		UpstreamDurationMs: out.upstream.Milliseconds(),
+		ResponseSizeBytes:  size,
+		CacheKeyHash:       "",
+	}
+
+	if out.key != "" {
+		h := keyHash(out.key)
+		entry.CacheKeyHash = hex.EncodeToString(h[:])
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	m.accessLog.Println(string(b))
+}
@@ -0,0 +1,258 @@
+package plugin_simpleforcecache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	adminEntryPath = "/admin/cache/entry"
+	adminStatsPath = "/admin/cache/stats"
+
+	maxAdminKeyLength = 4096
+
+	// adminTokenHeader carries the token authorizing admin requests.
+	adminTokenHeader = "X-Admin-Token"
+)
+
+type adminEntry struct {
+	Key        string     `json:"key"`
+	StorageKey string     `json:"storageKey"`
+	Size       int        `json:"size"`
+	Expires    string     `json:"expires,omitempty"`
+	Compressed bool       `json:"compressed"`
+	Entry      *cacheData `json:"entry"`
+}
+
+// adminStats is the response of the admin stats API.
+type adminStats struct {
+	CacheStats
+
+	DiskBytes int64 `json:"diskBytes"`
+}
+
+// serveAdmin serves the admin API to requests carrying the admin token.
+func (m *cache) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(adminTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.cfg.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case adminEntryPath:
+		m.serveAdminEntry(w, r)
+	case adminStatsPath:
+		m.serveAdminStats(w, r)
+	}
+}
+
+// serveAdminStats serves the cache usage counters as JSON.
+func (m *cache) serveAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// The bytes measured on disk let operators detect drift of the running
+	// StoredBytes count.
+	stats := adminStats{CacheStats: m.Stats(), DiskBytes: getUsage(m.cache).Bytes}
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error writing admin stats: %v", err)
+	}
+}
+
+// adminEntryPut is the request body of the admin entry API used to store an
+// entry. Body is base64 encoded and TTL is in seconds, defaulting to
+// MaxExpiry.
+type adminEntryPut struct {
+	Key     string              `json:"key"`
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body"`
+	TTL     int                 `json:"ttl"`
+}
+
+// serveAdminEntry serves the admin entry API. GET previews the cache entry
+// stored under the key given in the key query parameter, DELETE invalidates
+// it and PUT stores one.
+func (m *cache) serveAdminEntry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.getAdminEntry(w, r)
+	case http.MethodDelete:
+		m.deleteAdminEntry(w, r)
+	case http.MethodPut:
+		m.putAdminEntry(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete+", "+http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *cache) getAdminEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if !validAdminKey(key) {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	storageKey := key
+	if m.hasher != nil {
+		storageKey = m.hasher.Hash(key)
+	}
+
+	b, expires, err := getExpiry(m.cache, storageKey)
+	if err != nil {
+		http.Error(w, "entry not found", http.StatusNotFound)
+		return
+	}
+
+	meta, _, err := splitEntry(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var stored struct {
+		Compressed bool `json:"compressed"`
+	}
+
+	_ = json.Unmarshal(meta, &stored)
+
+	var data cacheData
+
+	if err = m.unmarshalEntry(b, &data); err != nil { //nolint:noinlineerr // acceptable inline error
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminEntry{
+		Key:        key,
+		StorageKey: storageKey,
+		Size:       len(b),
+		Expires:    "",
+		Compressed: stored.Compressed,
+		Entry:      &data,
+	}
+
+	if !expires.IsZero() {
+		resp.Expires = expires.UTC().Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error writing admin entry: %v", err)
+	}
+}
+
+// deleteAdminEntry invalidates the entry stored under the key given in the
+// key query parameter, on this instance and the others sharing the
+// invalidation channel.
+func (m *cache) deleteAdminEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if !validAdminKey(key) {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	if m.hasher != nil {
+		key = m.hasher.Hash(key)
+	}
+
+	m.invalidate(key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putAdminEntry stores the entry in the request body, so that applications
+// can populate the cache without going through the upstream.
+func (m *cache) putAdminEntry(w http.ResponseWriter, r *http.Request) {
+	var put adminEntryPut
+
+	if err := json.NewDecoder(r.Body).Decode(&put); err != nil { //nolint:noinlineerr // acceptable inline error
+		http.Error(w, "invalid entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validAdminKey(put.Key) {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	if put.Status == 0 {
+		put.Status = http.StatusOK
+	}
+
+	if put.Status < 100 || put.Status > 599 {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	if put.TTL == 0 {
+		put.TTL = m.cfg.MaxExpiry
+	}
+
+	if put.TTL < 0 || put.TTL > m.cfg.MaxExpiry {
+		http.Error(w, fmt.Sprintf("ttl must be between 1 and %d", m.cfg.MaxExpiry), http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(put.TTL) * time.Second
+
+	data := cacheData{ //nolint:exhaustruct // body fields are set by marshalEntry
+		Status:  put.Status,
+		Headers: put.Headers,
+		Body:    put.Body,
+		Expires: m.cfg.now().Add(ttl).Unix(),
+		Created: m.cfg.now().Unix(),
+	}
+
+	entry, err := m.marshalEntry(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	storageKey := put.Key
+	if m.hasher != nil {
+		storageKey = m.hasher.Hash(put.Key)
+	}
+
+	expiry := ttl + time.Duration(m.cfg.StaleTolerance)*time.Second
+	if err = m.cache.Set(storageKey, entry, expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.stats.stores.Add(1)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// validAdminKey reports whether key looks like a cache key, which holds the
+// path of the request and no spaces or control characters.
+func validAdminKey(key string) bool {
+	if key == "" || len(key) > maxAdminKeyLength {
+		return false
+	}
+
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	return strings.Contains(key, "/")
+}
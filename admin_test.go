@@ -0,0 +1,169 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// adminRequest returns a request to the admin API carrying the token used
+// by the tests.
+func adminRequest(method, path string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, "http://localhost"+path, body)
+	req.Header.Set(adminTokenHeader, "secret")
+
+	return req
+}
+
+func TestCache_AdminEntry(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{
+		Path:       dir,
+		MaxExpiry:  10,
+		Cleanup:    20,
+		AdminAPI:   true,
+		AdminToken: "secret",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, adminRequest(http.MethodGet, adminEntryPath+"?key="+url.QueryEscape("GETlocalhost/test"), nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	var entry adminEntry
+	if err := json.Unmarshal(rw.Body.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.StorageKey != "GETlocalhost/test" || entry.Entry == nil || string(entry.Entry.Body) != "hello" || entry.Expires == "" || entry.Size == 0 {
+		t.Errorf("unexpected admin entry: %+v", entry)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, adminRequest(http.MethodGet, adminEntryPath+"?key="+url.QueryEscape("GETlocalhost/missing"), nil))
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code for missing entry: want %d, got %d", http.StatusNotFound, rw.Code)
+	}
+
+	for _, key := range []string{"", "GET localhost/test"} {
+		rw = httptest.NewRecorder()
+		c.ServeHTTP(rw, adminRequest(http.MethodGet, adminEntryPath+"?key="+url.QueryEscape(key), nil))
+
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for key %q: want %d, got %d", key, http.StatusBadRequest, rw.Code)
+		}
+	}
+}
+
+func TestCache_AdminPutEntry(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("upstream"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AdminAPI: true, AdminToken: "secret"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "invalid json", body: `{`, want: http.StatusBadRequest},
+		{name: "missing key", body: `{"body": "aGVsbG8="}`, want: http.StatusBadRequest},
+		{name: "invalid key", body: `{"key": "GET localhost/test"}`, want: http.StatusBadRequest},
+		{name: "ttl above maxExpiry", body: `{"key": "GETlocalhost/test", "ttl": 11}`, want: http.StatusBadRequest},
+		{name: "invalid status", body: `{"key": "GETlocalhost/test", "status": 42}`, want: http.StatusBadRequest},
+		{
+			name: "valid",
+			body: `{"key": "GETlocalhost/test", "status": 200, "headers": {"Content-Type": ["text/plain"]}, "body": "aGVsbG8=", "ttl": 5}`,
+			want: http.StatusCreated,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, adminRequest(http.MethodPut, adminEntryPath, strings.NewReader(test.body)))
+
+			if rw.Code != test.want {
+				t.Errorf("unexpected status code: want %d, got %d: %s", test.want, rw.Code, rw.Body.String())
+			}
+		})
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if rw.Body.String() != "hello" || rw.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected the stored entry to be served, got %q with %v", rw.Body.String(), rw.Header())
+	}
+}
+
+func TestCache_AdminUnauthorized(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("upstream"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AdminAPI: true, AdminToken: "secret"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodPut, "http://localhost"+adminEntryPath, strings.NewReader(`{"key": "GETlocalhost/test", "body": "aGVsbG8="}`)),
+			httptest.NewRequest(http.MethodGet, "http://localhost"+adminStatsPath, nil),
+		} {
+			if token != "" {
+				req.Header.Set(adminTokenHeader, token)
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if rw.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with token %q: unexpected status code: want %d, got %d", req.Method, req.URL.Path, token, http.StatusUnauthorized, rw.Code)
+			}
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if rw.Body.String() != "upstream" || calls != 1 {
+		t.Errorf("expected the unauthorized entry not to be stored, got %q", rw.Body.String())
+	}
+}
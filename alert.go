@@ -0,0 +1,48 @@
+package plugin_simpleforcecache
+
+import (
+	"log"
+	"time"
+)
+
+const defaultHitRateAlertInterval = 60
+
+// watchHitRate checks the hit rate of each interval against the alert
+// threshold.
+func (m *cache) watchHitRate(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := m.stats.snapshot()
+
+	for range ticker.C {
+		prev = m.checkHitRate(prev)
+	}
+}
+
+// checkHitRate alerts when the hit rate since prev is below the threshold,
+// and returns the stats the next interval is measured from. Intervals
+// without hits or misses don't alert.
+func (m *cache) checkHitRate(prev CacheStats) CacheStats {
+	cur := m.stats.snapshot()
+
+	hits := cur.Hits - prev.Hits
+	total := hits + cur.Misses - prev.Misses
+
+	if total == 0 {
+		return cur
+	}
+
+	rate := float64(hits) / float64(total)
+	if rate >= m.cfg.HitRateAlertThreshold {
+		return cur
+	}
+
+	if m.cfg.HitRateAlertCallback != nil {
+		m.cfg.HitRateAlertCallback(rate)
+	} else {
+		log.Printf("Warning: cache hit rate %.2f is below threshold %.2f", rate, m.cfg.HitRateAlertThreshold)
+	}
+
+	return cur
+}
@@ -0,0 +1,43 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"testing"
+)
+
+func TestCache_CheckHitRate(t *testing.T) {
+	var alerts []float64
+
+	m := &cache{cfg: &Config{
+		HitRateAlertThreshold: 0.5,
+		HitRateAlertCallback: func(rate float64) {
+			alerts = append(alerts, rate)
+		},
+	}}
+
+	record := func(hits, misses int) {
+		for i := 0; i < hits; i++ {
+			m.stats.record(requestOutcome{status: cacheHitStatus})
+		}
+
+		for i := 0; i < misses; i++ {
+			m.stats.record(requestOutcome{status: cacheMissStatus})
+		}
+	}
+
+	prev := m.stats.snapshot()
+
+	// Only the requests of each interval count.
+	record(9, 1)
+	prev = m.checkHitRate(prev)
+
+	record(1, 3)
+	prev = m.checkHitRate(prev)
+
+	// Intervals without traffic don't alert.
+	m.checkHitRate(prev)
+
+	if len(alerts) != 1 || alerts[0] != 0.25 {
+		t.Errorf("unexpected alerts: %v", alerts)
+	}
+}
@@ -4,11 +4,24 @@
 package plugin_simpleforcecache
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,29 +35,378 @@ type Config struct {
 	Force             bool     `json:"force"             toml:"force"             yaml:"force"`
 	CacheHeaders      []string `json:"cacheHeaders"      toml:"cacheHeaders"      yaml:"cacheHeaders"`
 	CachePathPrefixes []string `json:"cachePathPrefixes" toml:"cachePathPrefixes" yaml:"cachePathPrefixes"`
+
+	TranscodeCacheEncoding bool `json:"transcodeCacheEncoding" toml:"transcodeCacheEncoding" yaml:"transcodeCacheEncoding"`
+	DetectCollisions       bool `json:"detectCollisions"       toml:"detectCollisions"       yaml:"detectCollisions"`
+
+	EarlyExpirationFactor float64 `json:"earlyExpirationFactor" toml:"earlyExpirationFactor" yaml:"earlyExpirationFactor"`
+
+	FallbackURL     string `json:"fallbackURL"     toml:"fallbackURL"     yaml:"fallbackURL"`
+	UpstreamTimeout int    `json:"upstreamTimeout" toml:"upstreamTimeout" yaml:"upstreamTimeout"`
+
+	SynthesizeCacheControl bool `json:"synthesizeCacheControl" toml:"synthesizeCacheControl" yaml:"synthesizeCacheControl"`
+
+	BackendAddresses []string `json:"backendAddresses" toml:"backendAddresses" yaml:"backendAddresses"`
+	VirtualNodes     int      `json:"virtualNodes"     toml:"virtualNodes"     yaml:"virtualNodes"`
+
+	LogMisses     bool      `json:"logMisses" toml:"logMisses" yaml:"logMisses"`
+	MissLogWriter io.Writer `json:"-"         toml:"-"         yaml:"-"`
+
+	InvalidationChannel string `json:"invalidationChannel" toml:"invalidationChannel" yaml:"invalidationChannel"`
+	// InvalidationBackend shares invalidations between instances in place of
+	// InvalidationChannel. It can only be set programmatically.
+	InvalidationBackend InvalidationBackend `json:"-" toml:"-" yaml:"-"`
+
+	WarmThroughOn404   bool   `json:"warmThroughOn404"   toml:"warmThroughOn404"   yaml:"warmThroughOn404"`
+	CanonicalURLHeader string `json:"canonicalURLHeader" toml:"canonicalURLHeader" yaml:"canonicalURLHeader"`
+
+	HashKey       bool   `json:"hashKey"       toml:"hashKey"       yaml:"hashKey"`
+	HashAlgorithm string `json:"hashAlgorithm" toml:"hashAlgorithm" yaml:"hashAlgorithm"`
+
+	MemoryFallbackSize int `json:"memoryFallbackSize" toml:"memoryFallbackSize" yaml:"memoryFallbackSize"`
+
+	CacheCookies []string `json:"cacheCookies" toml:"cacheCookies" yaml:"cacheCookies"`
+
+	PromoteThreshold  int `json:"promoteThreshold"  toml:"promoteThreshold"  yaml:"promoteThreshold"`
+	PromoteMemorySize int `json:"promoteMemorySize" toml:"promoteMemorySize" yaml:"promoteMemorySize"`
+
+	BodyStorageEncoding string `json:"bodyStorageEncoding" toml:"bodyStorageEncoding" yaml:"bodyStorageEncoding"`
+
+	StaleTolerance int `json:"staleTolerance" toml:"staleTolerance" yaml:"staleTolerance"`
+
+	CompressCache     bool `json:"compressCache"     toml:"compressCache"     yaml:"compressCache"`
+	CompressThreshold int  `json:"compressThreshold" toml:"compressThreshold" yaml:"compressThreshold"`
+
+	OverwriteHeadersOnStore map[string]string `json:"overwriteHeadersOnStore" toml:"overwriteHeadersOnStore" yaml:"overwriteHeadersOnStore"`
+
+	AccessLog       bool      `json:"accessLog" toml:"accessLog" yaml:"accessLog"`
+	AccessLogWriter io.Writer `json:"-"         toml:"-"         yaml:"-"`
+
+	TTLOverrideHeader string `json:"ttlOverrideHeader" toml:"ttlOverrideHeader" yaml:"ttlOverrideHeader"`
+
+	DeduplicateResponses bool `json:"deduplicateResponses" toml:"deduplicateResponses" yaml:"deduplicateResponses"`
+
+	HealthCheckURL      string `json:"healthCheckURL"      toml:"healthCheckURL"      yaml:"healthCheckURL"`
+	HealthCheckInterval int    `json:"healthCheckInterval" toml:"healthCheckInterval" yaml:"healthCheckInterval"`
+	FailOpenOnUnhealthy bool   `json:"failOpenOnUnhealthy" toml:"failOpenOnUnhealthy" yaml:"failOpenOnUnhealthy"`
+
+	AdminAPI   bool   `json:"adminAPI" toml:"adminAPI" yaml:"adminAPI"`
+	AdminToken string `json:"adminToken" toml:"adminToken" yaml:"adminToken"`
+
+	UpstreamHeaders map[string]string `json:"upstreamHeaders" toml:"upstreamHeaders" yaml:"upstreamHeaders"`
+
+	NormalizeStatusCode map[int]int `json:"normalizeStatusCode" toml:"normalizeStatusCode" yaml:"normalizeStatusCode"`
+
+	UnderstoodStatusCodes []int `json:"understoodStatusCodes" toml:"understoodStatusCodes" yaml:"understoodStatusCodes"`
+
+	SitemapURL             string `json:"sitemapURL"             toml:"sitemapURL"             yaml:"sitemapURL"`
+	SitemapWarmConcurrency int    `json:"sitemapWarmConcurrency" toml:"sitemapWarmConcurrency" yaml:"sitemapWarmConcurrency"`
+	SitemapWarmDelay       int    `json:"sitemapWarmDelay"       toml:"sitemapWarmDelay"       yaml:"sitemapWarmDelay"`
+
+	IgnoreQueryParams    []string `json:"ignoreQueryParams"    toml:"ignoreQueryParams"    yaml:"ignoreQueryParams"`
+	RemoveTrackingParams bool     `json:"removeTrackingParams" toml:"removeTrackingParams" yaml:"removeTrackingParams"`
+
+	BypassUserAgents  []string `json:"bypassUserAgents"  toml:"bypassUserAgents"  yaml:"bypassUserAgents"`
+	NoCacheUserAgents []string `json:"noCacheUserAgents" toml:"noCacheUserAgents" yaml:"noCacheUserAgents"`
+
+	BypassSampleRate float64 `json:"bypassSampleRate" toml:"bypassSampleRate" yaml:"bypassSampleRate"`
+
+	UpstreamRetries    int `json:"upstreamRetries"    toml:"upstreamRetries"    yaml:"upstreamRetries"`
+	UpstreamRetryDelay int `json:"upstreamRetryDelay" toml:"upstreamRetryDelay" yaml:"upstreamRetryDelay"`
+
+	PathTemplates []string `json:"pathTemplates" toml:"pathTemplates" yaml:"pathTemplates"`
+
+	RespectNoTransform bool `json:"respectNoTransform" toml:"respectNoTransform" yaml:"respectNoTransform"`
+
+	HotKeyThreshold     int     `json:"hotKeyThreshold"     toml:"hotKeyThreshold"     yaml:"hotKeyThreshold"`
+	HotKeyTTLMultiplier float64 `json:"hotKeyTTLMultiplier" toml:"hotKeyTTLMultiplier" yaml:"hotKeyTTLMultiplier"`
+
+	// ValidateResponse, when set, is called with a copy of each cacheable
+	// response before it is stored; it can reject responses carrying
+	// application-level errors. It can only be set programmatically.
+	ValidateResponse func(status int, headers http.Header, body []byte) bool `json:"-" toml:"-" yaml:"-"`
+
+	StripUpstreamRequestHeaders []string `json:"stripUpstreamRequestHeaders" toml:"stripUpstreamRequestHeaders" yaml:"stripUpstreamRequestHeaders"`
+
+	PathUpstreamTimeouts map[string]int `json:"pathUpstreamTimeouts" toml:"pathUpstreamTimeouts" yaml:"pathUpstreamTimeouts"`
+
+	ReplicaPath string `json:"replicaPath" toml:"replicaPath" yaml:"replicaPath"`
+
+	AddXCacheHeader bool `json:"addXCacheHeader" toml:"addXCacheHeader" yaml:"addXCacheHeader"`
+
+	// Clock is the time source used for entry expiry, defaulting to
+	// time.Now. It can only be set programmatically, mostly for tests.
+	Clock func() time.Time `json:"-" toml:"-" yaml:"-"`
+
+	AddBodyHashHeader bool `json:"addBodyHashHeader" toml:"addBodyHashHeader" yaml:"addBodyHashHeader"`
+
+	MaxConcurrentMissesPerKey int `json:"maxConcurrentMissesPerKey" toml:"maxConcurrentMissesPerKey" yaml:"maxConcurrentMissesPerKey"`
+	MissWaitTimeout           int `json:"missWaitTimeout"           toml:"missWaitTimeout"           yaml:"missWaitTimeout"`
+
+	RequestUpstreamGzip bool `json:"requestUpstreamGzip" toml:"requestUpstreamGzip" yaml:"requestUpstreamGzip"`
+
+	UpstreamQueryParams []string `json:"upstreamQueryParams" toml:"upstreamQueryParams" yaml:"upstreamQueryParams"`
+
+	WriteQueueSize int `json:"writeQueueSize" toml:"writeQueueSize" yaml:"writeQueueSize"`
+	WriteWorkers   int `json:"writeWorkers"   toml:"writeWorkers"   yaml:"writeWorkers"`
+
+	CacheAuthenticated bool     `json:"cacheAuthenticated" toml:"cacheAuthenticated" yaml:"cacheAuthenticated"`
+	AuthHeaders        []string `json:"authHeaders"        toml:"authHeaders"        yaml:"authHeaders"`
+
+	BypassCIDRs []string `json:"bypassCIDRs" toml:"bypassCIDRs" yaml:"bypassCIDRs"`
+
+	AutoVary bool `json:"autoVary" toml:"autoVary" yaml:"autoVary"`
+
+	WriteBatchSize          int `json:"writeBatchSize"          toml:"writeBatchSize"          yaml:"writeBatchSize"`
+	WriteBatchFlushInterval int `json:"writeBatchFlushInterval" toml:"writeBatchFlushInterval" yaml:"writeBatchFlushInterval"`
+
+	NormalizeHost bool `json:"normalizeHost" toml:"normalizeHost" yaml:"normalizeHost"`
+
+	RetryOnEmptyBody    bool `json:"retryOnEmptyBody"    toml:"retryOnEmptyBody"    yaml:"retryOnEmptyBody"`
+	EmptyBodyRetries    int  `json:"emptyBodyRetries"    toml:"emptyBodyRetries"    yaml:"emptyBodyRetries"`
+	EmptyBodyRetryDelay int  `json:"emptyBodyRetryDelay" toml:"emptyBodyRetryDelay" yaml:"emptyBodyRetryDelay"`
+
+	LockTimeout int `json:"lockTimeout" toml:"lockTimeout" yaml:"lockTimeout"`
+
+	HitRateAlertThreshold float64 `json:"hitRateAlertThreshold" toml:"hitRateAlertThreshold" yaml:"hitRateAlertThreshold"`
+	HitRateAlertInterval  int     `json:"hitRateAlertInterval"  toml:"hitRateAlertInterval"  yaml:"hitRateAlertInterval"`
+
+	// HitRateAlertCallback is called with the hit rate of the last interval
+	// whenever it drops below HitRateAlertThreshold. It can only be set
+	// programmatically; a warning is logged otherwise.
+	HitRateAlertCallback func(rate float64) `json:"-" toml:"-" yaml:"-"`
+
+	RequestIDHeader string `json:"requestIDHeader" toml:"requestIDHeader" yaml:"requestIDHeader"`
+
+	// GenerateRequestID returns the ID sent upstream under RequestIDHeader,
+	// defaulting to a random hex string. It can only be set programmatically.
+	GenerateRequestID func() string `json:"-" toml:"-" yaml:"-"`
+
+	// BodyTransforms are applied in order to the bodies of responses stored
+	// on misses. It can only be set programmatically.
+	BodyTransforms []BodyTransform `json:"-" toml:"-" yaml:"-"`
+
+	Debug    bool `json:"debug"    toml:"debug"    yaml:"debug"`
+	HitDelay int  `json:"hitDelay" toml:"hitDelay" yaml:"hitDelay"`
+
+	PropagateContext bool `json:"propagateContext" toml:"propagateContext" yaml:"propagateContext"`
+
+	SkipHealthCheck bool `json:"skipHealthCheck" toml:"skipHealthCheck" yaml:"skipHealthCheck"`
+
+	PrefetchLinks       bool `json:"prefetchLinks"       toml:"prefetchLinks"       yaml:"prefetchLinks"`
+	PrefetchDepth       int  `json:"prefetchDepth"       toml:"prefetchDepth"       yaml:"prefetchDepth"`
+	PrefetchConcurrency int  `json:"prefetchConcurrency" toml:"prefetchConcurrency" yaml:"prefetchConcurrency"`
+
+	NoCacheRequestContentTypes []string `json:"noCacheRequestContentTypes" toml:"noCacheRequestContentTypes" yaml:"noCacheRequestContentTypes"`
+
+	MetadataOnlyCache bool `json:"metadataOnlyCache" toml:"metadataOnlyCache" yaml:"metadataOnlyCache"`
+
+	CacheErrorResponses bool `json:"cacheErrorResponses" toml:"cacheErrorResponses" yaml:"cacheErrorResponses"`
+	ErrorTTL            int  `json:"errorTTL"            toml:"errorTTL"            yaml:"errorTTL"`
+
+	// WarmupDone, when set, is closed once every URL of SitemapURL and
+	// WarmupRedisListKey has been warmed, so callers can wait before
+	// accepting traffic. It is closed right away when there is nothing to
+	// warm. It can only be set programmatically.
+	WarmupDone chan struct{} `json:"-" toml:"-" yaml:"-"`
+
+	CacheTagHeader string `json:"cacheTagHeader" toml:"cacheTagHeader" yaml:"cacheTagHeader"`
+
+	XFetchBeta float64 `json:"xFetchBeta" toml:"xFetchBeta" yaml:"xFetchBeta"`
+
+	VaryByScheme bool `json:"varyByScheme" toml:"varyByScheme" yaml:"varyByScheme"`
+
+	PassCloudflareStatus bool `json:"passCloudflareStatus" toml:"passCloudflareStatus" yaml:"passCloudflareStatus"`
+
+	ConditionalRevalidate bool `json:"conditionalRevalidate" toml:"conditionalRevalidate" yaml:"conditionalRevalidate"`
+
+	GlobalMaxAge int `json:"globalMaxAge" toml:"globalMaxAge" yaml:"globalMaxAge"`
+
+	MissBudget         int `json:"missBudget"         toml:"missBudget"         yaml:"missBudget"`
+	MissBudgetWindow   int `json:"missBudgetWindow"   toml:"missBudgetWindow"   yaml:"missBudgetWindow"`
+	MissBudgetCooldown int `json:"missBudgetCooldown" toml:"missBudgetCooldown" yaml:"missBudgetCooldown"`
+
+	DynamicConfigHeader  string `json:"dynamicConfigHeader"  toml:"dynamicConfigHeader"  yaml:"dynamicConfigHeader"`
+	DynamicConfigTrusted bool   `json:"dynamicConfigTrusted" toml:"dynamicConfigTrusted" yaml:"dynamicConfigTrusted"`
+
+	ShadowCachePrefixes []string `json:"shadowCachePrefixes" toml:"shadowCachePrefixes" yaml:"shadowCachePrefixes"`
+
+	CleanupWorkers int `json:"cleanupWorkers" toml:"cleanupWorkers" yaml:"cleanupWorkers"`
+
+	LogKeyMaxLen int `json:"logKeyMaxLen" toml:"logKeyMaxLen" yaml:"logKeyMaxLen"`
+
+	// TenantIDExtractor, when set, returns the tenant of a request, which is
+	// prepended to the cache key so tenants never share entries. See
+	// HeaderTenantExtractor, PathSegmentTenantExtractor and
+	// JWTClaimTenantExtractor. It can only be set programmatically.
+	TenantIDExtractor func(r *http.Request) string `json:"-" toml:"-" yaml:"-"`
+
+	CacheReadTimeout int `json:"cacheReadTimeout" toml:"cacheReadTimeout" yaml:"cacheReadTimeout"`
+
+	WarmupRedisAddr    string `json:"warmupRedisAddr"    toml:"warmupRedisAddr"    yaml:"warmupRedisAddr"`
+	WarmupRedisListKey string `json:"warmupRedisListKey" toml:"warmupRedisListKey" yaml:"warmupRedisListKey"`
+	ClearWarmupList    bool   `json:"clearWarmupList"    toml:"clearWarmupList"    yaml:"clearWarmupList"`
+
+	StaleNoStoreDownstream bool `json:"staleNoStoreDownstream" toml:"staleNoStoreDownstream" yaml:"staleNoStoreDownstream"`
+
+	RespectClientNoCache bool     `json:"respectClientNoCache" toml:"respectClientNoCache" yaml:"respectClientNoCache"`
+	TrustedOrigins       []string `json:"trustedOrigins"       toml:"trustedOrigins"       yaml:"trustedOrigins"`
+
+	UseSendfile bool `json:"useSendfile" toml:"useSendfile" yaml:"useSendfile"`
+
+	WarmConcurrency int     `json:"warmConcurrency" toml:"warmConcurrency" yaml:"warmConcurrency"`
+	WarmRateLimit   float64 `json:"warmRateLimit"   toml:"warmRateLimit"   yaml:"warmRateLimit"`
+
+	AutoInvalidateOnWrite bool `json:"autoInvalidateOnWrite" toml:"autoInvalidateOnWrite" yaml:"autoInvalidateOnWrite"`
+
+	// InvalidationURLMapper, when set, returns the paths whose GET entries
+	// are deleted after a successful write to path with AutoInvalidateOnWrite,
+	// instead of path itself. It can only be set programmatically.
+	InvalidationURLMapper func(method, path string) []string `json:"-" toml:"-" yaml:"-"`
+
+	JWTClaimCacheKey    string `json:"jwtClaimCacheKey"    toml:"jwtClaimCacheKey"    yaml:"jwtClaimCacheKey"`
+	JWTClaimTrustedAuth bool   `json:"jwtClaimTrustedAuth" toml:"jwtClaimTrustedAuth" yaml:"jwtClaimTrustedAuth"`
+
+	AddStatusHeaderForAll bool `json:"addStatusHeaderForAll" toml:"addStatusHeaderForAll" yaml:"addStatusHeaderForAll"`
+
+	FingerprintRevalidate bool `json:"fingerprintRevalidate" toml:"fingerprintRevalidate" yaml:"fingerprintRevalidate"`
+
+	DomainMaxExpiry map[string]int `json:"domainMaxExpiry" toml:"domainMaxExpiry" yaml:"domainMaxExpiry"`
+
+	FastPathPrefixes []string `json:"fastPathPrefixes" toml:"fastPathPrefixes" yaml:"fastPathPrefixes"`
+
+	MethodTTL map[string]int `json:"methodTTL" toml:"methodTTL" yaml:"methodTTL"`
+
+	PersistWriteQueue bool `json:"persistWriteQueue" toml:"persistWriteQueue" yaml:"persistWriteQueue"`
+}
+
+// lockTimeout returns how long cleanup sweeps wait for the cache lock.
+func (c *Config) lockTimeout() time.Duration {
+	return time.Duration(c.LockTimeout) * time.Millisecond
+}
+
+// closeWarmupDone closes WarmupDone, if set.
+func (c *Config) closeWarmupDone() {
+	if c.WarmupDone != nil {
+		close(c.WarmupDone)
+	}
+}
+
+// globalMaxAge returns the age past which cleanup sweeps delete entries.
+func (c *Config) globalMaxAge() time.Duration {
+	return time.Duration(c.GlobalMaxAge) * time.Second
+}
+
+// clock returns the configured time source.
+func (c *Config) clock() func() time.Time {
+	if c.Clock != nil {
+		return c.Clock
+	}
+
+	return time.Now
+}
+
+// now returns the current time according to the configured clock.
+func (c *Config) now() time.Time {
+	return c.clock()()
+}
+
+// WithResponseValidator returns the default config with ValidateResponse set
+// to fn. fn receives copies of the response headers and body, and the
+// response is only cached if it returns true.
+func WithResponseValidator(fn func(status int, headers http.Header, body []byte) bool) *Config {
+	cfg := CreateConfig()
+	cfg.ValidateResponse = fn
+
+	return cfg
 }
 
 // CreateConfig returns a config instance.
 func CreateConfig() *Config {
 	return &Config{ //nolint:exhaustruct // zero values are intentional defaults
-		MaxExpiry:       int((5 * time.Minute).Seconds()),
-		Cleanup:         int((5 * time.Minute).Seconds()),
-		AddStatusHeader: true,
+		MaxExpiry:             int((5 * time.Minute).Seconds()),
+		Cleanup:               int((5 * time.Minute).Seconds()),
+		AddStatusHeader:       true,
+		CompressThreshold:     1024,
+		UnderstoodStatusCodes: append([]int(nil), defaultUnderstoodStatusCodes...),
+		NormalizeHost:         true,
+
+		NoCacheRequestContentTypes: []string{"multipart/form-data", "application/x-www-form-urlencoded"},
+
+		CacheTagHeader: "X-Cache-Tags",
+
+		XFetchBeta: 1,
+
+		CleanupWorkers: 1,
+
+		LogKeyMaxLen: defaultLogKeyMaxLen,
+
+		StaleNoStoreDownstream: true,
+
+		UseSendfile: true,
 	}
 }
 
+// Environment variables that disable caching, for tests.
+const (
+	disableEnv   = "SIMPLECACHE_DISABLE"
+	forceMissEnv = "SIMPLECACHE_FORCE_MISS"
+)
+
 const (
-	cacheHeader      = "Cache-Status"
-	cacheHitStatus   = "hit"
-	cacheMissStatus  = "miss"
-	cacheErrorStatus = "error"
+	cacheHeader            = "Cache-Status"
+	xCacheHeader           = "X-Cache"
+	bodyHashHeader         = "X-Body-Hash"
+	cacheHitStatus         = "hit"
+	cacheMissStatus        = "miss"
+	cacheErrorStatus       = "error"
+	cacheFallbackStatus    = "fallback"
+	cacheStaleStatus       = "stale"
+	cacheBypassStatus      = "bypass"
+	cacheSampledStatus     = "bypass-sampled"
+	cacheRevalidatedStatus = "revalidated"
+	cacheUpgradeStatus     = "bypass-upgrade"
+	cacheUncachedStatus    = "uncached"
 )
 
 type cache struct {
-	name  string
-	cache *fileCache
-	cfg   *Config
-	next  http.Handler
+	name    string
+	cache   storage
+	cfg     *Config
+	next    http.Handler
+	missLog *log.Logger
+
+	accessLog    *log.Logger
+	invalidation InvalidationBackend
+	hasher       hasher
+	dedupe       *contentIndex
+	health       *healthChecker
+	hotKeys      *hotKeyTracker
+	misses       *missLimiter
+	missBudget   *missBudget
+	writeQueue   *writeQueue
+	wal          *writeAheadLog
+	vary         *varyIndex
+
+	// invalidations queues the invalidations published in the background.
+	invalidations chan invalidationMessage
+
+	stats     cacheStats
+	forceMiss bool
+
+	bypassUserAgents  []*regexp.Regexp
+	bypassNetworks    []*net.IPNet
+	noCacheUserAgents []*regexp.Regexp
+	trustedOrigins    *origins
+
+	fingerprints *keySet
+	fastPath     *fastPathIndex
+
+	// canonicalWarms holds the aliases whose canonical URL is being warmed.
+	canonicalWarms *keySet
+
+	// prefetches holds a slot for each prefetch running in the background.
+	prefetches chan struct{}
 }
 
 // New returns a plugin instance.
@@ -57,111 +419,1127 @@ func New(_ context.Context, next http.Handler, cfg *Config, name string) (http.H
 		return nil, errors.New("cleanup must be greater or equal to 1")
 	}
 
-	fc, err := newFileCache(cfg.Path, time.Duration(cfg.Cleanup)*time.Second)
+	if cfg.EarlyExpirationFactor != 0 && cfg.EarlyExpirationFactor <= 1 {
+		return nil, errors.New("earlyExpirationFactor must be greater than 1")
+	}
+
+	switch cfg.BodyStorageEncoding {
+	case "", bodyStorageBase64, bodyStorageUTF8, bodyStorageNone:
+	default:
+		return nil, fmt.Errorf("unsupported bodyStorageEncoding %q", cfg.BodyStorageEncoding)
+	}
+
+	if cfg.UpstreamRetries < 0 || cfg.UpstreamRetryDelay < 0 {
+		return nil, errors.New("upstreamRetries and upstreamRetryDelay must not be negative")
+	}
+
+	if cfg.EmptyBodyRetries < 0 || cfg.EmptyBodyRetryDelay < 0 {
+		return nil, errors.New("emptyBodyRetries and emptyBodyRetryDelay must not be negative")
+	}
+
+	if cfg.BypassSampleRate < 0 || cfg.BypassSampleRate > 1 {
+		return nil, errors.New("bypassSampleRate must be between 0 and 1")
+	}
+
+	if cfg.HitRateAlertThreshold < 0 || cfg.HitRateAlertThreshold > 1 {
+		return nil, errors.New("hitRateAlertThreshold must be between 0 and 1")
+	}
+
+	if cfg.XFetchBeta < 0 {
+		return nil, errors.New("xFetchBeta must not be negative")
+	}
+
+	if cfg.GlobalMaxAge < 0 {
+		return nil, errors.New("globalMaxAge must not be negative")
+	}
+
+	if cfg.CleanupWorkers < 0 {
+		return nil, errors.New("cleanupWorkers must not be negative")
+	}
+
+	if cfg.LogKeyMaxLen < 0 {
+		return nil, errors.New("logKeyMaxLen must not be negative")
+	}
+
+	if cfg.CacheReadTimeout < 0 {
+		return nil, errors.New("cacheReadTimeout must not be negative")
+	}
+
+	if cfg.PersistWriteQueue && cfg.WriteQueueSize <= 0 {
+		return nil, errors.New("persistWriteQueue requires writeQueueSize")
+	}
+
+	// Batched writes are only buffered in memory when Set returns, so they
+	// would be committed to the write-ahead log before being persisted.
+	if cfg.PersistWriteQueue && cfg.WriteBatchSize > 0 {
+		return nil, errors.New("persistWriteQueue cannot be combined with writeBatchSize")
+	}
+
+	if cfg.DynamicConfigHeader != "" && !cfg.DynamicConfigTrusted {
+		return nil, errors.New("dynamicConfigHeader requires dynamicConfigTrusted")
+	}
+
+	if cfg.JWTClaimCacheKey != "" && !cfg.JWTClaimTrustedAuth {
+		return nil, errors.New("jwtClaimCacheKey requires jwtClaimTrustedAuth")
+	}
+
+	if cfg.AdminAPI && cfg.AdminToken == "" {
+		return nil, errors.New("adminToken is required with adminAPI")
+	}
+
+	if cfg.WarmupRedisAddr != "" && cfg.WarmupRedisListKey == "" {
+		return nil, errors.New("warmupRedisListKey is required with warmupRedisAddr")
+	}
+
+	for domain, seconds := range cfg.DomainMaxExpiry {
+		if seconds < 1 {
+			return nil, fmt.Errorf("domainMaxExpiry for %q must be greater or equal to 1", domain)
+		}
+	}
+
+	for method, ttl := range cfg.MethodTTL {
+		if ttl < 1 {
+			return nil, fmt.Errorf("methodTTL for %q must be greater or equal to 1", method)
+		}
+	}
+
+	if cfg.WarmConcurrency < 0 || cfg.WarmRateLimit < 0 {
+		return nil, errors.New("warmConcurrency and warmRateLimit must not be negative")
+	}
+
+	if cfg.MissBudget < 0 || cfg.MissBudgetWindow < 0 || cfg.MissBudgetCooldown < 0 {
+		return nil, errors.New("missBudget, missBudgetWindow and missBudgetCooldown must not be negative")
+	}
+
+	if cfg.FallbackURL != "" {
+		if _, err := url.ParseRequestURI(cfg.FallbackURL); err != nil { //nolint:noinlineerr // acceptable inline error
+			return nil, fmt.Errorf("invalid fallbackURL: %w", err)
+		}
+	}
+
+	if cfg.HealthCheckURL != "" {
+		if _, err := url.ParseRequestURI(cfg.HealthCheckURL); err != nil { //nolint:noinlineerr // acceptable inline error
+			return nil, fmt.Errorf("invalid healthCheckURL: %w", err)
+		}
+	}
+
+	if cfg.SitemapURL != "" {
+		if _, err := url.ParseRequestURI(cfg.SitemapURL); err != nil { //nolint:noinlineerr // acceptable inline error
+			return nil, fmt.Errorf("invalid sitemapURL: %w", err)
+		}
+	}
+
+	if cfg.HealthCheckInterval < 0 {
+		return nil, errors.New("healthCheckInterval must not be negative")
+	}
+
+	// Testing utilities for CI pipelines, not meant for production.
+	if os.Getenv(disableEnv) == "1" {
+		log.Printf("Caching disabled by %s", disableEnv)
+		cfg.closeWarmupDone()
+
+		return next, nil
+	}
+
+	st, err := newStorage(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	m := &cache{
+	if !cfg.SkipHealthCheck {
+		for _, dir := range cacheDirs(cfg) {
+			if err = probeCacheDir(dir); err != nil { //nolint:noinlineerr // acceptable inline error
+				return nil, fmt.Errorf("cache directory health check failed: %w", err)
+			}
+		}
+	}
+
+	m := &cache{ //nolint:exhaustruct // optional fields are set below
 		name:  name,
-		cache: fc,
+		cache: st,
 		cfg:   cfg,
 		next:  next,
 	}
 
-	return m, nil
+	if cfg.LogMisses {
+		w := cfg.MissLogWriter
+		if w == nil {
+			w = os.Stderr
+		}
+
+		m.missLog = log.New(w, "", 0)
+	}
+
+	if cfg.AccessLog {
+		w := cfg.AccessLogWriter
+		if w == nil {
+			w = os.Stderr
+		}
+
+		m.accessLog = log.New(w, "", 0)
+	}
+
+	m.bypassUserAgents, err = compilePatterns(cfg.BypassUserAgents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bypassUserAgents: %w", err)
+	}
+
+	m.noCacheUserAgents, err = compilePatterns(cfg.NoCacheUserAgents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid noCacheUserAgents: %w", err)
+	}
+
+	m.bypassNetworks, err = parseCIDRs(cfg.BypassCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bypassCIDRs: %w", err)
+	}
+
+	m.trustedOrigins = parseOrigins(cfg.TrustedOrigins)
+
+	if len(cfg.FastPathPrefixes) > 0 {
+		m.fastPath = newFastPathIndex()
+	}
+
+	if cfg.FingerprintRevalidate {
+		m.fingerprints = &keySet{keys: map[string]struct{}{}} //nolint:exhaustruct // zero mutex is ready to use
+	}
+
+	if cfg.PrefetchLinks {
+		m.prefetches = make(chan struct{}, maxPrefetchRuns)
+	}
+
+	if cfg.WarmThroughOn404 {
+		m.canonicalWarms = &keySet{keys: map[string]struct{}{}} //nolint:exhaustruct // zero mutex is ready to use
+	}
+
+	if cfg.HealthCheckURL != "" {
+		interval := cfg.HealthCheckInterval
+		if interval == 0 {
+			interval = defaultHealthCheckInterval
+		}
+
+		m.health = newHealthChecker(cfg.HealthCheckURL, time.Duration(interval)*time.Second)
+	}
+
+	if cfg.MaxConcurrentMissesPerKey > 0 {
+		m.misses = newMissLimiter(cfg.MaxConcurrentMissesPerKey)
+	}
+
+	if cfg.HotKeyThreshold > 0 {
+		m.hotKeys = newHotKeyTracker(cfg.HotKeyThreshold, time.Minute, cfg.clock())
+	}
+
+	if cfg.MissBudget > 0 {
+		window := cfg.MissBudgetWindow
+		if window <= 0 {
+			window = defaultMissBudgetWindow
+		}
+
+		cooldown := cfg.MissBudgetCooldown
+		if cooldown <= 0 {
+			cooldown = defaultMissBudgetCooldown
+		}
+
+		m.missBudget = newMissBudget(cfg.MissBudget, time.Duration(window)*time.Second, time.Duration(cooldown)*time.Second, cfg.clock())
+	}
+
+	if cfg.AutoVary {
+		m.vary = newVaryIndex()
+	}
+
+	if cfg.DeduplicateResponses {
+		m.dedupe = newContentIndex()
+	}
+
+	if cfg.HashKey {
+		m.hasher, err = newHasher(cfg.HashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.invalidation = cfg.InvalidationBackend
+	if m.invalidation == nil && cfg.InvalidationChannel != "" {
+		m.invalidation, err = newInvalidationBackend(cfg.InvalidationChannel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.invalidation != nil {
+		m.invalidations = make(chan invalidationMessage, invalidationQueueSize)
+		go m.publishInvalidations()
+
+		m.invalidation.Subscribe(m.deleteLocal, m.purgeLocalTag)
+	}
+
+	if cfg.HitDelay > 0 && !cfg.Debug {
+		log.Printf("Ignoring hitDelay, which is only honored in debug mode")
+	}
+
+	if os.Getenv(forceMissEnv) == "1" {
+		log.Printf("Cache lookups disabled by %s", forceMissEnv)
+
+		m.forceMiss = true
+	}
+
+	if cfg.WriteQueueSize > 0 {
+		m.writeQueue = newWriteQueue(cfg.WriteQueueSize)
+
+		if cfg.PersistWriteQueue {
+			path := filepath.Join(cfg.Path, walFileName)
+			m.replayWriteAheadLog(path)
+
+			m.wal, err = openWriteAheadLog(path)
+			if err != nil {
+				return nil, err
+			}
+
+			go m.wal.compactPeriodically(walCompactInterval)
+		}
+
+		m.startWriteWorkers(cfg.WriteWorkers)
+	}
+
+	if cfg.HitRateAlertThreshold > 0 {
+		interval := cfg.HitRateAlertInterval
+		if interval <= 0 {
+			interval = defaultHitRateAlertInterval
+		}
+
+		go m.watchHitRate(time.Duration(interval) * time.Second)
+	}
+
+	m.publishExpvars()
+
+	if cfg.SitemapURL == "" && cfg.WarmupRedisAddr == "" {
+		cfg.closeWarmupDone()
+	} else {
+		go func() {
+			if cfg.SitemapURL != "" {
+				m.warmSitemap(cfg.SitemapURL)
+			}
+
+			if cfg.WarmupRedisAddr != "" {
+				if err := m.warmRedisList(cfg.WarmupRedisAddr, cfg.WarmupRedisListKey); err != nil { //nolint:noinlineerr // acceptable inline error
+					log.Printf("Error warming from redis list %q: %v", cfg.WarmupRedisListKey, err)
+				}
+			}
+
+			cfg.closeWarmupDone()
+		}()
+	}
+
+	return m, nil
+}
+
+type cacheData struct {
+	Status          int                 `json:"status"`
+	Headers         map[string][]string `json:"headers"`
+	Body            []byte              `json:"body"`
+	BodyEncoding    string              `json:"bodyEncoding,omitempty"`
+	URL             string              `json:"url,omitempty"`
+	Expires         int64               `json:"expires,omitempty"`
+	ComputeDuration int64               `json:"computeDuration,omitempty"`
+	BodyText        string              `json:"bodyText,omitempty"`
+	BodyRaw         bool                `json:"bodyRaw,omitempty"`
+	Compressed      bool                `json:"compressed"`
+	Canonical       string              `json:"canonical,omitempty"`
+	Digest          string              `json:"digest,omitempty"`
+	RequestID       string              `json:"requestID,omitempty"`
+	Tags            []string            `json:"tags,omitempty"`
+	Created         int64               `json:"created,omitempty"`
+
+	// Key is recorded in tagged entries, so tag purges can drop the copies
+	// held outside the cache directories.
+	Key string `json:"key,omitempty"`
+
+	// bodyFile holds a raw body of bodySize bytes left in the entry file by
+	// readEntry, in place of Body.
+	bodyFile *os.File
+	bodySize int64
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.cfg.AdminAPI && (r.URL.Path == adminEntryPath || r.URL.Path == adminStatsPath) {
+		m.serveAdmin(w, r)
+		return
+	}
+
+	if m.accessLog == nil {
+		m.stats.record(m.serve(w, r))
+		return
+	}
+
+	cw := &countingWriter{ResponseWriter: w} //nolint:exhaustruct // zero values are intentional
+
+	out := m.serve(cw, r)
+	m.stats.record(out)
+	m.logAccess(r, out, cw.size)
+}
+
+// requestOutcome describes how serve handled a request.
+type requestOutcome struct {
+	status   string
+	key      string
+	upstream time.Duration
+}
+
+// serve handles a request and reports how it was served.
+//
+//nolint:gocyclo,funlen // complexity and length are acceptable for main handler
+func (m *cache) serve(w http.ResponseWriter, r *http.Request) requestOutcome {
+	// Protocol upgrades such as WebSockets are never cached.
+	if isUpgrade(r) {
+		m.setCacheStatus(w.Header(), cacheUpgradeStatus)
+
+		start := time.Now()
+		m.next.ServeHTTP(w, r)
+
+		return requestOutcome{status: cacheUpgradeStatus, key: "", upstream: time.Since(start)}
+	}
+
+	if m.cfg.AutoInvalidateOnWrite && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sw := &statusWriter{ResponseWriter: w} //nolint:exhaustruct // status is set by the handler
+		w = sw
+
+		defer func() {
+			if sw.status >= http.StatusOK && sw.status < http.StatusMultipleChoices {
+				m.invalidateWrite(r)
+			}
+		}()
+	}
+
+	r = m.withConfigOverride(r)
+
+	bypass := matchesAny(m.bypassUserAgents, r.UserAgent()) || m.authenticated(r) || m.noCacheContentType(r)
+
+	if !bypass && !m.matchesPathPrefix(r.URL.Path) && hasPathPrefix(r.URL.Path, m.cfg.ShadowCachePrefixes) {
+		return m.serveShadow(w, r)
+	}
+
+	// Skip caching if path doesn't match any configured prefix
+	if !m.matchesPathPrefix(r.URL.Path) || bypass {
+		if m.cfg.AddStatusHeaderForAll {
+			status := cacheBypassStatus
+			if !m.matchesPathPrefix(r.URL.Path) {
+				status = cacheUncachedStatus
+			}
+
+			w.Header().Set(cacheHeader, status)
+		}
+
+		start := time.Now()
+		m.next.ServeHTTP(w, r)
+
+		return requestOutcome{status: cacheBypassStatus, key: "", upstream: time.Since(start)}
+	}
+
+	// Internal clients, such as monitoring tools, never hit the cache.
+	if remoteInNetworks(r.RemoteAddr, m.bypassNetworks) {
+		m.setCacheStatus(w.Header(), cacheBypassStatus)
+
+		start := time.Now()
+		m.next.ServeHTTP(w, r)
+
+		return requestOutcome{status: cacheBypassStatus, key: "", upstream: time.Since(start)}
+	}
+
+	// Bypass a random sample of requests to compare against uncached traffic.
+	if m.cfg.BypassSampleRate > 0 && rand.Float64() < m.cfg.BypassSampleRate { //nolint:gosec // no need for crypto rand
+		m.setCacheStatus(w.Header(), cacheSampledStatus)
+
+		start := time.Now()
+		m.next.ServeHTTP(w, r)
+
+		return requestOutcome{status: cacheSampledStatus, key: "", upstream: time.Since(start)}
+	}
+
+	// HEAD requests are answered from the metadata of the GET entry.
+	if m.cfg.MetadataOnlyCache && r.Method == http.MethodHead {
+		if cs, _, served := m.lookup(w, r, m.metaKey(r)); served {
+			return requestOutcome{status: cs, key: m.metaKey(r), upstream: 0}
+		}
+	}
+
+	key := m.key(r)
+
+	if m.fastLookup(w, r, key) {
+		return requestOutcome{status: cacheHitStatus, key: key, upstream: 0}
+	}
+
+	cs, cached, served := m.lookup(w, r, key)
+	if served {
+		return requestOutcome{status: cs, key: key, upstream: 0}
+	}
+
+	if m.misses != nil {
+		release, waited := m.misses.acquire(r.Context(), key, time.Duration(m.cfg.MissWaitTimeout)*time.Millisecond)
+		defer release()
+
+		// Another request may have stored the entry while this one waited.
+		if waited {
+			if cs, cached, served = m.lookup(w, r, key); served {
+				return requestOutcome{status: cs, key: key, upstream: 0}
+			}
+		}
+	}
+
+	if !m.upstreamHealthy() {
+		return requestOutcome{status: m.serveUnhealthy(w, r, cached), key: key, upstream: 0}
+	}
+
+	if m.missBudget != nil {
+		if retryAfter, blocked := m.missBudget.blocked(key); blocked {
+			m.serveOverBudget(w, retryAfter)
+
+			return requestOutcome{status: cacheErrorStatus, key: key, upstream: 0}
+		}
+	}
+
+	m.setCacheStatus(w.Header(), cs)
+
+	if m.missLog != nil && cs == cacheMissStatus {
+		m.logMiss(r, key)
+	}
+
+	// Clients such as crawlers may read from the cache without updating it.
+	noStore := matchesAny(m.noCacheUserAgents, r.UserAgent())
+
+	stream := m.canStream() && !noStore && cached == nil
+
+	// Responses that may be replaced by a fallback, a retry or a stale copy,
+	// or whose headers depend on the whole body, are buffered.
+	buffered := m.cfg.FallbackURL != "" || m.cfg.UpstreamRetries > 0 || m.cfg.AddBodyHashHeader || m.cfg.RequestUpstreamGzip ||
+		m.cfg.RetryOnEmptyBody || m.cfg.ConditionalRevalidate || cached != nil
+
+	rw := &responseWriter{ResponseWriter: w, buffered: buffered, discardBody: stream} //nolint:exhaustruct // zero values are intentional
+
+	defer func() {
+		m.stats.downstreamBytes.Add(rw.BytesWritten)
+	}()
+
+	start := time.Now()
+
+	if m.cfg.SynthesizeCacheControl || stream {
+		rw.onWriteHeader = func(status int) {
+			if m.cfg.SynthesizeCacheControl {
+				m.synthesizeCacheControl(r, rw.Header(), status)
+			}
+
+			// Responses written without an explicit status are not cached.
+			if stream && rw.status != 0 {
+				m.startStream(m.learnVary(key, r, rw.Header()), r, rw, status, time.Since(start))
+			}
+		}
+	}
+
+	if stream {
+		// Discard the partial entry if the upstream handler panics.
+		defer rw.finishStream(true)
+	}
+
+	upstreamReq := r
+
+	etag := m.revalidationETag(cached)
+	if etag != "" {
+		upstreamReq = conditionalRequest(r, etag)
+	}
+
+	panicked := m.callUpstreamWithRetries(rw, upstreamReq)
+
+	computeDuration := time.Since(start)
+
+	if etag != "" && !panicked && rw.status == http.StatusNotModified {
+		m.refresh(r, key, cached)
+		m.serveCached(w, r, cached, cacheRevalidatedStatus)
+
+		return requestOutcome{status: cacheRevalidatedStatus, key: key, upstream: computeDuration}
+	}
+
+	if !panicked {
+		m.stats.recordMiss(rw.status)
+	}
+
+	if m.missBudget != nil {
+		if _, ok := m.cacheable(r, m.normalizeStatus(rw.status), rw.Header()); panicked || !ok {
+			m.missBudget.miss(key)
+		}
+	}
+
+	// A stale copy is preferred over both the error and the fallback.
+	if cached != nil && !panicked && rw.status >= http.StatusInternalServerError {
+		m.serveCached(w, r, cached, cacheStaleStatus)
+
+		return requestOutcome{status: cacheStaleStatus, key: key, upstream: computeDuration}
+	}
+
+	if m.cfg.FallbackURL != "" && (panicked || rw.status >= http.StatusInternalServerError) {
+		if m.serveFallback(w, r) {
+			return requestOutcome{status: cacheFallbackStatus, key: key, upstream: computeDuration}
+		}
+
+		if panicked {
+			w.WriteHeader(http.StatusBadGateway)
+
+			return requestOutcome{status: cacheErrorStatus, key: key, upstream: computeDuration}
+		}
+	}
+
+	if m.cfg.AddBodyHashHeader {
+		// Stored along with the other headers, so hits don't recompute it.
+		setBodyHash(rw.Header(), rw.body)
+	}
+
+	if m.upstreamGzip(r) && isGzipped(rw.Header()) {
+		// The client never asked for gzip: send it a decoded copy.
+		rw.commitDecoded()
+	} else {
+		rw.commit()
+	}
+
+	// Empty bodies that persisted through the retries are served, not cached.
+	if noStore || (m.cfg.RetryOnEmptyBody && emptyBody(rw)) {
+		return requestOutcome{status: cs, key: key, upstream: computeDuration}
+	}
+
+	if m.cfg.WarmThroughOn404 && rw.status == http.StatusNotFound {
+		m.warmCanonical(r, key, rw.Header())
+	}
+
+	if stream {
+		rw.finishStream(false)
+
+		return requestOutcome{status: cs, key: key, upstream: computeDuration}
+	}
+
+	m.store(m.learnVary(key, r, rw.Header()), r, rw, computeDuration, writePriorityHigh)
+
+	if m.cfg.PrefetchLinks && rw.status == http.StatusOK {
+		m.prefetchLinks(r, rw.Header(), rw.body)
+	}
+
+	return requestOutcome{status: cs, key: key, upstream: computeDuration}
+}
+
+// get reads key from the storage, giving up with a miss after
+// CacheReadTimeout so requests don't hang on an unresponsive disk.
+func (m *cache) get(key string) ([]byte, error) {
+	if m.cfg.CacheReadTimeout <= 0 {
+		return m.cache.Get(key)
+	}
+
+	type result struct {
+		b   []byte
+		err error
+	}
+
+	start := time.Now()
+	done := make(chan result, 1)
+
+	go func() {
+		b, err := m.cache.Get(key)
+		done <- result{b: b, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-time.After(time.Duration(m.cfg.CacheReadTimeout) * time.Millisecond):
+		log.Printf("Cache read of %q timed out after %s, forwarding upstream", m.displayKey(key), time.Since(start))
+
+		return nil, errCacheMiss
+	}
+}
+
+// lookup serves the entry stored under key if it can be used. Otherwise it
+// returns the cache status for the request and the entry to serve if the
+// upstream is unavailable, if any.
+func (m *cache) lookup(w http.ResponseWriter, r *http.Request, key string) (string, *cacheData, bool) {
+	var (
+		data  cacheData
+		found bool
+		err   error
+	)
+
+	if !m.forceMiss && !m.clientNoCache(r) {
+		found, err = m.readEntry(key, &data)
+	}
+
+	if !found {
+		return cacheMissStatus, nil, false
+	}
+
+	defer data.closeBody()
+
+	if err == nil && data.Canonical != "" {
+		err = m.resolveCanonical(&data)
+	}
+
+	switch {
+	case err != nil:
+		m.invalidate(key)
+
+		return cacheErrorStatus, nil, false
+	case m.cfg.DetectCollisions && data.URL != "" && data.URL != m.entryURL(r):
+		log.Printf("Cache key collision for %q: stored %q, requested %q", m.displayKey(key), data.URL, m.entryURL(r))
+
+		return cacheMissStatus, nil, false
+	case m.cfg.StaleTolerance > 0 && isStale(&data, m.cfg.now()) && withinStaleTolerance(&data, m.cfg):
+		// Expired within the stale tolerance: serve without revalidating.
+		m.serveCached(w, r, &data, cacheStaleStatus)
+
+		return cacheStaleStatus, nil, true
+	case m.revalidationETag(&data) != "" && isStale(&data, m.cfg.now()):
+		// Kept past its expiry to be revalidated with its ETag.
+		return cacheMissStatus, data.withBody(), false
+	case m.earlyExpiryBeta() > 0 && expiresEarly(&data, m.earlyExpiryBeta(), m.cfg.now()):
+		// Revalidate ahead of expiry to spread the load across requests.
+		return cacheMissStatus, data.withBody(), false
+	default:
+		if m.hotKeys != nil {
+			m.hotKeys.hit(key)
+		}
+
+		m.serveCached(w, r, &data, cacheHitStatus)
+
+		if m.fingerprints != nil && r.Method == http.MethodGet {
+			m.revalidateHit(r, key, data.Headers)
+		}
+
+		return cacheHitStatus, nil, true
+	}
+}
+
+// store saves the upstream response captured by rw under key, if cacheable.
+func (m *cache) store(key string, r *http.Request, rw *responseWriter, computeDuration time.Duration, priority writePriority) {
+	data, expiry, ok := m.newEntry(key, r, rw.status, rw.Header(), computeDuration)
+	if !ok {
+		return
+	}
+
+	if m.cfg.ValidateResponse != nil && !m.cfg.ValidateResponse(data.Status, rw.Header().Clone(), bytes.Clone(rw.body)) {
+		return
+	}
+
+	data.Body = rw.body
+	data.RequestID = rw.requestID
+
+	if len(m.cfg.BodyTransforms) > 0 && !m.noTransform(data.Headers) {
+		if err := transformBody(m.cfg.BodyTransforms, &data); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error transforming cache item: %v", err)
+			return
+		}
+	}
+
+	if m.cfg.TranscodeCacheEncoding && !m.noTransform(data.Headers) {
+		canonicalizeEncoding(&data)
+	}
+
+	if m.dedupe != nil {
+		m.deduplicate(key, &data)
+	}
+
+	entry, err := m.marshalEntry(&data)
+	if err != nil {
+		log.Printf("Error serializing cache item: %v", err)
+		return
+	}
+
+	if m.cfg.MetadataOnlyCache && r.Method == http.MethodGet {
+		m.storeMeta(key, data, expiry)
+	}
+
+	m.indexFastPath(key, r, data)
+
+	m.queueWrite(cacheWriteJob{key: key, entry: entry, expiry: expiry, priority: priority})
+}
+
+// newEntry returns the cache entry, without body, for a cacheable response
+// along with the duration it should be kept in storage.
+func (m *cache) newEntry(key string, r *http.Request, status int, h http.Header, computeDuration time.Duration) (cacheData, time.Duration, bool) {
+	status = m.normalizeStatus(status)
+
+	if isEventStream(h) {
+		return cacheData{}, 0, false //nolint:exhaustruct // empty entry
+	}
+
+	expiry, ok := m.cacheable(r, status, h)
+	if !ok {
+		return cacheData{}, 0, false //nolint:exhaustruct // empty entry
+	}
+
+	if ttl, ok := m.ttlOverride(r); ok {
+		expiry = ttl
+	}
+
+	if m.hotKeys != nil && m.hotKeys.hot(key) {
+		multiplier := m.cfg.HotKeyTTLMultiplier
+		if multiplier <= 0 {
+			multiplier = 1
+		}
+
+		expiry += time.Duration(multiplier * float64(m.maxExpiry(r)))
+	}
+
+	expiry = m.capExpiry(r, expiry)
+
+	// Filter out hop-by-hop headers that should not be cached
+	headers := make(map[string][]string)
+
+	for name, vals := range h {
+		if name == "Transfer-Encoding" || name == "Connection" {
+			continue
+		}
+
+		headers[name] = vals
+	}
+
+	// Normalize headers such as Server or Date across cache hits.
+	for name, val := range m.cfg.OverwriteHeadersOnStore {
+		headers[http.CanonicalHeaderKey(name)] = []string{val}
+	}
+
+	data := cacheData{ //nolint:exhaustruct // body fields are set by the caller
+		Status:          status,
+		Headers:         headers,
+		Expires:         m.cfg.now().Add(expiry).Unix(),
+		Created:         m.cfg.now().Unix(),
+		ComputeDuration: int64(computeDuration),
+		Tags:            cacheTags(h, m.cfg.CacheTagHeader),
+	}
+
+	if m.cfg.DetectCollisions {
+		data.URL = m.entryURL(r)
+	}
+
+	if len(data.Tags) > 0 {
+		data.Key = key
+	}
+
+	// Keep the entry on disk past its expiry so it can be served stale or
+	// revalidated.
+	expiry += time.Duration(m.cfg.StaleTolerance)*time.Second + m.revalidationRetention(headers)
+
+	return data, expiry, true
+}
+
+// setBodyHash sets the body hash header of h to the hash of body.
+func setBodyHash(h http.Header, body []byte) {
+	sum := sha256.Sum256(body)
+	h.Set(bodyHashHeader, "sha256="+hex.EncodeToString(sum[:]))
+}
+
+// rehashBody updates the body hash header of h, if any, once its body was
+// rewritten to body.
+func rehashBody(h http.Header, body []byte) {
+	if h.Get(bodyHashHeader) != "" {
+		setBodyHash(h, body)
+	}
+}
+
+func (m *cache) serveCached(w http.ResponseWriter, r *http.Request, data *cacheData, status string) {
+	if status == cacheHitStatus {
+		m.delayHit(r)
+	}
+
+	if data.bodyFile != nil && (m.cfg.TranscodeCacheEncoding || m.cfg.RequestUpstreamGzip) {
+		if err := data.loadBody(); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error reading cache entry: %v", err)
+		}
+	}
+
+	body := data.Body
+
+	for key, vals := range data.Headers {
+		for _, val := range vals {
+			w.Header().Add(key, val)
+		}
+	}
+
+	// Stale responses must not be kept by clients past this request.
+	if status == cacheStaleStatus && m.cfg.StaleNoStoreDownstream {
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+	}
+
+	switch {
+	case m.cfg.TranscodeCacheEncoding && !m.noTransform(data.Headers):
+		body = transcodeEncoding(w.Header(), r, data)
+	case m.cfg.RequestUpstreamGzip && isGzipped(w.Header()) && !acceptsEncoding(r.Header.Get("Accept-Encoding"), gzipEncoding):
+		body = decodeGzip(w.Header(), body)
+	}
+
+	if data.bodyFile != nil {
+		setBodyLength(w.Header(), data)
+	}
+
+	m.setCacheStatus(w.Header(), status)
+
+	w.WriteHeader(data.Status)
+
+	if data.bodyFile != nil {
+		m.stats.downstreamBytes.Add(copyBody(w, data))
+		return
+	}
+
+	n, _ := w.Write(body)
+	m.stats.downstreamBytes.Add(int64(n))
+}
+
+func (m *cache) cacheable(r *http.Request, status int, h http.Header) (time.Duration, bool) {
+	cfg := m.requestConfig(r)
+
+	if ttl, found := methodTTL(cfg, r.Method); found {
+		methodCfg := *cfg
+		methodCfg.MaxExpiry = ttl
+		cfg = &methodCfg
+	}
+
+	expiry, ok := IsCacheable(cfg, &http.Response{StatusCode: status, Header: h}) //nolint:exhaustruct // only status and headers are used
+	if !ok {
+		return 0, false
+	}
+
+	return m.capExpiry(r, expiry), true
+}
+
+// maxExpiry returns how long entries for r are kept when nothing shortens
+// their lifetime: the MaxExpiry of its config, replaced by MethodTTL and
+// capped by DomainMaxExpiry.
+func (m *cache) maxExpiry(r *http.Request) time.Duration {
+	cfg := m.requestConfig(r)
+
+	seconds := cfg.MaxExpiry
+	if ttl, found := methodTTL(cfg, r.Method); found {
+		seconds = ttl
+	}
+
+	return m.capExpiry(r, time.Duration(seconds)*time.Second)
+}
+
+// capExpiry caps the expiry of entries for r by their MethodTTL and
+// DomainMaxExpiry entries. It is applied last wherever an expiry is set.
+func (m *cache) capExpiry(r *http.Request, expiry time.Duration) time.Duration {
+	if ttl, found := methodTTL(m.requestConfig(r), r.Method); found && expiry > time.Duration(ttl)*time.Second {
+		expiry = time.Duration(ttl) * time.Second
+	}
+
+	if limit, found := m.domainMaxExpiry(r.Host); found && expiry > limit {
+		expiry = limit
+	}
+
+	return expiry
+}
+
+// methodTTL returns the MethodTTL entry of method, which replaces MaxExpiry
+// for its requests.
+func methodTTL(cfg *Config, method string) (int, bool) {
+	for name, ttl := range cfg.MethodTTL {
+		if strings.EqualFold(name, method) {
+			return ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+// domainMaxExpiry returns the TTL cap of host in DomainMaxExpiry, taken from
+// its exact entry or else the longest matching wildcard entry such as
+// *.example.com.
+func (m *cache) domainMaxExpiry(host string) (time.Duration, bool) {
+	if len(m.cfg.DomainMaxExpiry) == 0 {
+		return 0, false
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	if seconds, ok := m.cfg.DomainMaxExpiry[host]; ok {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	match := ""
+	limit := time.Duration(0)
+
+	for domain, seconds := range m.cfg.DomainMaxExpiry {
+		suffix, ok := strings.CutPrefix(strings.ToLower(domain), "*")
+		if ok && strings.HasSuffix(host, suffix) && len(suffix) > len(match) {
+			match = suffix
+			limit = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return limit, match != ""
+}
+
+// delayHit simulates network latency on cache hits, for tests.
+func (m *cache) delayHit(r *http.Request) {
+	if !m.cfg.Debug || m.cfg.HitDelay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(m.cfg.HitDelay) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context().Done():
+	case <-timer.C:
+	}
+}
+
+// setCacheStatus reports how the response was served through the enabled
+// status headers.
+func (m *cache) setCacheStatus(h http.Header, status string) {
+	if m.cfg.AddStatusHeader || m.cfg.AddStatusHeaderForAll {
+		h.Set(cacheHeader, status)
+	}
+
+	if m.cfg.AddXCacheHeader {
+		// Legacy clients only tell hits from misses.
+		result := "MISS"
+		if status == cacheHitStatus || status == cacheStaleStatus || status == cacheRevalidatedStatus {
+			result = "HIT"
+		}
+
+		h.Set(xCacheHeader, result+" from "+m.name)
+	}
+}
+
+// noTransform reports whether headers forbid the cache from modifying the
+// response body, when RespectNoTransform is set.
+func (m *cache) noTransform(headers map[string][]string) bool {
+	if !m.cfg.RespectNoTransform {
+		return false
+	}
+
+	h := http.Header(headers)
+
+	if _, ok := parseCacheControl(h.Values("Cache-Control"))["no-transform"]; ok {
+		return true
+	}
+
+	_, ok := parseCacheControl(h.Values("Pragma"))["no-transform"]
+
+	return ok
+}
+
+// normalizeStatus maps equivalent upstream status codes to the one they are
+// cached as.
+func (m *cache) normalizeStatus(status int) int {
+	if s, ok := m.cfg.NormalizeStatusCode[status]; ok {
+		return s
+	}
+
+	return status
+}
+
+// withinStaleTolerance reports whether an expired entry can still be served
+// stale. Entries kept for revalidation outlive the stale tolerance.
+func withinStaleTolerance(data *cacheData, cfg *Config) bool {
+	return cfg.now().Before(time.Unix(data.Expires, 0).Add(time.Duration(cfg.StaleTolerance) * time.Second))
 }
 
-type cacheData struct {
-	Status  int                 `json:"status"`
-	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
+// isStale reports whether an entry is past its expiry.
+func isStale(data *cacheData, now time.Time) bool {
+	return data.Expires != 0 && now.After(time.Unix(data.Expires, 0))
 }
 
-// ServeHTTP serves an HTTP request.
-//
-//nolint:gocyclo,funlen // complexity and length are acceptable for main handler
-func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Skip caching if path doesn't match any configured prefix
-	if !m.matchesPathPrefix(r.URL.Path) {
-		m.next.ServeHTTP(w, r)
-		return
+// expiresEarly implements probabilistic early expiration: the closer an entry
+// is to its expiry and the longer the upstream took to compute it, the more
+// likely a request is to revalidate it early.
+func expiresEarly(data *cacheData, factor float64, now time.Time) bool {
+	if data.Expires == 0 {
+		return false
 	}
 
-	cs := cacheMissStatus
+	// 1-Float64 is in (0, 1], which keeps the logarithm finite.
+	gap := -float64(data.ComputeDuration) * factor * math.Log(1-rand.Float64()) //nolint:gosec // no need for crypto rand
 
-	key := cacheKey(r, m.cfg.CacheHeaders)
+	return !now.Add(time.Duration(gap)).Before(time.Unix(data.Expires, 0))
+}
 
-	b, err := m.cache.Get(key)
-	if err == nil {
-		var data cacheData
+// earlyExpiryBeta returns the XFetch beta used for probabilistic early
+// expiration. EarlyExpirationFactor takes precedence over XFetchBeta.
+func (m *cache) earlyExpiryBeta() float64 {
+	if m.cfg.EarlyExpirationFactor > 0 {
+		return m.cfg.EarlyExpirationFactor
+	}
 
-		err := json.Unmarshal(b, &data)
-		if err != nil {
-			cs = cacheErrorStatus
-		} else {
-			for key, vals := range data.Headers {
-				for _, val := range vals {
-					w.Header().Add(key, val)
-				}
-			}
+	return m.cfg.XFetchBeta
+}
 
-			if m.cfg.AddStatusHeader {
-				w.Header().Set(cacheHeader, cacheHitStatus)
-			}
+// ttlOverride returns the TTL requested through the TTL override header.
+// Overrides are only honoured in force mode and are capped at the max expiry
+// of the request.
+func (m *cache) ttlOverride(r *http.Request) (time.Duration, bool) {
+	cfg := m.requestConfig(r)
+	if !cfg.Force || cfg.TTLOverrideHeader == "" {
+		return 0, false
+	}
 
-			w.WriteHeader(data.Status)
-			_, _ = w.Write(data.Body)
+	v := r.Header.Get(cfg.TTLOverrideHeader)
+	if v == "" {
+		return 0, false
+	}
 
-			return
-		}
+	ttl, err := strconv.Atoi(v)
+	if err != nil || ttl <= 0 {
+		return 0, false
 	}
 
-	if m.cfg.AddStatusHeader {
-		w.Header().Set(cacheHeader, cs)
+	if limit := m.maxExpiry(r); time.Duration(ttl)*time.Second > limit {
+		log.Printf("Requested TTL %ds for %q exceeds max expiry, using %s", ttl, requestURL(r), limit)
+
+		return limit, true
 	}
 
-	rw := &responseWriter{ResponseWriter: w} //nolint:exhaustruct // zero values are intentional
-	m.next.ServeHTTP(rw, r)
+	return time.Duration(ttl) * time.Second, true
+}
 
-	expiry, ok := m.cacheable(rw.status)
-	if !ok {
+// synthesizeCacheControl advertises the cache lifetime to downstream clients
+// for cacheable responses that don't carry their own Cache-Control header.
+func (m *cache) synthesizeCacheControl(r *http.Request, h http.Header, status int) {
+	if _, ok := m.cacheable(r, m.normalizeStatus(status), h); !ok {
 		return
 	}
 
-	// Filter out hop-by-hop headers that should not be cached
-	headers := make(map[string][]string)
+	cfg := m.requestConfig(r)
+	if h.Get("Cache-Control") != "" && !cfg.Force {
+		return
+	}
 
-	for key, vals := range w.Header() {
-		if key == "Transfer-Encoding" || key == "Connection" {
-			continue
-		}
+	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(cfg.MaxExpiry))
+}
 
-		headers[key] = vals
-	}
+// compilePatterns compiles the given regular expressions.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
 
-	data := cacheData{
-		Status:  rw.status,
-		Headers: headers,
-		Body:    rw.body,
-	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
 
-	b, err = json.Marshal(data)
-	if err != nil {
-		log.Printf("Error serializing cache item: %v", err)
+		res = append(res, re)
 	}
 
-	if err = m.cache.Set(key, b, expiry); err != nil { //nolint:noinlineerr // acceptable inline error
-		log.Printf("Error setting cache item: %v", err)
-	}
+	return res, nil
 }
 
-func (m *cache) cacheable(status int) (time.Duration, bool) {
-	if status != 200 {
-		return 0, false
+// matchesAny reports whether s matches any of the patterns.
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
 	}
 
-	return time.Duration(m.cfg.MaxExpiry) * time.Second, true
+	return false
 }
 
 func (m *cache) matchesPathPrefix(path string) bool {
@@ -170,8 +1548,14 @@ func (m *cache) matchesPathPrefix(path string) bool {
 		return true
 	}
 
+	return hasPathPrefix(path, m.cfg.CachePathPrefixes)
+}
+
+// hasPathPrefix reports whether path starts with one of prefixes, ignoring
+// case.
+func hasPathPrefix(path string, prefixes []string) bool {
 	lowerPath := strings.ToLower(path)
-	for _, prefix := range m.cfg.CachePathPrefixes {
+	for _, prefix := range prefixes {
 		if strings.HasPrefix(lowerPath, strings.ToLower(prefix)) {
 			return true
 		}
@@ -180,15 +1564,42 @@ func (m *cache) matchesPathPrefix(path string) bool {
 	return false
 }
 
-func cacheKey(r *http.Request, cacheHeaders []string) string {
+// key returns the storage key for a request.
+func (m *cache) key(r *http.Request) string {
+	key := cacheKey(r, m.cfg)
+	if m.vary != nil {
+		key += m.varyKey(r)
+	}
+
+	if m.hasher != nil {
+		return m.hasher.Hash(key)
+	}
+
+	return key
+}
+
+func cacheKey(r *http.Request, cfg *Config) string {
 	var builder strings.Builder
 
+	if cfg.TenantIDExtractor != nil {
+		if tenant := cfg.TenantIDExtractor(r); tenant != "" {
+			builder.WriteString("tenant:")
+			builder.WriteString(tenant)
+			builder.WriteString("|")
+		}
+	}
+
+	if cfg.VaryByScheme {
+		builder.WriteString(requestScheme(r))
+		builder.WriteString("|")
+	}
+
 	builder.WriteString(r.Method)
-	builder.WriteString(r.Host)
-	builder.WriteString(r.URL.Path)
+	builder.WriteString(keyHost(r, cfg))
+	builder.WriteString(templatedPath(r.URL.Path, cfg.PathTemplates))
 
 	// Add configured headers to the cache key (case-insensitive)
-	for _, headerName := range cacheHeaders {
+	for _, headerName := range cfg.CacheHeaders {
 		// Canonicalize header name to ensure case-insensitive matching
 		canonicalName := http.CanonicalHeaderKey(headerName)
 
@@ -201,22 +1612,463 @@ func cacheKey(r *http.Request, cacheHeaders []string) string {
 		}
 	}
 
+	// Add configured cookies to the cache key, leaving out any other cookie
+	// such as authentication tokens.
+	for _, cookieName := range cfg.CacheCookies {
+		cookie, err := r.Cookie(cookieName)
+		if err == nil {
+			builder.WriteString("|Cookie:")
+			builder.WriteString(cookie.Name)
+			builder.WriteString("=")
+			builder.WriteString(cookie.Value)
+		}
+	}
+
+	// Partition entries by a claim of the forwarded JWT, which a middleware
+	// in front of this one verifies.
+	if cfg.JWTClaimCacheKey != "" {
+		builder.WriteString("|JWT:")
+		builder.WriteString(cfg.JWTClaimCacheKey)
+		builder.WriteString("=")
+		builder.WriteString(bearerClaim(r, cfg.JWTClaimCacheKey))
+	}
+
 	return builder.String()
 }
 
+// parseCIDRs parses the given CIDR notations.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, network)
+	}
+
+	return res, nil
+}
+
+// remoteInNetworks reports whether the IP of a request's remote address is in
+// any of the networks.
+func remoteInNetworks(remoteAddr string, networks []*net.IPNet) bool {
+	if len(networks) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isUpgrade reports whether r asks to switch protocols, such as a WebSocket
+// handshake.
+func isUpgrade(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+
+	for _, val := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// noCacheContentType reports whether caching is skipped for r because of its
+// content type, such as file uploads.
+func (m *cache) noCacheContentType(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || len(m.cfg.NoCacheRequestContentTypes) == 0 {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	for _, noCache := range m.cfg.NoCacheRequestContentTypes {
+		if strings.EqualFold(mediaType, noCache) {
+			if m.cfg.Debug {
+				log.Printf("Bypassing cache for %q with content type %q", requestURL(r), mediaType)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticated reports whether caching is skipped for r because it carries
+// credentials, to prevent sharing responses across users.
+func (m *cache) authenticated(r *http.Request) bool {
+	if m.cfg.CacheAuthenticated {
+		return false
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	for _, name := range m.cfg.AuthHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyHost returns the host used in the cache key. With NormalizeHost, the
+// host is lowercased and the default port of the scheme is removed, so
+// http://EXAMPLE.COM:80/ and http://example.com/ share entries. The scheme is
+// the one given by requestScheme.
+func keyHost(r *http.Request, cfg *Config) string {
+	if !cfg.NormalizeHost {
+		return r.Host
+	}
+
+	host := strings.ToLower(r.Host)
+
+	defaultPort := ":80"
+	if requestScheme(r) == "https" {
+		defaultPort = ":443"
+	}
+
+	return strings.TrimSuffix(host, defaultPort)
+}
+
+// requestScheme returns the scheme the client used. TLS is usually terminated
+// before the middleware, so X-Forwarded-Proto takes precedence.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		proto, _, _ = strings.Cut(proto, ",")
+		return strings.ToLower(strings.TrimSpace(proto))
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// templatedPath returns the path used in the cache key. Paths matching one of the
+// templates, such as /api/users/{id}/posts, are keyed by the template and
+// the normalized variable values, e.g. /api/users/{id=42}/posts.
+func templatedPath(path string, templates []string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, template := range templates {
+		if key, ok := matchPathTemplate(segments, strings.Split(strings.Trim(template, "/"), "/")); ok {
+			return key
+		}
+	}
+
+	return path
+}
+
+func matchPathTemplate(segments, template []string) (string, bool) {
+	if len(segments) != len(template) {
+		return "", false
+	}
+
+	var builder strings.Builder
+
+	for i, part := range template {
+		builder.WriteString("/")
+
+		name, isVar := strings.CutPrefix(part, "{")
+		if !isVar {
+			if segments[i] != part {
+				return "", false
+			}
+
+			builder.WriteString(part)
+
+			continue
+		}
+
+		if segments[i] == "" {
+			return "", false
+		}
+
+		builder.WriteString("{")
+		builder.WriteString(strings.TrimSuffix(name, "}"))
+		builder.WriteString("=")
+		builder.WriteString(normalizePathValue(segments[i]))
+		builder.WriteString("}")
+	}
+
+	return builder.String(), true
+}
+
+// normalizePathValue strips leading zeros from integer values.
+func normalizePathValue(v string) string {
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return v
+		}
+	}
+
+	if v = strings.TrimLeft(v, "0"); v == "" {
+		return "0"
+	}
+
+	return v
+}
+
+// requestURL returns the original URL of a request, used to tell apart
+// requests that resolve to the same cache key.
+func requestURL(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// trackingParams are query parameters that only serve analytics and never
+// change the response.
+var trackingParams = []string{
+	"utm_source", "utm_medium", "utm_campaign", "utm_content", "utm_term",
+	"fbclid", "gclid", "msclkid", "_ga", "ref",
+}
+
+// entryURL returns the request URL stored with entries to detect collisions,
+// without the ignored query parameters. The request forwarded upstream keeps
+// them.
+func (m *cache) entryURL(r *http.Request) string {
+	if len(m.cfg.IgnoreQueryParams) == 0 && !m.cfg.RemoveTrackingParams {
+		return keyHost(r, m.cfg) + r.URL.RequestURI()
+	}
+
+	query := r.URL.Query()
+
+	for _, name := range m.cfg.IgnoreQueryParams {
+		query.Del(name)
+	}
+
+	if m.cfg.RemoveTrackingParams {
+		for _, name := range trackingParams {
+			query.Del(name)
+		}
+	}
+
+	u := *r.URL
+	u.RawQuery = query.Encode()
+
+	return keyHost(r, m.cfg) + u.RequestURI()
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 
 	status int
 	body   []byte
+
+	// buffered holds the response back until commit is called, so it can
+	// still be replaced after the upstream handler returns.
+	buffered bool
+	header   http.Header
+
+	// onWriteHeader is called with the status code right before the response
+	// headers are sent.
+	onWriteHeader func(status int)
+	wroteHeader   bool
+
+	// stream receives the body as it is written, instead of accumulating it
+	// when discardBody is set.
+	stream      *cacheStream
+	discardBody bool
+
+	// BytesWritten counts the body bytes sent to the underlying writer.
+	BytesWritten int64
+
+	// requestID is the ID sent upstream under RequestIDHeader.
+	requestID string
+}
+
+func (rw *responseWriter) Header() http.Header {
+	if !rw.buffered {
+		return rw.ResponseWriter.Header()
+	}
+
+	if rw.header == nil {
+		rw.header = http.Header{}
+	}
+
+	return rw.header
 }
 
 func (rw *responseWriter) Write(p []byte) (int, error) {
-	rw.body = append(rw.body, p...)
-	return rw.ResponseWriter.Write(p)
+	if !rw.discardBody {
+		rw.body = append(rw.body, p...)
+	}
+
+	if rw.buffered {
+		return len(p), nil
+	}
+
+	if !rw.wroteHeader {
+		rw.writeHeader(http.StatusOK)
+	}
+
+	if rw.stream != nil {
+		if err := rw.stream.Write(p); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error streaming cache item: %v", err)
+			rw.finishStream(true)
+		}
+	}
+
+	n, err := rw.ResponseWriter.Write(p)
+	rw.BytesWritten += int64(n)
+
+	return n, err //nolint:wrapcheck // pass through the client's error unchanged
 }
 
 func (rw *responseWriter) WriteHeader(s int) {
 	rw.status = s
+
+	if !rw.buffered {
+		rw.writeHeader(s)
+	}
+}
+
+func (rw *responseWriter) writeHeader(s int) {
+	if rw.wroteHeader {
+		return
+	}
+
+	rw.wroteHeader = true
+
+	// Event streams are never cached, and may be long-lived.
+	if isEventStream(rw.ResponseWriter.Header()) {
+		rw.discardBody = true
+	}
+
+	if rw.onWriteHeader != nil {
+		rw.onWriteHeader(s)
+	}
+
 	rw.ResponseWriter.WriteHeader(s)
 }
+
+// reset discards a buffered response so the upstream can be called again.
+func (rw *responseWriter) reset() {
+	rw.status = 0
+	rw.body = nil
+	rw.header = nil
+}
+
+// commitDecoded writes a buffered gzip response to the underlying writer
+// without its content encoding. The buffered response is left untouched so
+// it can be stored compressed.
+func (rw *responseWriter) commitDecoded() {
+	if !rw.buffered {
+		return
+	}
+
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// Headers set by the hook, such as a synthesized Cache-Control, go to the
+	// buffered response first, so they reach the client and the stored entry.
+	if hook := rw.onWriteHeader; hook != nil && !rw.wroteHeader {
+		rw.onWriteHeader = nil
+		hook(status)
+	}
+
+	for key, vals := range rw.Header() {
+		rw.ResponseWriter.Header()[key] = vals
+	}
+
+	body := decodeGzip(rw.ResponseWriter.Header(), rw.body)
+
+	rw.writeHeader(status)
+
+	n, _ := rw.ResponseWriter.Write(body)
+	rw.BytesWritten += int64(n)
+}
+
+// commit writes a buffered response to the underlying writer.
+func (rw *responseWriter) commit() {
+	if !rw.buffered {
+		return
+	}
+
+	header := rw.Header()
+
+	rw.buffered = false
+
+	for key, vals := range header {
+		rw.ResponseWriter.Header()[key] = vals
+	}
+
+	rw.header = nil
+
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rw.writeHeader(status)
+
+	n, _ := rw.ResponseWriter.Write(rw.body)
+	rw.BytesWritten += int64(n)
+}
+
+// Flush sends the data written so far to the client. Buffered responses are
+// held back until they are committed, except for event streams, which are
+// committed on their first flush.
+func (rw *responseWriter) Flush() {
+	if rw.buffered {
+		if !isEventStream(rw.Header()) {
+			return
+		}
+
+		rw.commit()
+	}
+
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements the deprecated http.CloseNotifier for handlers that
+// still rely on it.
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.ResponseWriter.(http.CloseNotifier); ok { //nolint:staticcheck // kept for backward compatibility
+		return cn.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// isEventStream reports whether h describes a server-sent events response.
+func isEventStream(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+
+	return err == nil && mediaType == "text/event-stream"
+}
@@ -2,15 +2,51 @@
 package plugin_simpleforcecache
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// manualClock is a time source that only moves when advanced.
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
 func TestNew(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -32,6 +68,136 @@ func TestNew(t *testing.T) {
 			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 1},
 			wantErr: true,
 		},
+		{
+			name:    "should error if earlyExpirationFactor <= 1",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, EarlyExpirationFactor: 1},
+			wantErr: true,
+		},
+		{
+			name:    "should error if fallbackURL is invalid",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, FallbackURL: "not a url"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on remote backend addresses",
+			cfg:     &Config{MaxExpiry: 300, Cleanup: 600, BackendAddresses: []string{"tcp://localhost:1234"}},
+			wantErr: true,
+		},
+		{
+			name:    "should error on unsupported hashAlgorithm",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, HashKey: true, HashAlgorithm: "crc64"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on unsupported bodyStorageEncoding",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, BodyStorageEncoding: "gzip"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on invalid healthCheckURL",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, HealthCheckURL: "not a url"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on invalid bypassUserAgents",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, BypassUserAgents: []string{"("}},
+			wantErr: true,
+		},
+		{
+			name:    "should error on bypassSampleRate above 1",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, BypassSampleRate: 1.5},
+			wantErr: true,
+		},
+		{
+			name:    "should error on invalid bypassCIDRs",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, BypassCIDRs: []string{"10.0.0.0/33"}},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative emptyBodyRetries",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, EmptyBodyRetries: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on hitRateAlertThreshold above 1",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, HitRateAlertThreshold: 1.5},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative xFetchBeta",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, XFetchBeta: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative globalMaxAge",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, GlobalMaxAge: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative missBudget",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, MissBudget: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative cleanupWorkers",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, CleanupWorkers: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative logKeyMaxLen",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, LogKeyMaxLen: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative cacheReadTimeout",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, CacheReadTimeout: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on warmupRedisAddr without list key",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, WarmupRedisAddr: "localhost:6379"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative warmRateLimit",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, WarmRateLimit: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error on zero methodTTL",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, MethodTTL: map[string]int{"HEAD": 0}},
+			wantErr: true,
+		},
+		{
+			name:    "should error on persistWriteQueue without writeQueueSize",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, PersistWriteQueue: true},
+			wantErr: true,
+		},
+		{
+			name:    "should error on persistWriteQueue with writeBatchSize",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, WriteQueueSize: 8, WriteBatchSize: 8, PersistWriteQueue: true},
+			wantErr: true,
+		},
+		{
+			name:    "should error on dynamicConfigHeader without dynamicConfigTrusted",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, DynamicConfigHeader: "X-Simplecache-Config"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on jwtClaimCacheKey without jwtClaimTrustedAuth",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, JWTClaimCacheKey: "tenant_id"},
+			wantErr: true,
+		},
+		{
+			name:    "should error on adminAPI without adminToken",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, AdminAPI: true},
+			wantErr: true,
+		},
+		{
+			name:    "should error on zero domainMaxExpiry",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600, DomainMaxExpiry: map[string]int{"example.com": 0}},
+			wantErr: true,
+		},
 		{
 			name:    "should be valid",
 			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600},
@@ -377,3 +543,2389 @@ func createTempDir(tb testing.TB) string {
 
 	return tb.TempDir()
 }
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "gzip, deflate", want: true},
+		{header: "GZIP;q=0.5", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "deflate", want: false},
+		{header: "*", want: true},
+		{header: "*;q=0", want: false},
+		{header: "*, gzip;q=0", want: false},
+		{header: "gzip;q=0, *", want: false},
+		{header: "*;q=0, gzip", want: true},
+		{header: "", want: false},
+	}
+
+	for _, test := range tests {
+		if got := acceptsEncoding(test.header, gzipEncoding); got != test.want {
+			t.Errorf("unexpected result for %q: want %t, got %t", test.header, test.want, got)
+		}
+	}
+}
+
+func TestCache_TranscodeCacheEncoding(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		body, err := gzipBody([]byte("test response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(body)
+	}
+
+	cfg := &Config{
+		Path:                   dir,
+		MaxExpiry:              10,
+		Cleanup:                20,
+		AddStatusHeader:        true,
+		TranscodeCacheEncoding: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	// Client without gzip support should get the decoded body.
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if ce := rw.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("unexpected Content-Encoding: want empty, got: %q", ce)
+	}
+
+	if body := rw.Body.String(); body != "test response" {
+		t.Errorf("unexpected body: want \"test response\", got: %q", body)
+	}
+
+	// Client with gzip support should get a gzip body.
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if ce := rw.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("unexpected Content-Encoding: want \"gzip\", got: %q", ce)
+	}
+
+	body, err := gunzip(rw.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "test response" {
+		t.Errorf("unexpected body: want \"test response\", got: %q", body)
+	}
+}
+
+func TestCache_DetectCollisions(t *testing.T) {
+	dir := createTempDir(t)
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(rw, "Response %d", callCount)
+	}
+
+	cfg := &Config{
+		Path:             dir,
+		MaxExpiry:        10,
+		Cleanup:          20,
+		AddStatusHeader:  true,
+		DetectCollisions: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query parameters are not part of the cache key, so both URLs share it.
+	req1 := httptest.NewRequest(http.MethodGet, "http://localhost/test?a=1", nil)
+	rw1 := httptest.NewRecorder()
+	c.ServeHTTP(rw1, req1)
+
+	req2 := httptest.NewRequest(http.MethodGet, "http://localhost/test?a=2", nil)
+	rw2 := httptest.NewRecorder()
+	c.ServeHTTP(rw2, req2)
+
+	if state := rw2.Header().Get("Cache-Status"); state != "miss" {
+		t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+	}
+
+	if body := rw2.Body.String(); body != "Response 2" {
+		t.Errorf("unexpected body: want \"Response 2\", got: %q", body)
+	}
+
+	req3 := httptest.NewRequest(http.MethodGet, "http://localhost/test?a=2", nil)
+	rw3 := httptest.NewRecorder()
+	c.ServeHTTP(rw3, req3)
+
+	if state := rw3.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+}
+
+func TestExpiresEarly(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		data cacheData
+		want bool
+	}{
+		{
+			name: "should not expire without expiry",
+			data: cacheData{ComputeDuration: int64(time.Hour)},
+			want: false,
+		},
+		{
+			name: "should not expire early for instant upstream",
+			data: cacheData{Expires: now.Add(time.Minute).Unix()},
+			want: false,
+		},
+		{
+			name: "should expire early for slow upstream",
+			data: cacheData{Expires: now.Add(time.Minute).Unix(), ComputeDuration: int64(1000 * time.Hour)},
+			want: true,
+		},
+		{
+			name: "should expire once expired",
+			data: cacheData{Expires: now.Add(-time.Second).Unix()},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := expiresEarly(&test.data, 2, now); got != test.want {
+				t.Errorf("unexpected early expiration: want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_EarlyExpiryBeta(t *testing.T) {
+	m := &cache{cfg: &Config{XFetchBeta: 1}}
+	if got := m.earlyExpiryBeta(); got != 1 {
+		t.Errorf("expected xFetchBeta to be used, got %v", got)
+	}
+
+	m.cfg.EarlyExpirationFactor = 2
+	if got := m.earlyExpiryBeta(); got != 2 {
+		t.Errorf("expected earlyExpirationFactor to take precedence, got %v", got)
+	}
+}
+
+func TestCache_FallbackURL(t *testing.T) {
+	dir := createTempDir(t)
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("maintenance"))
+	}))
+	defer fallback.Close()
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		callCount++
+
+		if r.URL.Path == "/panic" {
+			panic("upstream failure")
+		}
+
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, _ = rw.Write([]byte("upstream error"))
+	}
+
+	cfg := &Config{
+		Path:            dir,
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddStatusHeader: true,
+		FallbackURL:     fallback.URL,
+		UpstreamTimeout: 5,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/error", "/error", "/panic"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "fallback" {
+			t.Errorf("unexpected cache state for %s: want \"fallback\", got: %q", path, state)
+		}
+
+		if rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("unexpected status for %s: want %d, got: %d", path, http.StatusServiceUnavailable, rw.Code)
+		}
+
+		if body := rw.Body.String(); body != "maintenance" {
+			t.Errorf("unexpected body for %s: want \"maintenance\", got: %q", path, body)
+		}
+	}
+
+	if callCount != 3 {
+		t.Errorf("expected backend to be called 3 times, but was called %d times", callCount)
+	}
+}
+
+func TestCache_SynthesizeCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		force        bool
+		cacheControl string
+		want         string
+	}{
+		{
+			name: "should inject when missing",
+			want: "public, max-age=10",
+		},
+		{
+			name:         "should keep upstream header",
+			cacheControl: "max-age=5",
+			want:         "max-age=5",
+		},
+		{
+			name:         "should always inject when forced",
+			force:        true,
+			cacheControl: "max-age=5",
+			want:         "public, max-age=10",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				if test.cacheControl != "" {
+					rw.Header().Set("Cache-Control", test.cacheControl)
+				}
+
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Path:                   createTempDir(t),
+				MaxExpiry:              10,
+				Cleanup:                20,
+				AddStatusHeader:        true,
+				Force:                  test.force,
+				SynthesizeCacheControl: true,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []string{"miss", "hit"} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				if state := rw.Header().Get("Cache-Status"); state != want {
+					t.Errorf("unexpected cache state: want %q, got: %q", want, state)
+				}
+
+				if cc := rw.Header().Get("Cache-Control"); cc != test.want {
+					t.Errorf("unexpected Cache-Control on %s: want %q, got: %q", want, test.want, cc)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_LogMisses(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	var buf bytes.Buffer
+
+	cfg := &Config{
+		Path:          dir,
+		MaxExpiry:     10,
+		Cleanup:       20,
+		LogMisses:     true,
+		MissLogWriter: &buf,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test?q=1", nil)
+		req.Header.Set("User-Agent", "test-agent")
+
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one miss log line, got %d: %q", len(lines), buf.String())
+	}
+
+	var entry missLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Key != "GETlocalhost/test" || entry.URL != "localhost/test?q=1" || entry.UserAgent != "test-agent" {
+		t.Errorf("unexpected miss log entry: %+v", entry)
+	}
+}
+
+func TestCache_MissLogKeyMaxLen(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	var buf bytes.Buffer
+
+	cfg := &Config{
+		Path:          dir,
+		MaxExpiry:     10,
+		Cleanup:       20,
+		LogMisses:     true,
+		MissLogWriter: &buf,
+		LogKeyMaxLen:  8,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	var entry missLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Key != "GETlocal..." {
+		t.Errorf("expected truncated key %q, got %q", "GETlocal...", entry.Key)
+	}
+
+	if got := c.(*cache).displayKey("GET/a"); got != "GET/a" {
+		t.Errorf("expected short key to be kept, got %q", got)
+	}
+}
+
+func TestCache_AccessLog(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	var buf bytes.Buffer
+
+	cfg := &Config{
+		Path:              dir,
+		MaxExpiry:         10,
+		Cleanup:           20,
+		CachePathPrefixes: []string{"/cached"},
+		AccessLog:         true,
+		AccessLogWriter:   &buf,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/cached/a", "/cached/a", "/other"} {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+target, nil))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected three access log lines, got %d: %q", len(lines), buf.String())
+	}
+
+	want := []string{cacheMissStatus, cacheHitStatus, cacheBypassStatus}
+
+	for i, line := range lines {
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		if entry.CacheStatus != want[i] || entry.ResponseSizeBytes != 5 || entry.Method != http.MethodGet {
+			t.Errorf("unexpected access log entry %d: %+v", i, entry)
+		}
+
+		if (entry.CacheKeyHash == "") != (want[i] == cacheBypassStatus) {
+			t.Errorf("unexpected cache key hash in entry %d: %+v", i, entry)
+		}
+
+		if want[i] == cacheHitStatus && entry.UpstreamDurationMs != 0 {
+			t.Errorf("expected no upstream duration on a hit, got %d", entry.UpstreamDurationMs)
+		}
+	}
+}
+
+// hijackRecorder is a response recorder that supports connection hijacking.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+
+	hijacked bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+
+	client, server := net.Pipe()
+	_ = client.Close()
+
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestCache_AccessLogPassThrough(t *testing.T) {
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		if isUpgrade(r) {
+			hj, ok := rw.(http.Hijacker)
+			if !ok {
+				t.Fatal("expected the response writer to implement http.Hijacker")
+			}
+
+			conn, _, err := hj.Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.Close()
+
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("data: 1\n\n"))
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("expected the response writer to implement http.Flusher")
+		}
+
+		flusher.Flush()
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AccessLog: true, AccessLogWriter: io.Discard}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+
+	hr := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(hr, req)
+
+	if !hr.hijacked {
+		t.Error("expected the upgrade to hijack the client connection")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/events", nil))
+
+	if !rec.Flushed {
+		t.Error("expected the flush to reach the client")
+	}
+}
+
+func TestCache_WarmThroughOn404(t *testing.T) {
+	dir := createTempDir(t)
+
+	var callCount atomic.Int32
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+
+		if r.URL.Path == "/old" {
+			rw.Header().Set("Link", `</new>; rel="canonical"`)
+			rw.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("canonical"))
+	}
+
+	cfg := &Config{
+		Path:             dir,
+		MaxExpiry:        10,
+		Cleanup:          20,
+		AddStatusHeader:  true,
+		WarmThroughOn404: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/old", nil)
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: want %d, got: %d", http.StatusNotFound, rw.Code)
+	}
+
+	// The canonical URL is warmed in the background.
+	deadline := time.Now().Add(time.Second)
+	for c.(*cache).Stats().Stores < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, path := range []string{"/old", "/new"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "hit" {
+			t.Errorf("unexpected cache state for %s: want \"hit\", got: %q", path, state)
+		}
+
+		if body := rw.Body.String(); body != "canonical" {
+			t.Errorf("unexpected body for %s: want \"canonical\", got: %q", path, body)
+		}
+	}
+
+	if n := callCount.Load(); n != 2 {
+		t.Errorf("expected backend to be called twice, but was called %d times", n)
+	}
+}
+
+func TestCacheKey_Cookies(t *testing.T) {
+	cfg := &Config{CacheCookies: []string{"locale", "session_type"}}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	req.Header.Set("Cookie", "token=secret; session_type=premium; locale=fr")
+
+	want := "GETlocalhost/test|Cookie:locale=fr|Cookie:session_type=premium"
+	if got := cacheKey(req, cfg); got != want {
+		t.Errorf("unexpected cache key: want %q, got %q", want, got)
+	}
+
+	req.Header.Set("Cookie", "token=other; locale=fr; session_type=premium")
+
+	if got := cacheKey(req, cfg); got != want {
+		t.Errorf("unexpected cache key for unlisted cookie change: want %q, got %q", want, got)
+	}
+}
+
+func TestCache_StaleTolerance(t *testing.T) {
+	dir := createTempDir(t)
+
+	clock := newManualClock(time.Now())
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.Header().Set("Cache-Control", "max-age=1")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(rw, "Response %d", callCount)
+	}
+
+	cfg := &Config{
+		Path:            dir,
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddStatusHeader: true,
+		StaleTolerance:  5,
+		Clock:           clock.Now,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	clock.Advance(2 * time.Second)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "stale" {
+		t.Errorf("unexpected cache state: want \"stale\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "Response 1" {
+		t.Errorf("unexpected body: want \"Response 1\", got: %q", body)
+	}
+
+	if callCount != 1 {
+		t.Errorf("expected backend to be called once, but was called %d times", callCount)
+	}
+}
+
+func TestCache_StaleOnError(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("maintenance"))
+	}))
+	defer fallback.Close()
+
+	failing := false
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		if failing {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("ETag", `"v1"`)
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("Response 1"))
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		AddStatusHeader:       true,
+		ConditionalRevalidate: true,
+		FallbackURL:           fallback.URL,
+		Clock:                 clock.Now,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	failing = true
+
+	clock.Advance(11 * time.Second)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheStaleStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheStaleStatus, state)
+	}
+
+	if body := rw.Body.String(); body != "Response 1" {
+		t.Errorf("expected the stale copy over the fallback, got %q", body)
+	}
+}
+
+func TestCache_StaleOnErrorUnbuffered(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	failing := false
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		if failing {
+			rw.WriteHeader(http.StatusInternalServerError)
+			_, _ = rw.Write([]byte("boom"))
+
+			return
+		}
+
+		// Give the entry a compute duration for the early expiration.
+		time.Sleep(time.Millisecond)
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("Response 1"))
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		AddStatusHeader:       true,
+		EarlyExpirationFactor: 1e8,
+		Clock:                 clock.Now,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	failing = true
+
+	// Still fresh, but within the early revalidation window.
+	clock.Advance(8 * time.Second)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheStaleStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheStaleStatus, state)
+	}
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "Response 1" {
+		t.Errorf("expected only the stale copy, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestCache_StaleNoStoreDownstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		noStore bool
+		want    string
+	}{
+		{name: "no-store", noStore: true, want: "no-store, max-age=0"},
+		{name: "original", noStore: false, want: "max-age=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newManualClock(time.Now())
+
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=1")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Path:                   createTempDir(t),
+				MaxExpiry:              10,
+				Cleanup:                20,
+				AddStatusHeader:        true,
+				StaleTolerance:         5,
+				StaleNoStoreDownstream: test.noStore,
+				Clock:                  clock.Now,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			clock.Advance(2 * time.Second)
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != cacheStaleStatus {
+				t.Fatalf("unexpected cache state: want %q, got %q", cacheStaleStatus, state)
+			}
+
+			if got := rw.Header().Get("Cache-Control"); got != test.want {
+				t.Errorf("unexpected Cache-Control: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_OverwriteHeadersOnStore(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Server", "backend-1")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                    dir,
+		MaxExpiry:               10,
+		Cleanup:                 20,
+		AddStatusHeader:         true,
+		OverwriteHeadersOnStore: map[string]string{"server": "cache", "X-Cached": "true"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	// The live response is left untouched.
+	if server := rw.Header().Get("Server"); server != "backend-1" {
+		t.Errorf("unexpected Server header on miss: want \"backend-1\", got: %q", server)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if server := rw.Header().Get("Server"); server != "cache" {
+		t.Errorf("unexpected Server header on hit: want \"cache\", got: %q", server)
+	}
+
+	if cached := rw.Header().Get("X-Cached"); cached != "true" {
+		t.Errorf("unexpected X-Cached header on hit: want \"true\", got: %q", cached)
+	}
+}
+
+func TestCache_TTLOverrideHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		force  bool
+		header string
+		want   time.Duration
+	}{
+		{name: "uses requested ttl", force: true, header: "5", want: 5 * time.Second},
+		{name: "caps ttl at max expiry", force: true, header: "50", want: 10 * time.Second},
+		{name: "ignores invalid ttl", force: true, header: "-5", want: 10 * time.Second},
+		{name: "ignores override without force", force: false, header: "5", want: 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				Path:              createTempDir(t),
+				MaxExpiry:         10,
+				Cleanup:           20,
+				Force:             test.force,
+				TTLOverrideHeader: "X-Cache-TTL",
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+			req.Header.Set("X-Cache-TTL", test.header)
+
+			h := http.Header{"Cache-Control": []string{"max-age=60"}}
+
+			_, expiry, ok := c.(*cache).newEntry("", req, http.StatusOK, h, 0)
+			if !ok {
+				t.Fatal("expected response to be cacheable")
+			}
+
+			if expiry != test.want {
+				t.Errorf("unexpected expiry: want %v, got %v", test.want, expiry)
+			}
+		})
+	}
+}
+
+func TestCache_UpstreamHeaders(t *testing.T) {
+	dir := createTempDir(t)
+
+	var token string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Warm-Token")
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            dir,
+		MaxExpiry:       10,
+		Cleanup:         20,
+		UpstreamHeaders: map[string]string{"X-Warm-Token": "secret"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if token != "secret" {
+		t.Errorf("unexpected upstream header: want \"secret\", got: %q", token)
+	}
+
+	if got := req.Header.Get("X-Warm-Token"); got != "" {
+		t.Errorf("expected client request to be left untouched, got: %q", got)
+	}
+}
+
+func TestCache_NormalizeStatusCode(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}
+
+	cfg := &Config{
+		Path:                dir,
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		NormalizeStatusCode: map[int]int{http.StatusCreated: http.StatusOK},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("unexpected status code on miss: want %d, got %d", http.StatusCreated, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status code on hit: want %d, got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestCache_RemoveTrackingParams(t *testing.T) {
+	dir := createTempDir(t)
+
+	var upstreamQuery string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		upstreamQuery = r.URL.RawQuery
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                 dir,
+		MaxExpiry:            10,
+		Cleanup:              20,
+		AddStatusHeader:      true,
+		DetectCollisions:     true,
+		IgnoreQueryParams:    []string{"session"},
+		RemoveTrackingParams: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test?a=1&utm_source=mail", nil))
+
+	if upstreamQuery != "a=1&utm_source=mail" {
+		t.Errorf("expected tracking parameters to be forwarded, got: %q", upstreamQuery)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test?gclid=x&a=1&session=abc", nil))
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+}
+
+func TestCache_UserAgents(t *testing.T) {
+	dir := createTempDir(t)
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:              dir,
+		MaxExpiry:         10,
+		Cleanup:           20,
+		AddStatusHeader:   true,
+		BypassUserAgents:  []string{`(?i)monitor`},
+		NoCacheUserAgents: []string{`(?i)bot`},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(userAgent string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		req.Header.Set("User-Agent", userAgent)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		return rw.Header().Get(cacheHeader)
+	}
+
+	// Crawlers don't populate the cache.
+	if state := serve("GoogleBot/2.1"); state != cacheMissStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheMissStatus, state)
+	}
+
+	if state := serve("browser"); state != cacheMissStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheMissStatus, state)
+	}
+
+	// Crawlers still read from the cache.
+	if state := serve("GoogleBot/2.1"); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if state := serve("Uptime-Monitor"); state != "" || callCount != 3 {
+		t.Errorf("expected monitor to bypass the cache, got state %q after %d upstream calls", state, callCount)
+	}
+}
+
+func TestCache_BypassSampleRate(t *testing.T) {
+	dir := createTempDir(t)
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:             dir,
+		MaxExpiry:        10,
+		Cleanup:          20,
+		AddStatusHeader:  true,
+		BypassSampleRate: 1,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		if state := rw.Header().Get(cacheHeader); state != cacheSampledStatus {
+			t.Errorf("unexpected cache state: want %q, got: %q", cacheSampledStatus, state)
+		}
+	}
+
+	if callCount != 2 {
+		t.Errorf("expected every request to reach the upstream, got %d calls", callCount)
+	}
+}
+
+func TestCache_UpstreamRetries(t *testing.T) {
+	dir := createTempDir(t)
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		callCount++
+
+		switch {
+		case r.URL.Path == "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		case callCount < 3:
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = rw.Write([]byte("unavailable"))
+		default:
+			rw.WriteHeader(http.StatusOK)
+			_, _ = rw.Write([]byte("ok"))
+		}
+	}
+
+	cfg := &Config{
+		Path:               dir,
+		MaxExpiry:          10,
+		Cleanup:            20,
+		AddStatusHeader:    true,
+		UpstreamRetries:    2,
+		UpstreamRetryDelay: 1,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "ok" || callCount != 3 {
+		t.Errorf("unexpected response after retries: code %d, body %q, %d upstream calls", rw.Code, rw.Body.String(), callCount)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	callCount = 0
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/missing", nil))
+
+	if callCount != 1 {
+		t.Errorf("expected client errors not to be retried, got %d upstream calls", callCount)
+	}
+
+	callCount = 0
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://localhost/post", strings.NewReader("body")))
+
+	if callCount != 1 {
+		t.Errorf("expected POST requests not to be retried, got %d upstream calls", callCount)
+	}
+}
+
+func TestCacheKey_PathTemplates(t *testing.T) {
+	cfg := &Config{PathTemplates: []string{"/api/users/{id}/posts", "/api/{kind}"}}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/users/42/posts", want: "GETlocalhost/api/users/{id=42}/posts"},
+		{path: "/api/users/0042/posts/", want: "GETlocalhost/api/users/{id=42}/posts"},
+		{path: "/api/users/abc/posts", want: "GETlocalhost/api/users/{id=abc}/posts"},
+		{path: "/api/users", want: "GETlocalhost/api/{kind=users}"},
+		{path: "/api/users/42/comments", want: "GETlocalhost/api/users/42/comments"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+
+		if got := cacheKey(req, cfg); got != test.want {
+			t.Errorf("unexpected cache key for %q: want %q, got %q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestCache_ValidateResponse(t *testing.T) {
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+
+		if r.URL.Path == "/limited" {
+			_, _ = rw.Write([]byte(`{"error": "rate limit exceeded"}`))
+			return
+		}
+
+		_, _ = rw.Write([]byte(`{"data": 1}`))
+	}
+
+	cfg := WithResponseValidator(func(_ int, _ http.Header, body []byte) bool {
+		valid := !bytes.Contains(body, []byte(`"error"`))
+
+		// The validator works on a copy of the body.
+		body[0] = 'x'
+
+		return valid
+	})
+	cfg.Path = createTempDir(t)
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{"/ok": cacheHitStatus, "/limited": cacheMissStatus} {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+
+		if state := rw.Header().Get(cacheHeader); state != want {
+			t.Errorf("unexpected cache state for %s: want %q, got: %q", path, want, state)
+		}
+
+		if body := rw.Body.String(); body[0] != '{' {
+			t.Errorf("unexpected body for %s: %q", path, body)
+		}
+	}
+}
+
+func TestCache_StripUpstreamRequestHeaders(t *testing.T) {
+	dir := createTempDir(t)
+
+	var auth, accept string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		accept = r.Header.Get("Accept")
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                        dir,
+		MaxExpiry:                   10,
+		Cleanup:                     20,
+		CacheAuthenticated:          true,
+		StripUpstreamRequestHeaders: []string{"authorization"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/html")
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if auth != "" || accept != "text/html" {
+		t.Errorf("unexpected upstream headers: Authorization %q, Accept %q", auth, accept)
+	}
+
+	if req.Header.Get("Authorization") == "" {
+		t.Error("expected client request to be left untouched")
+	}
+}
+
+func TestCache_DomainMaxExpiry(t *testing.T) {
+	cfg := &Config{
+		Path:      createTempDir(t),
+		MaxExpiry: 300,
+		Cleanup:   600,
+		Force:     true,
+		DomainMaxExpiry: map[string]int{
+			"news.example.com":   10,
+			"*.example.com":      60,
+			"*.api.example.com":  30,
+			"static.example.com": 1000,
+		},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want time.Duration
+	}{
+		{host: "news.example.com", want: 10 * time.Second},
+		{host: "NEWS.example.com:8080", want: 10 * time.Second},
+		{host: "shop.example.com", want: 60 * time.Second},
+		{host: "v1.api.example.com", want: 30 * time.Second},
+		{host: "static.example.com", want: 300 * time.Second},
+		{host: "example.com", want: 300 * time.Second},
+		{host: "other.org", want: 300 * time.Second},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+test.host+"/test", nil)
+
+		expiry, ok := h.(*cache).cacheable(req, http.StatusOK, http.Header{})
+		if !ok || expiry != test.want {
+			t.Errorf("%s: unexpected expiry: want %s, got %s (cacheable %t)", test.host, test.want, expiry, ok)
+		}
+	}
+}
+
+func TestCache_ExpiryCaps(t *testing.T) {
+	cfg := &Config{
+		Path:              createTempDir(t),
+		MaxExpiry:         300,
+		Cleanup:           600,
+		Force:             true,
+		TTLOverrideHeader: "X-Cache-TTL",
+		DomainMaxExpiry:   map[string]int{"news.example.com": 10},
+		MethodTTL:         map[string]int{"HEAD": 30},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	tests := []struct {
+		method       string
+		host         string
+		wantOverride time.Duration
+		wantRefresh  time.Duration
+	}{
+		{method: http.MethodGet, host: "news.example.com", wantOverride: 10 * time.Second, wantRefresh: 10 * time.Second},
+		{method: http.MethodHead, host: "shop.example.com", wantOverride: 30 * time.Second, wantRefresh: 30 * time.Second},
+		{method: http.MethodGet, host: "shop.example.com", wantOverride: 200 * time.Second, wantRefresh: 300 * time.Second},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://"+test.host+"/test", nil)
+		req.Header.Set("X-Cache-TTL", "200")
+
+		if _, expiry, ok := c.newEntry("key", req, http.StatusOK, http.Header{}, 0); !ok || expiry != test.wantOverride {
+			t.Errorf("%s %s: unexpected override expiry: want %s, got %s (cacheable %t)", test.method, test.host, test.wantOverride, expiry, ok)
+		}
+
+		// Refreshed entries are extended by the max expiry of the request.
+		if got := c.maxExpiry(req); got != test.wantRefresh {
+			t.Errorf("%s %s: unexpected refresh expiry: want %s, got %s", test.method, test.host, test.wantRefresh, got)
+		}
+	}
+}
+
+func TestCache_MethodTTL(t *testing.T) {
+	cfg := &Config{
+		Path:      createTempDir(t),
+		MaxExpiry: 300,
+		Cleanup:   600,
+		Force:     true,
+		MethodTTL: map[string]int{"head": 30, "GET": 120},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		want   time.Duration
+	}{
+		{method: http.MethodGet, want: 120 * time.Second},
+		{method: http.MethodHead, want: 30 * time.Second},
+		{method: http.MethodOptions, want: 300 * time.Second},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost/test", nil)
+
+		expiry, ok := h.(*cache).cacheable(req, http.StatusOK, http.Header{})
+		if !ok || expiry != test.want {
+			t.Errorf("%s: unexpected expiry: want %s, got %s (cacheable %t)", test.method, test.want, expiry, ok)
+		}
+	}
+}
+
+func TestCache_PathUpstreamTimeouts(t *testing.T) {
+	dir := createTempDir(t)
+
+	var ctxErr error
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			ctxErr = r.Context().Err()
+
+			rw.WriteHeader(http.StatusGatewayTimeout)
+		case <-time.After(5 * time.Second):
+			rw.WriteHeader(http.StatusOK)
+		}
+	}
+
+	cfg := &Config{
+		Path:                 dir,
+		MaxExpiry:            10,
+		Cleanup:              20,
+		UpstreamTimeout:      30,
+		PathUpstreamTimeouts: map[string]int{"/api": 10, "/api/slow": 1},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/api/slow/report", nil))
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the upstream call to be cancelled after 1s, took %v", elapsed)
+	}
+
+	if !errors.Is(ctxErr, context.DeadlineExceeded) || rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("unexpected result: context error %v, status %d", ctxErr, rw.Code)
+	}
+}
+
+func TestCache_AddXCacheHeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            dir,
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddXCacheHeader: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"MISS from simplecache", "HIT from simplecache"} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		if got := rw.Header().Get("X-Cache"); got != want {
+			t.Errorf("unexpected X-Cache header: want %q, got %q", want, got)
+		}
+
+		// Cache-Status stays controlled by AddStatusHeader.
+		if state := rw.Header().Get(cacheHeader); state != "" {
+			t.Errorf("unexpected Cache-Status header: %q", state)
+		}
+	}
+}
+
+func TestCache_AddBodyHashHeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{
+		Path:              dir,
+		MaxExpiry:         10,
+		Cleanup:           20,
+		AddStatusHeader:   true,
+		AddBodyHashHeader: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "sha256=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	for _, state := range []string{cacheMissStatus, cacheHitStatus} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		if got := rw.Header().Get("X-Body-Hash"); got != want {
+			t.Errorf("unexpected body hash on %s: want %q, got %q", state, want, got)
+		}
+
+		if got := rw.Header().Get(cacheHeader); got != state {
+			t.Errorf("unexpected cache state: want %q, got %q", state, got)
+		}
+
+		if got := rw.Header().Values("X-Body-Hash"); len(got) != 1 {
+			t.Errorf("expected a single body hash header, got %q", got)
+		}
+	}
+}
+
+func TestCache_BodyHashRewrittenBodies(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		encodings []string
+	}{
+		{name: "body transforms", cfg: Config{BodyTransforms: []BodyTransform{JSONMinifyTransform{}}}, encodings: []string{"", ""}},
+		{name: "upstream gzip", cfg: Config{RequestUpstreamGzip: true}, encodings: []string{"", ""}},
+		{name: "transcoding", cfg: Config{TranscodeCacheEncoding: true}, encodings: []string{gzipEncoding, "", gzipEncoding}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, r *http.Request) {
+				body := []byte(`{ "a" :  1 }`)
+
+				rw.Header().Set("Content-Type", "application/json")
+
+				if acceptsEncoding(r.Header.Get("Accept-Encoding"), gzipEncoding) {
+					body, _ = gzipBody(body)
+					rw.Header().Set("Content-Encoding", gzipEncoding)
+				}
+
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write(body)
+			}
+
+			cfg := test.cfg
+			cfg.Path = createTempDir(t)
+			cfg.MaxExpiry = 10
+			cfg.Cleanup = 20
+			cfg.AddBodyHashHeader = true
+
+			c, err := New(context.Background(), http.HandlerFunc(next), &cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, encoding := range test.encodings {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+				if encoding != "" {
+					req.Header.Set("Accept-Encoding", encoding)
+				}
+
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				sum := sha256.Sum256(rw.Body.Bytes())
+				if got, want := rw.Header().Get(bodyHashHeader), "sha256="+hex.EncodeToString(sum[:]); got != want {
+					t.Errorf("unexpected body hash of response %d: want %q, got %q", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNew_EnvOverrides(t *testing.T) {
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	newCache := func(t *testing.T) http.Handler {
+		t.Helper()
+
+		cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true}
+
+		c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	t.Run("disable", func(t *testing.T) {
+		t.Setenv("SIMPLECACHE_DISABLE", "1")
+
+		if _, ok := newCache(t).(*cache); ok {
+			t.Error("expected a pass-through handler")
+		}
+	})
+
+	t.Run("force miss", func(t *testing.T) {
+		t.Setenv("SIMPLECACHE_FORCE_MISS", "1")
+
+		c := newCache(t)
+		callCount = 0
+
+		for i := 0; i < 2; i++ {
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if state := rw.Header().Get(cacheHeader); state != cacheMissStatus {
+				t.Errorf("unexpected cache state: want %q, got: %q", cacheMissStatus, state)
+			}
+		}
+
+		if _, err := c.(*cache).cache.Get("GETlocalhost/test"); err != nil || callCount != 2 {
+			t.Errorf("expected responses to still be stored, got %v after %d upstream calls", err, callCount)
+		}
+	})
+}
+
+func TestCache_RequestUpstreamGzip(t *testing.T) {
+	dir := createTempDir(t)
+
+	compressed, err := gzipBody([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamEncodings []string
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		upstreamEncodings = append(upstreamEncodings, req.Header.Get("Accept-Encoding"))
+
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(compressed)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, RequestUpstreamGzip: true, SynthesizeCacheControl: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantStatus     string
+		wantEncoding   string
+		wantBody       []byte
+	}{
+		{name: "decoded miss", wantStatus: cacheMissStatus, wantBody: []byte("hello")},
+		{name: "decoded hit", wantStatus: cacheHitStatus, wantBody: []byte("hello")},
+		{name: "compressed hit", acceptEncoding: "gzip", wantStatus: cacheHitStatus, wantEncoding: "gzip", wantBody: compressed},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.name, test.wantStatus, got)
+		}
+
+		if got := rw.Header().Get("Content-Encoding"); got != test.wantEncoding {
+			t.Errorf("%s: unexpected content encoding: want %q, got %q", test.name, test.wantEncoding, got)
+		}
+
+		if got := rw.Header().Get("Cache-Control"); got != "public, max-age=10" {
+			t.Errorf("%s: unexpected Cache-Control: want %q, got %q", test.name, "public, max-age=10", got)
+		}
+
+		if !bytes.Equal(rw.Body.Bytes(), test.wantBody) {
+			t.Errorf("%s: unexpected body: want %q, got %q", test.name, test.wantBody, rw.Body.Bytes())
+		}
+	}
+
+	if len(upstreamEncodings) != 1 || upstreamEncodings[0] != "gzip" {
+		t.Errorf("expected a single upstream call asking for gzip, got %q", upstreamEncodings)
+	}
+}
+
+func TestCache_UpstreamQueryParams(t *testing.T) {
+	dir := createTempDir(t)
+
+	var queries []string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                dir,
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		UpstreamQueryParams: []string{"page"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test?page=2&utm_source=mail", nil)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if len(queries) != 1 || queries[0] != "page=2" {
+		t.Errorf("unexpected upstream queries: %q", queries)
+	}
+
+	if req.URL.RawQuery != "page=2&utm_source=mail" {
+		t.Errorf("expected client request to be left untouched, got %q", req.URL.RawQuery)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test?page=2&utm_source=ad", nil))
+
+	if got := rw.Header().Get(cacheHeader); got != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheHitStatus, got)
+	}
+}
+
+func TestCache_CacheAuthenticated(t *testing.T) {
+	tests := []struct {
+		name               string
+		cacheAuthenticated bool
+		header             string
+		wantStatus         string
+	}{
+		{name: "authorization bypasses", header: "Authorization", wantStatus: cacheBypassStatus},
+		{name: "auth header bypasses", header: "X-Api-Key", wantStatus: cacheBypassStatus},
+		{name: "other header is cached", header: "X-Other", wantStatus: cacheMissStatus},
+		{name: "opt in", cacheAuthenticated: true, header: "Authorization", wantStatus: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Path:               createTempDir(t),
+				MaxExpiry:          10,
+				Cleanup:            20,
+				AddStatusHeader:    true,
+				CacheAuthenticated: test.cacheAuthenticated,
+				AuthHeaders:        []string{"X-Api-Key"},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+			req.Header.Set(test.header, "secret")
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			got := rw.Header().Get(cacheHeader)
+			if test.wantStatus == cacheBypassStatus {
+				if got != "" {
+					t.Errorf("expected no cache status, got %q", got)
+				}
+
+				if _, err := c.(*cache).cache.Get("GETlocalhost/test"); err == nil {
+					t.Error("expected the response not to be cached")
+				}
+
+				return
+			}
+
+			if got != test.wantStatus {
+				t.Errorf("unexpected cache state: want %q, got %q", test.wantStatus, got)
+			}
+		})
+	}
+}
+
+func TestCache_BypassCIDRs(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddStatusHeader: true,
+		BypassCIDRs:     []string{"10.0.0.0/8", "127.0.0.1/32"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		wantStatus string
+	}{
+		{remoteAddr: "192.168.1.1:1234", wantStatus: cacheMissStatus},
+		{remoteAddr: "10.1.2.3:1234", wantStatus: cacheBypassStatus},
+		{remoteAddr: "127.0.0.1:1234", wantStatus: cacheBypassStatus},
+		{remoteAddr: "192.168.1.1:1234", wantStatus: cacheHitStatus},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.remoteAddr, test.wantStatus, got)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 upstream calls, got %d", calls)
+	}
+}
+
+func TestCache_BypassUpgrade(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddStatusHeader: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, headers := range []map[string]string{
+		{"Upgrade": "websocket", "Connection": "Upgrade"},
+		{"Upgrade": "WebSocket"},
+		{"Connection": "keep-alive, Upgrade"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		for name, val := range headers {
+			req.Header.Set(name, val)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != cacheUpgradeStatus {
+			t.Errorf("%v: unexpected cache state: want %q, got %q", headers, cacheUpgradeStatus, got)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 upstream calls, got %d", calls)
+	}
+
+	if _, err := h.(*cache).cache.Get("GETlocalhost/test"); err == nil {
+		t.Error("expected upgrade requests never to be stored")
+	}
+}
+
+func TestCache_AddStatusHeaderForAll(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		CachePathPrefixes:     []string{"/cached"},
+		AddStatusHeaderForAll: true,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path       string
+		header     string
+		wantStatus string
+	}{
+		{path: "/other", wantStatus: cacheUncachedStatus},
+		{path: "/cached", header: "Authorization", wantStatus: cacheBypassStatus},
+		{path: "/cached", wantStatus: cacheMissStatus},
+		{path: "/cached", wantStatus: cacheHitStatus},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, "secret")
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.path, test.wantStatus, got)
+		}
+	}
+}
+
+func TestCacheKey_NormalizeHost(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		proto     string
+		normalize bool
+		want      string
+	}{
+		{name: "default http port", url: "http://example.com:80/path", normalize: true, want: "GETexample.com/path"},
+		{name: "default https port", url: "https://example.com:443/path", normalize: true, want: "GETexample.com/path"},
+		{name: "uppercase host", url: "http://EXAMPLE.COM/path", normalize: true, want: "GETexample.com/path"},
+		{name: "uppercase host with port", url: "http://Example.Com:80/path", normalize: true, want: "GETexample.com/path"},
+		{name: "https port over http", url: "http://example.com:443/path", normalize: true, want: "GETexample.com:443/path"},
+		{name: "http port over https", url: "https://example.com:80/path", normalize: true, want: "GETexample.com:80/path"},
+		{name: "forwarded https port", url: "http://example.com:443/path", proto: "https", normalize: true, want: "GETexample.com/path"},
+		{name: "forwarded http port", url: "https://example.com:443/path", proto: "http", normalize: true, want: "GETexample.com:443/path"},
+		{name: "custom port", url: "http://example.com:8080/path", normalize: true, want: "GETexample.com:8080/path"},
+		{name: "ipv6 default port", url: "http://[::1]:80/path", normalize: true, want: "GET[::1]/path"},
+		{name: "disabled", url: "http://EXAMPLE.COM:80/path", normalize: false, want: "GETEXAMPLE.COM:80/path"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+
+			if got := cacheKey(req, &Config{NormalizeHost: test.normalize}); got != test.want {
+				t.Errorf("unexpected cache key: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCacheKey_VaryByScheme(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		proto string
+		want  string
+	}{
+		{name: "http", url: "http://example.com/path", want: "http|GETexample.com/path"},
+		{name: "tls", url: "https://example.com/path", want: "https|GETexample.com/path"},
+		{name: "forwarded https", url: "http://example.com/path", proto: "HTTPS", want: "https|GETexample.com/path"},
+		{name: "forwarded list", url: "https://example.com/path", proto: "http, https", want: "http|GETexample.com/path"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+
+			if got := cacheKey(req, &Config{VaryByScheme: true}); got != test.want {
+				t.Errorf("unexpected cache key: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_RetryOnEmptyBody(t *testing.T) {
+	callCount := 0
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		callCount++
+
+		rw.WriteHeader(http.StatusOK)
+
+		// The flaky path only answers with a body on every other call.
+		if r.URL.Path == "/flaky" && callCount%2 == 0 {
+			_, _ = rw.Write([]byte("ok"))
+		}
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		RetryOnEmptyBody:    true,
+		EmptyBodyRetries:    2,
+		EmptyBodyRetryDelay: 1,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method    string
+		path      string
+		wantCalls int
+		wantState string
+	}{
+		{method: http.MethodGet, path: "/flaky", wantCalls: 2, wantState: cacheMissStatus},
+		{method: http.MethodGet, path: "/flaky", wantCalls: 0, wantState: cacheHitStatus},
+		{method: http.MethodGet, path: "/empty", wantCalls: 3, wantState: cacheMissStatus},
+		{method: http.MethodGet, path: "/empty", wantCalls: 3, wantState: cacheMissStatus},
+		{method: http.MethodPost, path: "/empty", wantCalls: 1, wantState: cacheMissStatus},
+	}
+
+	for i, test := range tests {
+		callCount = 0
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(test.method, "http://localhost"+test.path, nil))
+
+		if callCount != test.wantCalls {
+			t.Errorf("request %d: unexpected upstream calls: want %d, got %d", i, test.wantCalls, callCount)
+		}
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantState {
+			t.Errorf("request %d: unexpected cache state: want %q, got %q", i, test.wantState, got)
+		}
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("request %d: unexpected status %d", i, rw.Code)
+		}
+	}
+}
+
+func TestCache_RequestID(t *testing.T) {
+	var upstreamIDs []string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		upstreamIDs = append(upstreamIDs, r.Header.Get("X-Request-Id"))
+
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:              createTempDir(t),
+		MaxExpiry:         10,
+		Cleanup:           20,
+		RequestIDHeader:   "X-Request-Id",
+		GenerateRequestID: func() string { return "req-1" },
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(upstreamIDs) != 1 || upstreamIDs[0] != "req-1" {
+		t.Errorf("unexpected upstream request IDs: %q", upstreamIDs)
+	}
+
+	if req.Header.Get("X-Request-Id") != "" {
+		t.Error("expected client request to be left untouched")
+	}
+
+	b, err := c.cache.Get("GETlocalhost/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data cacheData
+	if err = c.unmarshalEntry(b, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.RequestID != "req-1" {
+		t.Errorf("unexpected stored request ID: %q", data.RequestID)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if got := rw.Header().Get("X-Request-Id"); got != "" {
+		t.Errorf("expected the request ID not to be served on hits, got %q", got)
+	}
+}
+
+func TestCache_HitDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		debug     bool
+		wantDelay bool
+	}{
+		{name: "debug", debug: true, wantDelay: true},
+		{name: "ignored without debug", debug: false, wantDelay: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, Debug: test.debug, HitDelay: 100}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Misses are never delayed.
+			start := time.Now()
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+				t.Errorf("unexpected delay on miss: %s", elapsed)
+			}
+
+			start = time.Now()
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if delayed := time.Since(start) >= 100*time.Millisecond; delayed != test.wantDelay {
+				t.Errorf("unexpected hit delay: want %t, got %t", test.wantDelay, delayed)
+			}
+		})
+	}
+}
+
+func TestCache_PropagateContext(t *testing.T) {
+	type ctxKey struct{}
+
+	tests := []struct {
+		name      string
+		propagate bool
+		wantErr   error
+	}{
+		{name: "detached by default", propagate: false, wantErr: nil},
+		{name: "propagated", propagate: true, wantErr: context.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				upstreamErr error
+				value       any
+			)
+
+			next := func(rw http.ResponseWriter, r *http.Request) {
+				upstreamErr = r.Context().Err()
+				value = r.Context().Value(ctxKey{})
+
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, PropagateContext: test.propagate}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The client is gone by the time the upstream is called.
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+			cancel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil).WithContext(ctx)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !errors.Is(upstreamErr, test.wantErr) {
+				t.Errorf("unexpected upstream context error: want %v, got %v", test.wantErr, upstreamErr)
+			}
+
+			if value != "value" {
+				t.Errorf("expected request-scoped values to propagate, got %v", value)
+			}
+		})
+	}
+}
+
+func TestNew_CacheDirHealthCheck(t *testing.T) {
+	dir := createTempDir(t)
+
+	// A directory in place of the probe file makes the probe write fail, as
+	// on a read-only filesystem.
+	if err := os.Mkdir(filepath.Join(dir, probeFileName), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {}
+
+	if _, err := New(context.Background(), http.HandlerFunc(next), &Config{Path: dir, MaxExpiry: 10, Cleanup: 20}, "simplecache"); err == nil {
+		t.Error("expected the health check to fail")
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, SkipHealthCheck: true}
+	if _, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache"); err != nil {
+		t.Errorf("unexpected error with the health check skipped: %v", err)
+	}
+
+	if err := probeCacheDir(createTempDir(t)); err != nil {
+		t.Errorf("unexpected probe error on a writable directory: %v", err)
+	}
+}
+
+func TestCache_NoCacheRequestContentTypes(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := CreateConfig()
+	cfg.Path = createTempDir(t)
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		contentType string
+		wantStatus  string
+	}{
+		{contentType: "multipart/form-data; boundary=xyz", wantStatus: ""},
+		{contentType: "application/x-www-form-urlencoded", wantStatus: ""},
+		{contentType: "application/json", wantStatus: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/upload", strings.NewReader("data"))
+		req.Header.Set("Content-Type", test.contentType)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.contentType, test.wantStatus, got)
+		}
+	}
+}
+
+func TestCache_CacheErrorResponses(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	callCount := 0
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		callCount++
+
+		switch r.URL.Path {
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		default:
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           300,
+		Cleanup:             600,
+		AddStatusHeader:     true,
+		CacheErrorResponses: true,
+		ErrorTTL:            5,
+		Clock:               clock.Now,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		advance   time.Duration
+		wantState string
+		wantCalls int
+	}{
+		{path: "/missing", wantState: cacheMissStatus, wantCalls: 1},
+		{path: "/missing", advance: 4 * time.Second, wantState: cacheHitStatus, wantCalls: 1},
+		{path: "/missing", advance: 2 * time.Second, wantState: cacheMissStatus, wantCalls: 2},
+		{path: "/broken", wantState: cacheMissStatus, wantCalls: 3},
+		{path: "/broken", wantState: cacheMissStatus, wantCalls: 4},
+	}
+
+	for i, test := range tests {
+		clock.Advance(test.advance)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantState {
+			t.Errorf("request %d: unexpected cache state: want %q, got %q", i, test.wantState, got)
+		}
+
+		if callCount != test.wantCalls {
+			t.Errorf("request %d: unexpected upstream calls: want %d, got %d", i, test.wantCalls, callCount)
+		}
+	}
+}
+
+func TestCache_EventStream(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			callCount := 0
+
+			var flushedBody string
+
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				callCount++
+
+				rw.Header().Set("Content-Type", "text/event-stream")
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("data: 1\n\n"))
+
+				flusher, ok := rw.(http.Flusher)
+				if !ok {
+					t.Fatal("expected the response writer to implement http.Flusher")
+				}
+
+				flusher.Flush()
+
+				flushedBody = rw.(*responseWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String()
+			}
+
+			cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20}
+			if buffered {
+				cfg.UpstreamRetries = 1
+			}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/events", nil))
+
+				if !rec.Flushed {
+					t.Error("expected the flush to reach the client")
+				}
+
+				if flushedBody != "data: 1\n\n" {
+					t.Errorf("expected the event to be sent on flush, got %q", flushedBody)
+				}
+			}
+
+			if callCount != 2 {
+				t.Errorf("expected event streams not to be cached, upstream called %d times", callCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+// Command cachepurge deletes the entries tagged with a cache tag from a cache
+// directory, for use from deployment scripts:
+//
+//	cachepurge --dir /tmp/cache --tag product-123
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	plugin "github.com/gfreezy/plugin-simpleforcecache"
+)
+
+func main() {
+	dir := flag.String("dir", "", "cache directory to purge")
+	tag := flag.String("tag", "", "cache tag of the entries to delete")
+
+	flag.Parse()
+
+	if *dir == "" || *tag == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	n, err := plugin.PurgeDir(*dir, *tag)
+	if err != nil {
+		log.Fatalf("Error purging %q: %v", *dir, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Purged %d entries tagged %q\n", n, *tag)
+}
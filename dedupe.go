@@ -0,0 +1,112 @@
+package plugin_simpleforcecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errCanonicalMismatch = errors.New("canonical entry content changed")
+
+// contentIndex maps body digests to the key of the first entry stored with
+// that body, so that later entries with identical bodies can refer to it.
+type contentIndex struct {
+	mu      sync.Mutex
+	keys    map[string]string
+	digests map[string]string
+}
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		mu:      sync.Mutex{},
+		keys:    map[string]string{},
+		digests: map[string]string{},
+	}
+}
+
+// canonical returns the key holding the body with the given digest,
+// recording key as that holder if there is none yet.
+func (ci *contentIndex) canonical(digest, key string) string {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if k, ok := ci.keys[digest]; ok {
+		return k
+	}
+
+	if len(ci.keys) >= maxTrackedHitKeys {
+		ci.keys = map[string]string{}
+		ci.digests = map[string]string{}
+	}
+
+	// A key stored with new content no longer holds its previous body.
+	if old, ok := ci.digests[key]; ok {
+		delete(ci.keys, old)
+	}
+
+	ci.keys[digest] = key
+	ci.digests[key] = digest
+
+	return key
+}
+
+// forget drops the digest recorded for key.
+func (ci *contentIndex) forget(key string) {
+	if ci == nil {
+		return
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if digest, ok := ci.digests[key]; ok {
+		delete(ci.keys, digest)
+		delete(ci.digests, key)
+	}
+}
+
+// deduplicate replaces the body of data by a reference to the entry stored
+// under another key with the same body, if any.
+func (m *cache) deduplicate(key string, data *cacheData) {
+	sum := sha256.Sum256(data.Body)
+	digest := hex.EncodeToString(sum[:])
+
+	canonical := m.dedupe.canonical(digest, key)
+	if canonical == key {
+		return
+	}
+
+	data.Canonical = canonical
+	data.Digest = digest
+	data.Body = nil
+}
+
+// resolveCanonical loads the body of a deduplicated entry from the entry it
+// refers to.
+func (m *cache) resolveCanonical(data *cacheData) error {
+	b, err := m.cache.Get(data.Canonical)
+	if err != nil {
+		m.dedupe.forget(data.Canonical)
+		return fmt.Errorf("error reading canonical entry: %w", err)
+	}
+
+	var canonical cacheData
+
+	if err = m.unmarshalEntry(b, &canonical); err != nil { //nolint:noinlineerr // acceptable inline error
+		return err
+	}
+
+	sum := sha256.Sum256(canonical.Body)
+	if hex.EncodeToString(sum[:]) != data.Digest {
+		m.dedupe.forget(data.Canonical)
+		return errCanonicalMismatch
+	}
+
+	data.Body = canonical.Body
+	data.Canonical = ""
+	data.Digest = ""
+
+	return nil
+}
@@ -0,0 +1,78 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_DeduplicateResponses(t *testing.T) {
+	dir := createTempDir(t)
+
+	body := "shared content"
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(body))
+	}
+
+	cfg := &Config{
+		Path:                 dir,
+		MaxExpiry:            10,
+		Cleanup:              20,
+		AddStatusHeader:      true,
+		DeduplicateResponses: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+
+		return rw
+	}
+
+	get("/a")
+	get("/b")
+
+	b, err := c.cache.Get("GETlocalhost/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data cacheData
+	if err := c.unmarshalEntry(b, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Canonical != "GETlocalhost/a" || len(data.Body) != 0 {
+		t.Errorf("expected /b to refer to /a, got canonical %q and body %q", data.Canonical, data.Body)
+	}
+
+	rw := get("/b")
+	if rw.Header().Get(cacheHeader) != cacheHitStatus || rw.Body.String() != body {
+		t.Errorf("unexpected deduplicated hit: status %q, body %q", rw.Header().Get(cacheHeader), rw.Body.String())
+	}
+
+	// Replacing the canonical entry with other content invalidates references.
+	body = "changed content"
+
+	if err := c.cache.Delete("GETlocalhost/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	get("/a")
+
+	rw = get("/b")
+	if rw.Header().Get(cacheHeader) != cacheErrorStatus || rw.Body.String() != body {
+		t.Errorf("unexpected response for stale reference: status %q, body %q", rw.Header().Get(cacheHeader), rw.Body.String())
+	}
+}
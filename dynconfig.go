@@ -0,0 +1,92 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// dynamicConfigFields are the fields a DynamicConfigHeader override may set,
+// by JSON name.
+var dynamicConfigFields = map[string]bool{
+	"maxExpiry": true,
+	"force":     true,
+}
+
+type configOverrideKey struct{}
+
+// withConfigOverride returns r carrying the configuration override found in
+// DynamicConfigHeader, if any. The header is removed so that it doesn't
+// reach the upstream.
+func (m *cache) withConfigOverride(r *http.Request) *http.Request {
+	if m.cfg.DynamicConfigHeader == "" {
+		return r
+	}
+
+	val := r.Header.Get(m.cfg.DynamicConfigHeader)
+	if val == "" {
+		return r
+	}
+
+	req := r.Clone(r.Context())
+	req.Header.Del(m.cfg.DynamicConfigHeader)
+
+	cfg, err := parseConfigOverride(m.cfg, val)
+	if err != nil {
+		log.Printf("Ignoring configuration override for %q: %v", requestURL(r), err)
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), configOverrideKey{}, cfg))
+}
+
+// requestConfig returns the configuration applying to r.
+func (m *cache) requestConfig(r *http.Request) *Config {
+	if cfg, ok := r.Context().Value(configOverrideKey{}).(*Config); ok {
+		return cfg
+	}
+
+	return m.cfg
+}
+
+// parseConfigOverride returns a copy of base with the fields set by the base64
+// encoded JSON object val. Only dynamicConfigFields can be set, and maxExpiry
+// can only be lowered.
+func parseConfigOverride(base *Config, val string) (*Config, error) {
+	b, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+
+	var fields map[string]json.RawMessage
+
+	if err = json.Unmarshal(b, &fields); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	for name := range fields {
+		if !dynamicConfigFields[name] {
+			return nil, fmt.Errorf("field %q can't be overridden", name)
+		}
+	}
+
+	cfg := *base
+
+	if err = json.Unmarshal(b, &cfg); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	if cfg.MaxExpiry < 1 {
+		return nil, errors.New("maxExpiry must be greater or equal to 1")
+	}
+
+	if cfg.MaxExpiry > base.MaxExpiry {
+		cfg.MaxExpiry = base.MaxExpiry
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,102 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseConfigOverride(t *testing.T) {
+	base := &Config{MaxExpiry: 100, Path: "/tmp/cache"}
+
+	tests := []struct {
+		name    string
+		val     string
+		want    int
+		wantErr bool
+	}{
+		{name: "valid", val: `{"maxExpiry": 60, "force": true}`, want: 60},
+		{name: "minimum maxExpiry", val: `{"maxExpiry": 1, "force": true}`, want: 1},
+		{name: "capped maxExpiry", val: `{"maxExpiry": 1000000, "force": true}`, want: 100},
+		{name: "field not allowed", val: `{"path": "/etc"}`, wantErr: true},
+		{name: "invalid maxExpiry", val: `{"maxExpiry": 0}`, wantErr: true},
+		{name: "invalid JSON", val: `{`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfigOverride(base, base64.StdEncoding.EncodeToString([]byte(test.val)))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err == nil && (cfg.MaxExpiry != test.want || !cfg.Force || cfg.Path != base.Path) {
+				t.Errorf("unexpected configuration: %+v", cfg)
+			}
+		})
+	}
+
+	if _, err := parseConfigOverride(base, "not base64!"); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+
+	if base.MaxExpiry != 100 || base.Force {
+		t.Error("expected the base configuration to be left untouched")
+	}
+}
+
+func TestCache_DynamicConfigHeader(t *testing.T) {
+	var upstreamHeader string
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Get("X-Simplecache-Config")
+
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                 createTempDir(t),
+		MaxExpiry:            10,
+		Cleanup:              20,
+		AddStatusHeader:      true,
+		DynamicConfigHeader:  "X-Simplecache-Config",
+		DynamicConfigTrusted: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(override string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		if override != "" {
+			req.Header.Set("X-Simplecache-Config", base64.StdEncoding.EncodeToString([]byte(override)))
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Header().Get("Cache-Status")
+	}
+
+	get("")
+
+	if got := get(`{"path": "/etc"}`); got != cacheMissStatus {
+		t.Errorf("expected disallowed overrides to be ignored, got status %q", got)
+	}
+
+	get(`{"force": true}`)
+
+	if upstreamHeader != "" {
+		t.Errorf("expected the override header not to reach the upstream, got %q", upstreamHeader)
+	}
+
+	if got := get(""); got != cacheHitStatus {
+		t.Errorf("expected the forced response to be cached, got status %q", got)
+	}
+}
@@ -0,0 +1,163 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const gzipEncoding = "gzip"
+
+// canonicalizeEncoding converts a gzip-encoded body to its uncompressed form
+// so a single cache entry can be served to any client. Bodies that cannot be
+// decoded are stored as-is and tagged with their encoding.
+func canonicalizeEncoding(data *cacheData) {
+	encoding := strings.ToLower(strings.TrimSpace(http.Header(data.Headers).Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return
+	}
+
+	data.BodyEncoding = encoding
+
+	if encoding != gzipEncoding {
+		return
+	}
+
+	body, err := gunzip(data.Body)
+	if err != nil {
+		return
+	}
+
+	delete(data.Headers, "Content-Encoding")
+	delete(data.Headers, "Content-Length")
+	rehashBody(data.Headers, body)
+
+	data.Body = body
+	data.BodyEncoding = ""
+}
+
+// transcodeEncoding returns the cached body encoded to match the client's
+// Accept-Encoding, adjusting the response headers accordingly.
+func transcodeEncoding(h http.Header, r *http.Request, data *cacheData) []byte {
+	acceptsGzip := acceptsEncoding(r.Header.Get("Accept-Encoding"), gzipEncoding)
+
+	switch {
+	case data.BodyEncoding == "" && acceptsGzip:
+		body, err := gzipBody(data.Body)
+		if err != nil {
+			return data.Body
+		}
+
+		h.Set("Content-Encoding", gzipEncoding)
+		h.Del("Content-Length")
+		rehashBody(h, body)
+		addVary(h, "Accept-Encoding")
+
+		return body
+	case data.BodyEncoding == gzipEncoding && !acceptsGzip:
+		return decodeGzip(h, data.Body)
+	default:
+		return data.Body
+	}
+}
+
+// decodeGzip returns the gzip body decompressed, removing the content
+// encoding from h. The body is returned as is if it can't be decompressed.
+func decodeGzip(h http.Header, body []byte) []byte {
+	decoded, err := gunzip(body)
+	if err != nil {
+		return body
+	}
+
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	rehashBody(h, decoded)
+
+	return decoded
+}
+
+// isGzipped reports whether h describes a gzip encoded body.
+func isGzipped(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Content-Encoding")), gzipEncoding)
+}
+
+// upstreamGzip reports whether gzip is requested from the upstream on behalf
+// of a client that didn't state its accepted encodings.
+func (m *cache) upstreamGzip(r *http.Request) bool {
+	return m.cfg.RequestUpstreamGzip && r.Header.Get("Accept-Encoding") == ""
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows the
+// given encoding with a non-zero quality. The encoding listed by name takes
+// precedence over "*".
+func acceptsEncoding(header, encoding string) bool {
+	var wildcard bool
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		accepted := true
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, err := strconv.ParseFloat(q, 64)
+			accepted = err == nil && quality > 0
+		}
+
+		if name == encoding {
+			return accepted
+		}
+
+		wildcard = accepted
+	}
+
+	return wildcard
+}
+
+func addVary(h http.Header, name string) {
+	for _, vals := range h.Values("Vary") {
+		for _, val := range strings.Split(vals, ",") {
+			if strings.EqualFold(strings.TrimSpace(val), name) {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", name)
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+
+	if _, err := zw.Write(body); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	return io.ReadAll(zr)
+}
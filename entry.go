@@ -0,0 +1,139 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	bodyStorageBase64 = "base64"
+	bodyStorageUTF8   = "utf8"
+	bodyStorageNone   = "none"
+)
+
+// Entries are stored as a big-endian uint32 metadata length, the JSON
+// encoded metadata and, when the body is stored raw, the body itself. Raw
+// bodies can be streamed to storage as they are received.
+const entryMetaLenSize = 4
+
+var errInvalidEntry = errors.New("invalid cache entry")
+
+// entryMeta returns the prefix written before a raw body.
+func entryMeta(data *cacheData) ([]byte, error) {
+	meta, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, entryMetaLenSize, entryMetaLenSize+len(meta))
+	binary.BigEndian.PutUint32(b, uint32(len(meta))) //nolint:gosec // metadata is far below 4GB
+
+	return append(b, meta...), nil
+}
+
+// marshalEntry serializes data for storage, storing the body according to
+// the configured body storage encoding.
+func (m *cache) marshalEntry(data *cacheData) (io.Reader, error) {
+	compress := m.cfg.CompressCache && len(data.Body) > m.cfg.CompressThreshold
+	if compress && m.noTransform(data.Headers) {
+		log.Printf("Not compressing no-transform cache item")
+
+		compress = false
+	}
+
+	if compress {
+		body, err := gzipBody(data.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing body: %w", err)
+		}
+
+		data.Body = body
+		data.Compressed = true
+	}
+
+	var body []byte
+
+	switch m.cfg.BodyStorageEncoding {
+	case bodyStorageUTF8:
+		if isTextContent(http.Header(data.Headers).Get("Content-Type")) && utf8.Valid(data.Body) {
+			data.BodyText = string(data.Body)
+			data.Body = nil
+		}
+	case bodyStorageNone:
+		body = data.Body
+		data.BodyRaw = true
+		data.Body = nil
+	}
+
+	meta, err := entryMeta(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(meta), bytes.NewReader(body)), nil
+}
+
+// splitEntry returns the JSON metadata and the raw body of a stored entry.
+func splitEntry(b []byte) ([]byte, []byte, error) {
+	if len(b) < entryMetaLenSize {
+		return nil, nil, errInvalidEntry
+	}
+
+	n := int(binary.BigEndian.Uint32(b))
+	if n > len(b)-entryMetaLenSize {
+		return nil, nil, errInvalidEntry
+	}
+
+	return b[entryMetaLenSize : entryMetaLenSize+n], b[entryMetaLenSize+n:], nil
+}
+
+// unmarshalEntry restores an entry read from storage.
+func (m *cache) unmarshalEntry(b []byte, data *cacheData) error {
+	meta, raw, err := splitEntry(b)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(meta, data); err != nil { //nolint:noinlineerr // acceptable inline error
+		return err
+	}
+
+	switch {
+	case data.BodyText != "":
+		data.Body = []byte(data.BodyText)
+		data.BodyText = ""
+	case data.BodyRaw:
+		data.Body = raw
+		data.BodyRaw = false
+	}
+
+	if data.Compressed {
+		body, err := gunzip(data.Body)
+		if err != nil {
+			return fmt.Errorf("error decompressing body: %w", err)
+		}
+
+		data.Body = body
+		data.Compressed = false
+	}
+
+	return nil
+}
+
+func isTextContent(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "javascript")
+}
@@ -0,0 +1,174 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var bodyStorageEncodings = []string{bodyStorageBase64, bodyStorageUTF8, bodyStorageNone}
+
+func newEntryTestCache(tb testing.TB, encoding string) *cache {
+	tb.Helper()
+
+	fc, err := newFileCache(createTempDir(tb), time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(fc.Close)
+
+	return &cache{cache: fc, cfg: &Config{BodyStorageEncoding: encoding}}
+}
+
+func roundTripEntry(tb testing.TB, c *cache, data *cacheData) cacheData {
+	tb.Helper()
+
+	entry, err := c.marshalEntry(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	b, err := io.ReadAll(entry)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var got cacheData
+	if err = c.unmarshalEntry(b, &got); err != nil {
+		tb.Fatal(err)
+	}
+
+	return got
+}
+
+func jsonBody(size int) []byte {
+	var b strings.Builder
+
+	b.WriteString("[")
+
+	for i := 0; b.Len() < size; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		fmt.Fprintf(&b, `{"id":%d,"name":"item %d"}`, i, i)
+	}
+
+	b.WriteString("]")
+
+	return []byte(b.String())
+}
+
+func TestCache_BodyStorageEncoding(t *testing.T) {
+	body := jsonBody(1024)
+
+	for _, encoding := range bodyStorageEncodings {
+		t.Run(encoding, func(t *testing.T) {
+			c := newEntryTestCache(t, encoding)
+
+			data := cacheData{
+				Status:  200,
+				Headers: map[string][]string{"Content-Type": {"application/json"}},
+				Body:    body,
+			}
+
+			got := roundTripEntry(t, c, &data)
+
+			if !bytes.Equal(got.Body, body) {
+				t.Errorf("unexpected body: want %q, got %q", body, got.Body)
+			}
+		})
+	}
+}
+
+func BenchmarkCache_BodyStorageEncoding(b *testing.B) {
+	body := jsonBody(10 * 1024)
+
+	for _, encoding := range bodyStorageEncodings {
+		b.Run(encoding, func(b *testing.B) {
+			c := newEntryTestCache(b, encoding)
+
+			var stored int
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				data := cacheData{
+					Status:  200,
+					Headers: map[string][]string{"Content-Type": {"application/json"}},
+					Body:    body,
+				}
+
+				entry, err := c.marshalEntry(&data)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err = c.cache.Set(testCacheKey, entry, time.Minute); err != nil {
+					b.Fatal(err)
+				}
+
+				got, _ := c.cache.Get(testCacheKey)
+				stored = len(got)
+
+				var restored cacheData
+				if err = c.unmarshalEntry(got, &restored); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(stored), "stored-bytes")
+		})
+	}
+}
+
+func TestCache_CompressThreshold(t *testing.T) {
+	c := newEntryTestCache(t, "")
+	c.cfg.CompressCache = true
+	c.cfg.CompressThreshold = 1024
+	c.cfg.RespectNoTransform = true
+
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		body           []byte
+		wantCompressed bool
+	}{
+		{
+			name: "should not compress small bodies",
+			body: jsonBody(512),
+		},
+		{
+			name:           "should compress large bodies",
+			body:           jsonBody(4096),
+			wantCompressed: true,
+		},
+		{
+			name:    "should not compress no-transform bodies",
+			headers: map[string][]string{"Cache-Control": {"public, no-transform"}},
+			body:    jsonBody(4096),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := cacheData{Status: 200, Headers: test.headers, Body: test.body}
+
+			got := roundTripEntry(t, c, &data)
+
+			if data.Compressed != test.wantCompressed {
+				t.Errorf("unexpected compressed flag: want %t, got %t", test.wantCompressed, data.Compressed)
+			}
+
+			if !bytes.Equal(got.Body, test.body) {
+				t.Error("unexpected body after round trip")
+			}
+		})
+	}
+}
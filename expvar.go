@@ -0,0 +1,49 @@
+package plugin_simpleforcecache
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarCaches maps instance names to the cache currently serving them.
+// Variables can't be unpublished, so those published for an earlier instance
+// with the same name, such as before a configuration reload, report the
+// current one.
+var expvarCaches sync.Map
+
+// expvarValues are the published variables, named simplecache.<name>.<var>.
+var expvarValues = map[string]func(m *cache) any{
+	"hits":   func(m *cache) any { return m.stats.hits.Load() },
+	"misses": func(m *cache) any { return m.stats.misses.Load() },
+	"stores": func(m *cache) any { return m.stats.stores.Load() },
+	"errors": func(m *cache) any { return m.stats.errors.Load() },
+	"hitRatio": func(m *cache) any {
+		hits, misses := m.stats.hits.Load(), m.stats.misses.Load()
+		if hits+misses == 0 {
+			return 0.0
+		}
+
+		return float64(hits) / float64(hits+misses)
+	},
+	"evictions": func(m *cache) any { return getUsage(m.cache).Evictions },
+	"entries":   func(m *cache) any { return getUsage(m.cache).Entries },
+	"diskBytes": func(m *cache) any { return getUsage(m.cache).Bytes },
+}
+
+// publishExpvars exposes the cache stats through expvar.
+func (m *cache) publishExpvars() {
+	if _, loaded := expvarCaches.Swap(m.name, m); loaded {
+		return
+	}
+
+	name := m.name
+
+	for v, fn := range expvarValues {
+		fn := fn
+
+		expvar.Publish("simplecache."+name+"."+v, expvar.Func(func() any {
+			c, _ := expvarCaches.Load(name)
+			return fn(c.(*cache)) //nolint:forcetypeassert // only caches are stored
+		}))
+	}
+}
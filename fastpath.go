@@ -0,0 +1,183 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// fastPathEntry is the metadata of an entry stored under a FastPathPrefixes
+// path, along with its serialized form to recognize the stored entry.
+type fastPathEntry struct {
+	data cacheData
+	meta []byte
+}
+
+// fastPathIndex keeps the metadata of the entries stored under
+// FastPathPrefixes paths, so hits on them don't parse it again.
+type fastPathIndex struct {
+	mu      sync.RWMutex
+	entries map[string]fastPathEntry
+}
+
+func newFastPathIndex() *fastPathIndex {
+	return &fastPathIndex{entries: map[string]fastPathEntry{}} //nolint:exhaustruct // zero mutex is ready to use
+}
+
+// put indexes the metadata of data, stored under key with a raw body.
+func (fi *fastPathIndex) put(key string, data cacheData) {
+	meta, err := json.Marshal(&data)
+	if err != nil {
+		return
+	}
+
+	data.BodyRaw = false
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	if _, ok := fi.entries[key]; !ok && len(fi.entries) >= maxTrackedHitKeys {
+		return
+	}
+
+	fi.entries[key] = fastPathEntry{data: data, meta: meta}
+}
+
+func (fi *fastPathIndex) get(key string) (fastPathEntry, bool) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	entry, ok := fi.entries[key]
+
+	return entry, ok
+}
+
+func (fi *fastPathIndex) remove(key string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	delete(fi.entries, key)
+}
+
+// indexFastPath indexes the entry stored under key for r, once marshalled,
+// if it can be served by fastLookup.
+func (m *cache) indexFastPath(key string, r *http.Request, data cacheData) {
+	if m.fastPath == nil || !hasPathPrefix(r.URL.Path, m.cfg.FastPathPrefixes) {
+		return
+	}
+
+	if !data.BodyRaw || data.Compressed || data.Canonical != "" {
+		m.fastPath.remove(key)
+		return
+	}
+
+	m.fastPath.put(key, data)
+}
+
+// fastLookup serves a fresh entry of a FastPathPrefixes path from its
+// indexed metadata, reading only its body from storage. It reports whether
+// it served the request; otherwise the regular lookup applies.
+func (m *cache) fastLookup(w http.ResponseWriter, r *http.Request, key string) bool {
+	if m.fastPath == nil || m.forceMiss || !hasPathPrefix(r.URL.Path, m.cfg.FastPathPrefixes) || m.clientNoCache(r) {
+		return false
+	}
+
+	entry, ok := m.fastPath.get(key)
+	if !ok {
+		return false
+	}
+
+	data := entry.data
+	now := m.cfg.now()
+
+	switch {
+	case isStale(&data, now):
+		return false
+	case m.earlyExpiryBeta() > 0 && expiresEarly(&data, m.earlyExpiryBeta(), now):
+		return false
+	case m.cfg.DetectCollisions && data.URL != "" && data.URL != m.entryURL(r):
+		return false
+	}
+
+	if !m.readFastBody(key, entry.meta, &data) {
+		m.fastPath.remove(key)
+		return false
+	}
+
+	defer data.closeBody()
+
+	if m.hotKeys != nil {
+		m.hotKeys.hit(key)
+	}
+
+	m.serveCached(w, r, &data, cacheHitStatus)
+
+	if m.fingerprints != nil && r.Method == http.MethodGet {
+		m.revalidateHit(r, key, data.Headers)
+	}
+
+	return true
+}
+
+// readFastBody reads the body of the entry stored under key into data, if
+// its metadata still is meta. The metadata is compared, not parsed.
+func (m *cache) readFastBody(key string, meta []byte, data *cacheData) bool {
+	if m.useSendfile() {
+		f, err := openEntryFile(m.cache, key)
+
+		switch {
+		case err == nil:
+			return readFastBodyFile(f, meta, data)
+		case !errors.Is(err, errNoEntryFile):
+			return false
+		}
+	}
+
+	b, err := m.get(key)
+	if err != nil {
+		return false
+	}
+
+	stored, raw, err := splitEntry(b)
+	if err != nil || !bytes.Equal(stored, meta) {
+		return false
+	}
+
+	data.Body = raw
+
+	return true
+}
+
+// readFastBodyFile is readFastBody for an entry file, leaving large bodies
+// in f for serveCached to copy.
+func readFastBodyFile(f *os.File, meta []byte, data *cacheData) bool {
+	_, stored, bodySize, err := readFileMeta(f)
+	if err != nil || !bytes.Equal(stored, meta) {
+		_ = f.Close()
+		return false
+	}
+
+	if bodySize >= sendfileThreshold {
+		data.bodyFile = f
+		data.bodySize = bodySize
+
+		return true
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	body, err := io.ReadAll(f)
+	if err != nil {
+		return false
+	}
+
+	data.Body = body
+
+	return true
+}
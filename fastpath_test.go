@@ -0,0 +1,122 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFastPathTestCache(tb testing.TB, prefixes []string) http.Handler {
+	tb.Helper()
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/css")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body { color: red }"))
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(tb),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		BodyStorageEncoding: bodyStorageNone,
+		FastPathPrefixes:    prefixes,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return h
+}
+
+func TestCache_FastPathPrefixes(t *testing.T) {
+	h := newFastPathTestCache(t, []string{"/static/"})
+	c := h.(*cache)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+
+		return rec
+	}
+
+	serve("/static/app.css")
+	serve("/other")
+
+	if _, ok := c.fastPath.get("GETlocalhost/static/app.css"); !ok {
+		t.Fatal("expected the fast path entry to be indexed")
+	}
+
+	if _, ok := c.fastPath.get("GETlocalhost/other"); ok {
+		t.Error("expected paths outside fastPathPrefixes not to be indexed")
+	}
+
+	rec := serve("/static/app.css")
+	if rec.Header().Get("Cache-Status") != cacheHitStatus || rec.Body.String() != "body { color: red }" || rec.Header().Get("ETag") != `"v1"` {
+		t.Errorf("unexpected fast path hit: %q with headers %v", rec.Body.String(), rec.Header())
+	}
+
+	// An entry replaced behind the index is not served from the stale
+	// metadata.
+	data := cacheData{Status: http.StatusOK, Headers: map[string][]string{"Etag": {`"v2"`}}, Body: []byte("replaced")}
+
+	entry, err := c.marshalEntry(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.cache.Set("GETlocalhost/static/app.css", entry, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serve("/static/app.css")
+	if rec.Body.String() != "replaced" || rec.Header().Get("ETag") != `"v2"` {
+		t.Errorf("expected the replaced entry to be served, got %q with headers %v", rec.Body.String(), rec.Header())
+	}
+
+	if _, ok := c.fastPath.get("GETlocalhost/static/app.css"); ok {
+		t.Error("expected the outdated fast path entry to be dropped")
+	}
+}
+
+func BenchmarkCache_FastPath(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		name := "lookup"
+		if fast {
+			name = "fast-path"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var prefixes []string
+			if fast {
+				prefixes = []string{"/static/"}
+			}
+
+			h := newFastPathTestCache(b, prefixes)
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/static/app.css", nil)
+
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+
+				if !strings.HasPrefix(rec.Body.String(), "body") {
+					b.Fatal("unexpected body")
+				}
+			}
+		})
+	}
+}
@@ -2,26 +2,65 @@
 package plugin_simpleforcecache
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var errCacheMiss = errors.New("cache miss")
 
+const (
+	// tempFilePattern names files being written, which the vacuum skips.
+	tempFilePattern = ".tmp-*"
+	// lockFileName names the lock file serializing the vacuum across processes.
+	lockFileName = ".lock"
+	// walFileName names the write-ahead log of queued writes.
+	walFileName = ".wal"
+	// probeFileName names the file written to check a cache directory.
+	probeFileName = ".cache_probe"
+
+	defaultLockTimeout = 5 * time.Second
+	lockRetryInterval  = 10 * time.Millisecond
+)
+
 type fileCache struct {
 	path string
 	pm   *pathMutex
+	now  func() time.Time
+
+	lock        *dirLock
+	lockTimeout time.Duration
+	// maxAge, when set, bounds the age of entries regardless of their expiry.
+	maxAge time.Duration
+	// workers is the number of goroutines sweeping expired entries.
+	workers int
+
+	evictions atomic.Int64
+	// storedBytes counts the bytes of the entries found on disk at startup
+	// or written since, less those of the entries removed since. entrySizes
+	// counts the same entries by size.
+	storedBytes atomic.Int64
+	entrySizes  sizeHistogram
+
+	// stop ends the vacuum, which closes done once it returned.
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
+func newFileCache(path string, vacuum, lockTimeout, maxAge time.Duration, workers int, now func() time.Time) (*fileCache, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -42,9 +81,30 @@ func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
 		return nil, errors.New("path must be a directory")
 	}
 
-	fc := &fileCache{
-		path: path,
-		pm:   &pathMutex{lock: map[string]*fileLock{}}, //nolint:exhaustruct // mu is zero value
+	if lockTimeout <= 0 {
+		lockTimeout = defaultLockTimeout
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	fc := &fileCache{ //nolint:exhaustruct // counters are zero values
+		path:        path,
+		pm:          &pathMutex{lock: map[string]*fileLock{}}, //nolint:exhaustruct // mu is zero value
+		now:         now,
+		lock:        newDirLock(path),
+		lockTimeout: lockTimeout,
+		maxAge:      maxAge,
+		workers:     workers,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	// Seed the counters with the entries kept from a previous run, which are
+	// uncounted when removed or replaced.
+	if err = fc.walkEntries(func(info os.FileInfo) { fc.stored(info.Size()) }); err != nil {
+		return nil, fmt.Errorf("error walking cache directory: %w", err)
 	}
 
 	go fc.vacuum(vacuum)
@@ -54,52 +114,194 @@ func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
 
 //nolint:funcorder // vacuum is called during initialization
 func (c *fileCache) vacuum(interval time.Duration) {
+	defer close(c.done)
+
 	timer := time.NewTicker(interval)
 	defer timer.Stop()
 
-	for range timer.C {
-		_ = filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
-			switch {
-			case err != nil:
-				return err
-			case info.IsDir():
-				return nil
-			}
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-timer.C:
+		}
 
-			mu := c.pm.MutexAt(filepath.Base(path))
-			mu.Lock()
+		unlock, ok, err := c.lock.exclusive(c.lockTimeout)
+		if err != nil {
+			log.Printf("Error locking cache for cleanup: %v", err)
+			continue
+		}
 
-			defer mu.Unlock()
+		if !ok {
+			log.Printf("Warning: skipping cache cleanup, lock not acquired within %s", c.lockTimeout)
+			continue
+		}
 
-			// Get the expiry.
-			var t [8]byte
+		c.sweep()
 
-			f, err := os.Open(filepath.Clean(path))
-			if err != nil {
-				// Just skip the file in this case.
-				return nil
-			}
+		unlock()
+	}
+}
 
-			if n, err := f.Read(t[:]); err != nil && n != 8 {
-				return nil
-			}
+// Close stops the vacuum, waiting for a running sweep to finish.
+func (c *fileCache) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+
+	<-c.done
+}
 
-			_ = f.Close()
+// sweep deletes the expired entries. The top-level directories, which
+// partition the keys by hash, are spread over the cleanup workers.
+func (c *fileCache) sweep() {
+	dirs, err := os.ReadDir(c.path)
+	if err != nil {
+		log.Printf("Error reading cache directory for cleanup: %v", err)
+		return
+	}
 
-			expires := time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0) //nolint:gosec // safe conversion
-			if !expires.Before(time.Now()) {
-				return nil
+	var wg sync.WaitGroup
+
+	for i := 0; i < c.workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := i; j < len(dirs); j += c.workers {
+				if dirs[j].IsDir() {
+					c.sweepShard(dirs[j].Name())
+				}
 			}
+		}(i)
+	}
 
-			// Delete the file.
-			_ = os.Remove(path)
+	wg.Wait()
+}
 
-			return nil
-		})
+// sweepShard deletes the expired entries of the top-level directory name,
+// holding off the writes to it meanwhile.
+func (c *fileCache) sweepShard(name string) {
+	if shard, err := hex.DecodeString(name); err == nil && len(shard) == 1 {
+		unlock, ok := c.lock.shard(shard[0], c.lockTimeout)
+		if !ok {
+			log.Printf("Warning: skipping cleanup of %q, lock not acquired within %s", name, c.lockTimeout)
+			return
+		}
+
+		defer unlock()
 	}
+
+	_ = filepath.Walk(filepath.Join(c.path, name), c.sweepFile)
+}
+
+// sweepFile deletes the entry at path if it expired.
+func (c *fileCache) sweepFile(path string, info os.FileInfo, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case info.IsDir(), strings.HasPrefix(info.Name(), ".tmp-"), info.Name() == lockFileName, info.Name() == walFileName:
+		return nil
+	}
+
+	mu := c.pm.MutexAt(filepath.Base(path))
+	mu.Lock()
+
+	defer mu.Unlock()
+
+	// Get the expiry.
+	var t [8]byte
+
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		// Just skip the file in this case.
+		return nil
+	}
+
+	if n, err := f.Read(t[:]); err != nil && n != 8 {
+		_ = f.Close()
+		return nil
+	}
+
+	expires := time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0) //nolint:gosec // safe conversion
+
+	tooOld := false
+	if c.maxAge > 0 && !expires.Before(c.now()) {
+		tooOld = entryCreated(f, info).Before(c.now().Add(-c.maxAge))
+	}
+
+	_ = f.Close()
+
+	if !expires.Before(c.now()) && !tooOld {
+		return nil
+	}
+
+	// Delete the file.
+	if os.Remove(path) == nil {
+		c.evictions.Add(1)
+		c.removed(info.Size())
+	}
+
+	return nil
+}
+
+// usage walks the cache directory to count the stored entries and bytes.
+func (c *fileCache) usage() storageUsage {
+	u := storageUsage{Entries: 0, Bytes: 0, Evictions: c.evictions.Load(), StoredBytes: c.storedBytes.Load()}
+
+	_ = c.walkEntries(func(info os.FileInfo) {
+		u.Entries++
+		u.Bytes += info.Size()
+	})
+
+	return u
+}
+
+// TotalStoredBytes walks the cache directory to sum the size of the entries
+// on disk, as opposed to the running count of storedBytes.
+func (c *fileCache) TotalStoredBytes() (int64, error) {
+	var total int64
+
+	err := c.walkEntries(func(info os.FileInfo) {
+		total += info.Size()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error walking cache directory: %w", err)
+	}
+
+	return total, nil
+}
+
+// walkEntries calls fn for each entry file in the cache directory.
+func (c *fileCache) walkEntries(fn func(info os.FileInfo)) error {
+	return filepath.Walk(c.path, func(_ string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir(), strings.HasPrefix(info.Name(), ".tmp-"), info.Name() == lockFileName, info.Name() == walFileName:
+			return nil
+		}
+
+		fn(info)
+
+		return nil
+	})
+}
+
+func (c *fileCache) storedByteCount() int64 {
+	return c.storedBytes.Load()
+}
+
+func (c *fileCache) sizeHistogram() [sizeBuckets]int64 {
+	return c.entrySizes.snapshot()
 }
 
 func (c *fileCache) Get(key string) ([]byte, error) {
+	b, _, err := c.GetExpiry(key)
+	return b, err
+}
+
+// GetExpiry returns the value stored under key along with its expiry time.
+func (c *fileCache) GetExpiry(key string) ([]byte, time.Time, error) {
 	mu := c.pm.MutexAt(key)
 	mu.RLock()
 
@@ -107,44 +309,82 @@ func (c *fileCache) Get(key string) ([]byte, error) {
 
 	p := keyPath(c.path, key)
 	if info, err := os.Stat(p); err != nil || info.IsDir() {
-		return nil, errCacheMiss
+		return nil, time.Time{}, errCacheMiss
 	}
 
 	b, err := os.ReadFile(filepath.Clean(p))
 	if err != nil {
-		return nil, fmt.Errorf("error reading file %q: %w", p, err)
+		return nil, time.Time{}, fmt.Errorf("error reading file %q: %w", p, err)
 	}
 
 	expires := time.Unix(int64(binary.LittleEndian.Uint64(b[:8])), 0) //nolint:gosec // safe conversion
-	if expires.Before(time.Now()) {
-		_ = os.Remove(p)
-		return nil, errCacheMiss
+	if expires.Before(c.now()) {
+		if os.Remove(p) == nil {
+			c.removed(int64(len(b)))
+		}
+
+		return nil, time.Time{}, errCacheMiss
 	}
 
-	return b[8:], nil
+	return b[8:], expires, nil
 }
 
-func (c *fileCache) Set(key string, val []byte, expiry time.Duration) error {
+// open returns the file of the entry stored under key, positioned after its
+// expiry. Entries are replaced by renaming, so the file stays readable once
+// the lock is released.
+func (c *fileCache) open(key string) (*os.File, error) {
 	mu := c.pm.MutexAt(key)
-	mu.Lock()
+	mu.RLock()
 
-	defer mu.Unlock()
+	defer mu.RUnlock()
 
+	p := keyPath(c.path, key)
+
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return nil, errCacheMiss
+	}
+
+	b := make([]byte, expirySize)
+	if _, err := io.ReadFull(f, b); err != nil { //nolint:noinlineerr // acceptable inline error
+		_ = f.Close()
+		return nil, errCacheMiss
+	}
+
+	expires := time.Unix(int64(binary.LittleEndian.Uint64(b)), 0) //nolint:gosec // safe conversion
+	if expires.Before(c.now()) {
+		_ = f.Close()
+
+		if info, err := os.Stat(p); err == nil && os.Remove(p) == nil { //nolint:noinlineerr // acceptable inline error
+			c.removed(info.Size())
+		}
+
+		return nil, errCacheMiss
+	}
+
+	return f, nil
+}
+
+// Set streams val to the file for key. The value is written to a temporary
+// file first and moved in place once complete, so readers never see partial
+// entries and a failing reader leaves the previous entry untouched.
+func (c *fileCache) Set(key string, val io.Reader, expiry time.Duration) error {
 	p := keyPath(c.path, key)
 	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
 		return fmt.Errorf("error creating file path: %w", err)
 	}
 
-	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE, 0o600)
+	f, err := os.CreateTemp(filepath.Dir(p), tempFilePattern)
 	if err != nil {
 		return fmt.Errorf("error creating file: %w", err)
 	}
 
 	defer func() {
 		_ = f.Close()
+		_ = os.Remove(f.Name())
 	}()
 
-	timestamp := uint64(time.Now().Add(expiry).Unix()) //nolint:gosec // safe conversion
+	timestamp := uint64(c.now().Add(expiry).Unix()) //nolint:gosec // safe conversion
 
 	var t [8]byte
 
@@ -154,10 +394,129 @@ func (c *fileCache) Set(key string, val []byte, expiry time.Duration) error {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
-	if _, err = f.Write(val); err != nil {
+	n, err := io.Copy(f, val)
+	if err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
+	// Only the rename needs to be excluded from cleanup sweeps.
+	defer c.lock.shared(key)()
+
+	mu := c.pm.MutexAt(key)
+	mu.Lock()
+
+	defer mu.Unlock()
+
+	old, statErr := os.Stat(p)
+
+	if err = os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+
+	if statErr == nil {
+		c.removed(old.Size())
+	}
+
+	c.stored(int64(len(t)) + n)
+
+	return nil
+}
+
+func (c *fileCache) Delete(key string) error {
+	mu := c.pm.MutexAt(key)
+	mu.Lock()
+
+	defer mu.Unlock()
+
+	p := keyPath(c.path, key)
+	info, statErr := os.Stat(p)
+
+	if err := os.Remove(p); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("error deleting file: %w", err)
+	}
+
+	if statErr == nil {
+		c.removed(info.Size())
+	}
+
+	return nil
+}
+
+// stored counts an entry of size bytes written to disk.
+func (c *fileCache) stored(size int64) {
+	c.storedBytes.Add(size)
+	c.entrySizes.add(size, 1)
+}
+
+// removed counts an entry of size bytes removed from disk.
+func (c *fileCache) removed(size int64) {
+	c.storedBytes.Add(-size)
+	c.entrySizes.add(size, -1)
+}
+
+// entryCreated returns when the entry read from f, positioned after the
+// expiry, was first stored. Entries refreshed in place keep their creation
+// time; the modification time of the file is used for older entries.
+func entryCreated(f io.Reader, info os.FileInfo) time.Time {
+	var n [entryMetaLenSize]byte
+	if _, err := io.ReadFull(f, n[:]); err != nil {
+		return info.ModTime()
+	}
+
+	size := int64(binary.BigEndian.Uint32(n[:]))
+	if size > info.Size() {
+		return info.ModTime()
+	}
+
+	meta := make([]byte, size)
+	if _, err := io.ReadFull(f, meta); err != nil {
+		return info.ModTime()
+	}
+
+	var data struct {
+		Created int64 `json:"created"`
+	}
+
+	if err := json.Unmarshal(meta, &data); err != nil || data.Created == 0 {
+		return info.ModTime()
+	}
+
+	return time.Unix(data.Created, 0)
+}
+
+// probeCacheDir checks that entries can be written to and read back from dir,
+// which fails on full or read-only filesystems.
+func probeCacheDir(dir string) error {
+	p := filepath.Join(dir, probeFileName)
+	want := []byte("probe")
+
+	if err := os.WriteFile(p, want, 0o600); err != nil {
+		return fmt.Errorf("error writing probe file: %w", err)
+	}
+
+	defer func() { _ = os.Remove(p) }()
+
+	got, err := os.ReadFile(filepath.Clean(p))
+	if err != nil {
+		return fmt.Errorf("error reading probe file: %w", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("probe file %q has unexpected content", p)
+	}
+
+	if err = os.Remove(p); err != nil {
+		return fmt.Errorf("error deleting probe file: %w", err)
+	}
+
 	return nil
 }
 
@@ -5,6 +5,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -16,11 +19,13 @@ const testCacheKey = "GETlocalhost:8080/test/path"
 func TestFileCache(t *testing.T) {
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(dir, time.Second, 0, 0, 1, time.Now)
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
 
+	t.Cleanup(fc.Close)
+
 	_, err = fc.Get(testCacheKey)
 	if err == nil {
 		t.Error("unexpected cache content")
@@ -28,7 +33,7 @@ func TestFileCache(t *testing.T) {
 
 	cacheContent := []byte("some random cache content that should be exact")
 
-	err = fc.Set(testCacheKey, cacheContent, time.Second)
+	err = fc.Set(testCacheKey, bytes.NewReader(cacheContent), time.Second)
 	if err != nil {
 		t.Errorf("unexpected cache set error: %v", err)
 	}
@@ -55,11 +60,13 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(dir, time.Second, 0, 0, 1, time.Now)
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
 
+	t.Cleanup(fc.Close)
+
 	cacheContent := []byte("some random cache content that should be exact")
 
 	var wg sync.WaitGroup
@@ -87,7 +94,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 		defer wg.Done()
 
 		for {
-			err = fc.Set(testCacheKey, cacheContent, time.Second)
+			err = fc.Set(testCacheKey, bytes.NewReader(cacheContent), time.Second)
 			if err != nil {
 				panic(fmt.Errorf("unexpected cache set error: %w", err))
 			}
@@ -144,12 +151,14 @@ func TestPathMutex(t *testing.T) {
 func BenchmarkFileCache_Get(b *testing.B) {
 	dir := createTempDir(b)
 
-	fc, err := newFileCache(dir, time.Minute)
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 1, time.Now)
 	if err != nil {
 		b.Errorf("unexpected newFileCache error: %v", err)
 	}
 
-	_ = fc.Set(testCacheKey, []byte("some random cache content that should be exact"), time.Minute)
+	b.Cleanup(fc.Close)
+
+	_ = fc.Set(testCacheKey, strings.NewReader("some random cache content that should be exact"), time.Minute)
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -158,3 +167,212 @@ func BenchmarkFileCache_Get(b *testing.B) {
 		_, _ = fc.Get(testCacheKey)
 	}
 }
+
+func TestFileCache_SweepWorkers(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	fc, err := newFileCache(createTempDir(t), time.Hour, 0, 0, 4, clock.Now)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	for i := 0; i < 100; i++ {
+		expiry := time.Hour
+		if i%2 == 0 {
+			expiry = time.Second
+		}
+
+		if err = fc.Set(fmt.Sprintf("key-%d", i), strings.NewReader("content"), expiry); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	fc.sweep()
+
+	if got := fc.usage(); got.Entries != 50 || got.Evictions != 50 {
+		t.Errorf("expected the 50 expired entries to be swept, got %d entries and %d evictions", got.Entries, got.Evictions)
+	}
+}
+
+// BenchmarkFileCache_Sweep measures how fast cleanup sweeps go through 100k
+// entries depending on the number of workers.
+func BenchmarkFileCache_Sweep(b *testing.B) {
+	const entries = 100_000
+
+	dir := createTempDir(b)
+
+	fc, err := newFileCache(dir, time.Hour, 0, 0, 1, time.Now)
+	if err != nil {
+		b.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	b.Cleanup(fc.Close)
+
+	for i := 0; i < entries; i++ {
+		if err = fc.Set(fmt.Sprintf("key-%d", i), strings.NewReader("content"), time.Hour); err != nil {
+			b.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			fc, err := newFileCache(dir, time.Hour, 0, 0, workers, time.Now)
+			if err != nil {
+				b.Fatalf("unexpected newFileCache error: %v", err)
+			}
+
+			b.Cleanup(fc.Close)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				fc.sweep()
+			}
+
+			b.ReportMetric(float64(entries*b.N)/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
+
+func TestFileCache_Delete(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Second, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	if err = fc.Set(testCacheKey, strings.NewReader("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Fatalf("unexpected cache delete error: %v", err)
+	}
+
+	if _, err = fc.Get(testCacheKey); err == nil {
+		t.Error("expected cache miss after delete")
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Errorf("unexpected error deleting missing key: %v", err)
+	}
+}
+
+func TestFileCache_MaxAge(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, 10*time.Millisecond, 0, time.Minute, 1, time.Now)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	for _, key := range []string{"old", "fresh"} {
+		if err = fc.Set(key, strings.NewReader("content"), time.Hour); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	stored := time.Now().Add(-2 * time.Minute)
+	if err = os.Chtimes(keyPath(dir, "old"), stored, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries refreshed in place keep their creation time.
+	meta, err := entryMeta(&cacheData{Created: stored.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fc.Set("refreshed", bytes.NewReader(meta), time.Hour); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	for _, key := range []string{"old", "refreshed"} {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			if _, err = fc.Get(key); err != nil {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q, older than the max age, to be swept", key)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err = fc.Get("fresh"); err != nil {
+		t.Errorf("expected the fresh entry to be kept: %v", err)
+	}
+}
+
+func TestDirLock(t *testing.T) {
+	lock := newDirLock(createTempDir(t))
+
+	shard := keyHash(testCacheKey)[0]
+	unlockShared := lock.shared(testCacheKey)
+
+	if _, ok := lock.shard(shard, 50*time.Millisecond); ok {
+		t.Fatal("expected the shard lock to time out while a write holds it")
+	}
+
+	unlockOther, ok := lock.shard(shard+1, 50*time.Millisecond)
+	if !ok {
+		t.Fatal("expected the other shards to be lockable during the write")
+	}
+
+	unlockOther()
+	unlockShared()
+
+	unlock, ok := lock.shard(shard, 50*time.Millisecond)
+	if !ok {
+		t.Fatal("expected the shard lock once the write finished")
+	}
+
+	unlock()
+}
+
+func TestDirLock_LockFile(t *testing.T) {
+	dir := createTempDir(t)
+	lock := newDirLock(dir)
+
+	// Another instance sweeping the directory holds the lock file.
+	path := filepath.Join(dir, lockFileName)
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := lock.exclusive(50 * time.Millisecond); ok || err != nil {
+		t.Fatalf("expected the exclusive lock to time out while the lock file exists, got %t, %v", ok, err)
+	}
+
+	stale := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, ok, err := lock.exclusive(50 * time.Millisecond)
+	if !ok || err != nil {
+		t.Fatalf("expected a stale lock file to be taken over, got %t, %v", ok, err)
+	}
+
+	unlock()
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the lock file to be removed on unlock, got %v", err)
+	}
+
+	if _, _, err = newDirLock(filepath.Join(dir, "missing")).exclusive(50 * time.Millisecond); err == nil {
+		t.Error("expected an error locking a missing directory")
+	}
+}
@@ -0,0 +1,90 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// keySet is a set of keys safe for concurrent use.
+type keySet struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// add adds key to the set and reports whether it was missing.
+func (s *keySet) add(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key]; ok {
+		return false
+	}
+
+	s.keys[key] = struct{}{}
+
+	return true
+}
+
+func (s *keySet) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+}
+
+// revalidateHit asks the upstream in the background whether the entry with
+// headers just served from key for r changed, using its ETag or
+// Last-Modified. A changed response replaces the entry and an unchanged one
+// extends it. Each key is revalidated once at a time.
+func (m *cache) revalidateHit(r *http.Request, key string, headers map[string][]string) {
+	etag := http.Header(headers).Get("ETag")
+	lastModified := http.Header(headers).Get("Last-Modified")
+
+	if etag == "" && lastModified == "" || !m.fingerprints.add(key) {
+		return
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if m.cfg.UpstreamTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.upstreamTimeout())
+	}
+
+	req := r.Clone(ctx)
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	go func() {
+		defer m.fingerprints.remove(key)
+		defer cancel()
+
+		rw, computeDuration := m.fetch(req)
+
+		switch rw.status {
+		case http.StatusNotModified:
+			b, err := m.cache.Get(key)
+			if err != nil {
+				return
+			}
+
+			var data cacheData
+			if err := m.unmarshalEntry(b, &data); err != nil { //nolint:noinlineerr // acceptable inline error
+				log.Printf("Error reading cache item: %v", err)
+				return
+			}
+
+			m.refresh(req, key, &data)
+		case http.StatusOK:
+			m.store(key, req, rw, computeDuration, writePriorityLow)
+		}
+	}()
+}
@@ -0,0 +1,110 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache_FingerprintRevalidate(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		version     = "v1"
+		notModified int
+	)
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		etag := `"` + version + `"`
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("ETag", etag)
+
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+
+			rw.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(version))
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		AddStatusHeader:       true,
+		FingerprintRevalidate: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		return rec
+	}
+
+	waitFor := func(msg string, cond func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	idle := func() bool {
+		c.fingerprints.mu.Lock()
+		defer c.fingerprints.mu.Unlock()
+
+		return len(c.fingerprints.keys) == 0
+	}
+
+	serve()
+
+	if rec := serve(); rec.Header().Get("Cache-Status") != cacheHitStatus || rec.Body.String() != "v1" {
+		t.Fatalf("expected a hit on v1, got %q with status %q", rec.Body.String(), rec.Header().Get("Cache-Status"))
+	}
+
+	waitFor("expected the hit to be revalidated", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return notModified == 1
+	})
+	waitFor("expected the revalidation to finish", idle)
+
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+
+	if rec := serve(); rec.Body.String() != "v1" {
+		t.Fatalf("expected the cached v1 to be served, got %q", rec.Body.String())
+	}
+
+	waitFor("expected the changed response to replace the entry", func() bool {
+		return serve().Body.String() == "v2"
+	})
+	waitFor("expected the revalidation to finish", idle)
+}
@@ -0,0 +1,47 @@
+package plugin_simpleforcecache
+
+import (
+	"crypto/md5"  //nolint:gosec // used for key distribution, not security
+	"crypto/sha1" //nolint:gosec // used for key distribution, not security
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// hasher turns a cache key into a fixed-length storage key.
+type hasher interface {
+	Hash(key string) string
+}
+
+// digestHasher hashes keys with a standard library hash function.
+type digestHasher struct {
+	newHash func() hash.Hash
+}
+
+func (h digestHasher) Hash(key string) string {
+	d := h.newHash()
+	_, _ = io.WriteString(d, key)
+
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+func newHasher(algorithm string) (hasher, error) {
+	switch strings.ToLower(algorithm) {
+	case "", "sha256":
+		return digestHasher{newHash: sha256.New}, nil
+	case "sha1":
+		return digestHasher{newHash: sha1.New}, nil
+	case "md5":
+		return digestHasher{newHash: md5.New}, nil
+	case "fnv32":
+		return digestHasher{newHash: func() hash.Hash { return fnv.New32a() }}, nil
+	case "fnv64":
+		return digestHasher{newHash: func() hash.Hash { return fnv.New64a() }}, nil
+	default:
+		return nil, fmt.Errorf("unsupported hashAlgorithm %q", algorithm)
+	}
+}
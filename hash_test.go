@@ -0,0 +1,55 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"testing"
+)
+
+var hashAlgorithms = map[string]int{
+	"sha256": 64,
+	"sha1":   40,
+	"md5":    32,
+	"fnv32":  8,
+	"fnv64":  16,
+}
+
+func TestNewHasher(t *testing.T) {
+	for algorithm, size := range hashAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			h, err := newHasher(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := h.Hash(testCacheKey)
+			if len(got) != size {
+				t.Errorf("unexpected hash length: want %d, got %d", size, len(got))
+			}
+
+			if got != h.Hash(testCacheKey) {
+				t.Error("expected hash to be deterministic")
+			}
+		})
+	}
+
+	if _, err := newHasher("crc64"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func BenchmarkHasher(b *testing.B) {
+	for algorithm := range hashAlgorithms {
+		h, err := newHasher(algorithm)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(algorithm, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				_ = h.Hash(testCacheKey)
+			}
+		})
+	}
+}
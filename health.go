@@ -0,0 +1,90 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHealthCheckInterval = 10
+
+// healthChecker polls a health check URL to track whether the upstream is
+// available.
+type healthChecker struct {
+	url      string
+	interval time.Duration
+	healthy  atomic.Bool
+}
+
+func newHealthChecker(url string, interval time.Duration) *healthChecker {
+	hc := &healthChecker{ //nolint:exhaustruct // healthy is set below
+		url:      url,
+		interval: interval,
+	}
+
+	// Assume the upstream is healthy until a check proves otherwise.
+	hc.healthy.Store(true)
+
+	go hc.run()
+
+	return hc
+}
+
+//nolint:funcorder // run is called during initialization
+func (hc *healthChecker) run() {
+	hc.check()
+
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hc.check()
+	}
+}
+
+func (hc *healthChecker) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.interval)
+	defer cancel()
+
+	healthy := false
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.url, nil)
+	if err == nil {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+
+			healthy = resp.StatusCode < http.StatusBadRequest
+		}
+	}
+
+	if hc.healthy.Swap(healthy) != healthy {
+		log.Printf("Upstream health changed: healthy=%t", healthy)
+	}
+}
+
+// upstreamHealthy reports whether upstream calls should be attempted.
+func (m *cache) upstreamHealthy() bool {
+	return m.health == nil || m.cfg.FailOpenOnUnhealthy || m.health.healthy.Load()
+}
+
+// serveUnhealthy answers a request without calling the unhealthy upstream,
+// using the cached entry if there is one, or the fallback response otherwise.
+func (m *cache) serveUnhealthy(w http.ResponseWriter, r *http.Request, cached *cacheData) string {
+	if cached != nil {
+		m.serveCached(w, r, cached, cacheStaleStatus)
+		return cacheStaleStatus
+	}
+
+	if m.cfg.FallbackURL != "" && m.serveFallback(w, r) {
+		return cacheFallbackStatus
+	}
+
+	m.setCacheStatus(w.Header(), cacheErrorStatus)
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	return cacheErrorStatus
+}
@@ -0,0 +1,85 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_HealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if !healthy.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hs.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		wantCode int
+		wantCall bool
+	}{
+		{name: "skips upstream when unhealthy", failOpen: false, wantCode: http.StatusServiceUnavailable, wantCall: false},
+		{name: "calls upstream when failing open", failOpen: true, wantCode: http.StatusOK, wantCall: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			next := func(rw http.ResponseWriter, _ *http.Request) {
+				called = true
+
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Path:                createTempDir(t),
+				MaxExpiry:           10,
+				Cleanup:             20,
+				HealthCheckURL:      hs.URL,
+				HealthCheckInterval: 60,
+				FailOpenOnUnhealthy: test.failOpen,
+			}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.(*cache)
+
+			// Wait for the initial check to see the unhealthy upstream.
+			deadline := time.Now().Add(5 * time.Second)
+			for c.health.healthy.Load() {
+				if time.Now().After(deadline) {
+					t.Fatal("upstream was never reported unhealthy")
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if rw.Code != test.wantCode || called != test.wantCall {
+				t.Errorf("unexpected response: code %d, upstream called %t", rw.Code, called)
+			}
+
+			healthy.Store(true)
+			defer healthy.Store(false)
+
+			c.health.check()
+
+			if !c.health.healthy.Load() {
+				t.Error("expected upstream to be reported healthy")
+			}
+		})
+	}
+}
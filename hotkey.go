@@ -0,0 +1,90 @@
+package plugin_simpleforcecache
+
+import (
+	"sync"
+	"time"
+)
+
+// hitWindow counts hits in the current and previous windows, which
+// approximates a sliding window.
+type hitWindow struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// hotKeyTracker tracks per-key hit rates to detect keys hit more than
+// threshold times per window.
+type hotKeyTracker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	keys      map[string]*hitWindow
+	now       func() time.Time
+}
+
+func newHotKeyTracker(threshold int, window time.Duration, now func() time.Time) *hotKeyTracker {
+	return &hotKeyTracker{
+		mu:        sync.Mutex{},
+		threshold: threshold,
+		window:    window,
+		keys:      map[string]*hitWindow{},
+		now:       now,
+	}
+}
+
+// hit records a cache hit for key.
+func (t *hotKeyTracker) hit(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.keys[key]
+	if !ok {
+		if len(t.keys) >= maxTrackedHitKeys {
+			t.keys = map[string]*hitWindow{}
+		}
+
+		w = &hitWindow{start: t.now(), current: 0, previous: 0}
+		t.keys[key] = w
+	}
+
+	t.advance(w)
+	w.current++
+}
+
+// hot reports whether the hit rate of key exceeds the threshold.
+func (t *hotKeyTracker) hot(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.keys[key]
+	if !ok {
+		return false
+	}
+
+	t.advance(w)
+
+	// Weigh the previous window by how much of it still overlaps the
+	// sliding window ending now.
+	elapsed := float64(t.now().Sub(w.start)) / float64(t.window)
+	rate := float64(w.previous)*(1-elapsed) + float64(w.current)
+
+	return rate > float64(t.threshold)
+}
+
+// advance moves the windows of w forward to the current time.
+func (t *hotKeyTracker) advance(w *hitWindow) {
+	elapsed := t.now().Sub(w.start)
+	if elapsed < t.window {
+		return
+	}
+
+	if elapsed < 2*t.window {
+		w.previous = w.current
+	} else {
+		w.previous = 0
+	}
+
+	w.current = 0
+	w.start = w.start.Add(elapsed.Truncate(t.window))
+}
@@ -0,0 +1,96 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHotKeyTracker(t *testing.T) {
+	clock := newManualClock(time.Unix(1000, 0))
+	tracker := newHotKeyTracker(2, time.Minute, clock.Now)
+
+	for i := 0; i < 3; i++ {
+		tracker.hit("a")
+	}
+
+	tracker.hit("b")
+
+	if !tracker.hot("a") || tracker.hot("b") || tracker.hot("c") {
+		t.Error("expected only a to be hot")
+	}
+
+	// Half of the previous window still counts.
+	clock.Advance(90 * time.Second)
+
+	if tracker.hot("a") {
+		t.Error("expected a to cool down")
+	}
+
+	tracker.hit("a")
+
+	if !tracker.hot("a") {
+		t.Error("expected a to be hot again")
+	}
+
+	clock.Advance(3 * time.Minute)
+
+	if tracker.hot("a") {
+		t.Error("expected a to cool down after idle windows")
+	}
+}
+
+func TestCache_HotKeyTTL(t *testing.T) {
+	c := newEntryTestCache(t, "")
+	c.cfg.MaxExpiry = 10
+	c.cfg.HotKeyThreshold = 1
+	c.cfg.HotKeyTTLMultiplier = 2
+	c.hotKeys = newHotKeyTracker(1, time.Minute, time.Now)
+
+	c.hotKeys.hit("hot")
+	c.hotKeys.hit("hot")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+
+	for key, want := range map[string]time.Duration{"hot": 30 * time.Second, "cold": 10 * time.Second} {
+		_, expiry, ok := c.newEntry(key, req, http.StatusOK, http.Header{}, 0)
+		if !ok || expiry != want {
+			t.Errorf("unexpected expiry for %s key: want %v, got %v", key, want, expiry)
+		}
+	}
+}
+
+func TestCache_HotKeyClock(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		HotKeyThreshold: 1,
+		Clock:           clock.Now,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	c.hotKeys.hit("hot")
+	c.hotKeys.hit("hot")
+
+	if !c.hotKeys.hot("hot") {
+		t.Fatal("expected the key to be hot")
+	}
+
+	clock.Advance(3 * time.Minute)
+
+	if c.hotKeys.hot("hot") {
+		t.Error("expected the key to cool down on the configured clock")
+	}
+}
@@ -0,0 +1,229 @@
+package plugin_simpleforcecache
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	invalidationRetryDelay = time.Second
+	// invalidationQueueSize bounds the invalidations waiting to be published.
+	invalidationQueueSize = 1024
+	// invalidationTagSuffix names the Redis channel carrying purged tags.
+	invalidationTagSuffix = ":tags"
+)
+
+// InvalidationBackend broadcasts invalidated cache keys and purged cache tags
+// between instances.
+type InvalidationBackend interface {
+	// Publish announces that key was invalidated.
+	Publish(key string) error
+	// PublishTag announces that the entries tagged with tag were purged.
+	PublishTag(tag string) error
+	// Subscribe calls onKey and onTag in the background for every key and tag
+	// announced by any instance, including this one.
+	Subscribe(onKey, onTag func(string))
+}
+
+// invalidationMessage is an invalidation waiting to be published.
+type invalidationMessage struct {
+	value string
+	tag   bool
+}
+
+// newInvalidationBackend creates a backend from a channel URL such as
+// redis://localhost:6379/cache-invalidation.
+func newInvalidationBackend(channel string) (InvalidationBackend, error) {
+	u, err := url.Parse(channel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invalidationChannel: %w", err)
+	}
+
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported invalidationChannel scheme %q", u.Scheme)
+	}
+
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, errors.New("invalidationChannel must be of the form redis://host:port/channel")
+	}
+
+	return &redisInvalidation{addr: u.Host, channel: name}, nil //nolint:exhaustruct // connection is lazy
+}
+
+// redisInvalidation uses Redis pub/sub to broadcast invalidations. Purged
+// tags are published on a second channel, suffixed with :tags.
+type redisInvalidation struct {
+	addr    string
+	channel string
+
+	mu  sync.Mutex
+	pub *redisConn
+}
+
+func (ri *redisInvalidation) Publish(key string) error {
+	return ri.publish(ri.channel, key)
+}
+
+func (ri *redisInvalidation) PublishTag(tag string) error {
+	return ri.publish(ri.channel+invalidationTagSuffix, tag)
+}
+
+func (ri *redisInvalidation) publish(channel, msg string) error {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	if ri.pub == nil {
+		conn, err := dialRedis(ri.addr)
+		if err != nil {
+			return err
+		}
+
+		ri.pub = conn
+	}
+
+	if _, err := ri.pub.DoTimeout(redisCommandTimeout, "PUBLISH", channel, msg); err != nil { //nolint:noinlineerr // acceptable inline error
+		_ = ri.pub.Close()
+		ri.pub = nil
+
+		return err
+	}
+
+	return nil
+}
+
+func (ri *redisInvalidation) Subscribe(onKey, onTag func(string)) {
+	go func() {
+		for {
+			if err := ri.subscribe(onKey, onTag); err != nil { //nolint:noinlineerr // acceptable inline error
+				log.Printf("Error receiving cache invalidations: %v", err)
+			}
+
+			time.Sleep(invalidationRetryDelay)
+		}
+	}()
+}
+
+func (ri *redisInvalidation) subscribe(onKey, onTag func(string)) error {
+	conn, err := dialRedis(ri.addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err = conn.Send("SUBSCRIBE", ri.channel, ri.channel+invalidationTagSuffix); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+
+		val, ok := msg[2].(string)
+		if !ok {
+			continue
+		}
+
+		if msg[1] == ri.channel+invalidationTagSuffix {
+			onTag(val)
+		} else {
+			onKey(val)
+		}
+	}
+}
+
+// invalidate removes key from the local cache and announces it to the other
+// instances, without waiting for the announcement to be sent.
+func (m *cache) invalidate(key string) {
+	m.deleteLocal(key)
+	m.publishInvalidation(invalidationMessage{value: key, tag: false})
+}
+
+// publishInvalidation queues msg to be announced to the other instances. The
+// announcement is dropped when the queue is full, so that a slow backend
+// never holds up requests.
+func (m *cache) publishInvalidation(msg invalidationMessage) {
+	if m.invalidations == nil {
+		return
+	}
+
+	select {
+	case m.invalidations <- msg:
+	default:
+		log.Printf("Dropping cache invalidation of %q: queue full", msg.value)
+	}
+}
+
+// publishInvalidations announces the queued invalidations.
+func (m *cache) publishInvalidations() {
+	for msg := range m.invalidations {
+		publish := m.invalidation.Publish
+		if msg.tag {
+			publish = m.invalidation.PublishTag
+		}
+
+		if err := publish(msg.value); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error publishing cache invalidation: %v", err)
+		}
+	}
+}
+
+// deleteLocal removes the entry stored under key from the local storage.
+func (m *cache) deleteLocal(key string) {
+	if err := m.cache.Delete(key); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error deleting cache item: %v", err)
+	}
+
+	if m.cfg.MetadataOnlyCache {
+		_ = m.cache.Delete(key + metaKeySuffix)
+	}
+
+	if m.fastPath != nil {
+		m.fastPath.remove(key)
+	}
+}
+
+// purgeLocalTag removes the entries tagged with tag, announced by an
+// invalidation backend, from the local cache.
+func (m *cache) purgeLocalTag(tag string) {
+	if _, err := m.purgeTag(tag); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error purging cache tag: %v", err)
+	}
+}
+
+// purgeTag removes the entries tagged with tag from the local cache
+// directories, and their copies from the other storage layers and the fast
+// path index. It returns how many entries were removed from the directories.
+func (m *cache) purgeTag(tag string) (int, error) {
+	var total int
+
+	for _, dir := range cacheDirs(m.cfg) {
+		n, keys, err := purgeDir(dir, tag)
+		total += n
+
+		for _, key := range keys {
+			m.deleteLocal(key)
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
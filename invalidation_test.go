@@ -0,0 +1,253 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBackend is an InvalidationBackend recording what is published.
+// Publishing blocks while block is open.
+type recordingBackend struct {
+	block chan struct{}
+
+	mu   sync.Mutex
+	keys []string
+	tags []string
+}
+
+func (b *recordingBackend) Publish(key string) error {
+	<-b.block
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.keys = append(b.keys, key)
+
+	return nil
+}
+
+func (b *recordingBackend) PublishTag(tag string) error {
+	<-b.block
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tags = append(b.tags, tag)
+
+	return nil
+}
+
+func (b *recordingBackend) Subscribe(_, _ func(string)) {}
+
+func (b *recordingBackend) published() ([]string, []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.keys...), append([]string(nil), b.tags...)
+}
+
+func TestCache_InvalidationChannel(t *testing.T) {
+	fr := newFakeRedis(t)
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		InvalidationChannel: "redis://" + fr.Addr() + "/invalidations",
+	}
+
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := h.(*cache)
+
+	if err = c.cache.Set(testCacheKey, strings.NewReader("content"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fr.subscribers("invalidations") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for subscription")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Simulate another instance invalidating the key.
+	conn, err := dialRedis(fr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.Do("PUBLISH", "invalidations", testCacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := c.cache.Get(testCacheKey); err != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for invalidation")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewInvalidationBackend(t *testing.T) {
+	for _, channel := range []string{"udp://239.0.0.1:9999", "redis://localhost:6379", "redis:///channel"} {
+		if _, err := newInvalidationBackend(channel); err == nil {
+			t.Errorf("expected error for %q", channel)
+		}
+	}
+}
+
+func TestCache_InvalidationChannelTags(t *testing.T) {
+	fr := newFakeRedis(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("X-Cache-Tags", "product-1")
+		_, _ = rw.Write([]byte("product"))
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		CacheTagHeader:      "X-Cache-Tags",
+		InvalidationChannel: "redis://" + fr.Addr() + "/invalidations",
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := h.(*cache)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/product", nil))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fr.subscribers("invalidations:tags") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for subscription")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Simulate another instance purging the tag.
+	conn, err := dialRedis(fr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.Do("PUBLISH", "invalidations:tags", "product-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := c.cache.Get("GETlocalhost/product"); err != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the tag purge")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCache_InvalidationBackend(t *testing.T) {
+	backend := &recordingBackend{block: make(chan struct{})}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AdminAPI:            true,
+		AdminToken:          "secret",
+		InvalidationBackend: backend,
+	}
+
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := h.(*cache)
+
+	if err = c.cache.Set("GETlocalhost/test", strings.NewReader("content"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests don't wait for the blocked backend.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, adminRequest(http.MethodDelete, adminEntryPath+"?key="+url.QueryEscape("GETlocalhost/test"), nil))
+
+		if rw.Code != http.StatusNoContent {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNoContent, rw.Code)
+		}
+
+		if _, err := c.PurgeByTag("product-1"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalidation blocked on the backend")
+	}
+
+	if _, err = c.cache.Get("GETlocalhost/test"); err == nil {
+		t.Error("expected the entry to be deleted locally")
+	}
+
+	close(backend.block)
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		keys, tags := backend.published()
+		if len(keys) == 1 && len(tags) == 1 {
+			if keys[0] != "GETlocalhost/test" || tags[0] != "product-1" {
+				t.Errorf("unexpected invalidations: keys %q, tags %q", keys, tags)
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the invalidations, got keys %q, tags %q", keys, tags)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package plugin_simpleforcecache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// staleLockAge is the age after which a lock file is considered left over
+	// by a process that crashed while sweeping.
+	staleLockAge = 10 * time.Minute
+	// lockRefreshInterval is how often a sweep touches its lock file, so that
+	// long sweeps are not mistaken for crashed ones.
+	lockRefreshInterval = staleLockAge / 4
+)
+
+// dirLock serializes cleanup sweeps of a cache directory against writes.
+// Writes of the process hold a read lock on the top-level directory of their
+// key, which sweeps take in turn while sweeping it. Sweeps also create a lock
+// file in the directory exclusively, so that Traefik instances sharing the
+// directory don't sweep it at the same time.
+type dirLock struct {
+	path   string
+	shards [256]sync.RWMutex
+}
+
+func newDirLock(dir string) *dirLock {
+	return &dirLock{path: filepath.Join(dir, lockFileName)} //nolint:exhaustruct // zero mutexes are ready to use
+}
+
+// shared blocks until the write of key may proceed and returns the function
+// releasing the lock.
+func (l *dirLock) shared(key string) func() {
+	mu := &l.shards[keyHash(key)[0]]
+	mu.RLock()
+
+	return mu.RUnlock
+}
+
+// shard waits up to timeout for the writes to the top-level directory shard
+// to finish and returns the function releasing the lock. It reports false
+// when the wait times out.
+func (l *dirLock) shard(shard byte, timeout time.Duration) (func(), bool) {
+	mu := &l.shards[shard]
+	deadline := time.Now().Add(timeout)
+
+	for !mu.TryLock() {
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+
+	return mu.Unlock, true
+}
+
+// exclusive waits up to timeout for other sweeps to finish and returns the
+// function releasing the lock. It reports false when the wait times out.
+// The lock file is touched every lockRefreshInterval until it is released.
+func (l *dirLock) exclusive(timeout time.Duration) (func(), bool, error) {
+	ok, err := l.createFile(time.Now().Add(timeout))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				_ = os.Chtimes(l.path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		_ = os.Remove(l.path)
+	}, true, nil
+}
+
+// createFile creates the lock file, waiting until deadline for another
+// process to remove it. Stale lock files are taken over.
+func (l *dirLock) createFile(deadline time.Time) (bool, error) {
+	for {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return true, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return false, fmt.Errorf("error creating lock file: %w", err)
+		}
+
+		if info, err := os.Stat(l.path); err == nil && time.Since(info.ModTime()) > staleLockAge { //nolint:noinlineerr // acceptable inline error
+			_ = os.Remove(l.path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,116 @@
+package plugin_simpleforcecache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// memoryCache is a size-bounded in-memory LRU cache.
+type memoryCache struct {
+	size int
+
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	order   *list.List
+	onEvict func(key string)
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	key     string
+	val     []byte
+	expires time.Time
+}
+
+func newMemoryCache(size int, now func() time.Time) *memoryCache {
+	return &memoryCache{ //nolint:exhaustruct // onEvict is optional
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+		now:   now,
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, error) {
+	b, _, err := c.GetExpiry(key)
+	return b, err
+}
+
+// GetExpiry returns the value stored under key along with its expiry time.
+func (c *memoryCache) GetExpiry(key string) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, time.Time{}, errCacheMiss
+	}
+
+	entry, _ := el.Value.(*memoryEntry)
+	if entry.expires.Before(c.now()) {
+		c.remove(el)
+		return nil, time.Time{}, errCacheMiss
+	}
+
+	c.order.MoveToFront(el)
+
+	return entry.val, entry.expires, nil
+}
+
+func (c *memoryCache) Set(key string, val io.Reader, expiry time.Duration) error {
+	b, err := io.ReadAll(val)
+	if err != nil {
+		return fmt.Errorf("error reading cache item: %w", err)
+	}
+
+	c.setExpires(key, b, c.now().Add(expiry))
+
+	return nil
+}
+
+func (c *memoryCache) setExpires(key string, val []byte, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &memoryEntry{key: key, val: val, expires: expires}
+
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+
+		return
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.remove(oldest)
+
+		if c.onEvict != nil {
+			old, _ := oldest.Value.(*memoryEntry)
+			c.onEvict(old.key)
+		}
+	}
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	return nil
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	entry, _ := el.Value.(*memoryEntry)
+
+	c.order.Remove(el)
+	delete(c.items, entry.key)
+}
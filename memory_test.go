@@ -0,0 +1,42 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	mc := newMemoryCache(2, time.Now)
+
+	var evicted []string
+
+	mc.onEvict = func(key string) {
+		evicted = append(evicted, key)
+	}
+
+	_ = mc.Set("a", strings.NewReader("a"), time.Minute)
+	_ = mc.Set("b", strings.NewReader("b"), time.Minute)
+
+	// Touch a so that b becomes the least recently used entry.
+	if _, err := mc.Get("a"); err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	_ = mc.Set("c", strings.NewReader("c"), time.Minute)
+
+	if _, err := mc.Get("b"); err == nil {
+		t.Error("expected least recently used entry to be evicted")
+	}
+
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("unexpected evictions: %v", evicted)
+	}
+
+	_ = mc.Set("d", strings.NewReader("d"), -time.Second)
+
+	if _, err := mc.Get("d"); err == nil {
+		t.Error("expected expired entry to be a miss")
+	}
+}
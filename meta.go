@@ -0,0 +1,41 @@
+package plugin_simpleforcecache
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// metaKeySuffix is appended to the key of an entry to store its metadata,
+// without the body, so that HEAD requests don't read large bodies.
+const metaKeySuffix = ":meta"
+
+// metaKey returns the key of the metadata entry of the GET response matching
+// r.
+func (m *cache) metaKey(r *http.Request) string {
+	get := *r
+	get.Method = http.MethodGet
+
+	return m.key(&get) + metaKeySuffix
+}
+
+// storeMeta stores the status and headers of data under the metadata key of
+// the entry stored under key.
+func (m *cache) storeMeta(key string, data cacheData, expiry time.Duration) {
+	data.Body = nil
+	data.BodyText = ""
+	data.BodyRaw = false
+	data.Compressed = false
+	data.Canonical = ""
+	data.Digest = ""
+
+	entry, err := m.marshalEntry(&data)
+	if err != nil {
+		log.Printf("Error serializing cache metadata: %v", err)
+		return
+	}
+
+	if err = m.cache.Set(key+metaKeySuffix, entry, expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error setting cache metadata: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_MetadataOnlyCache(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("a large body"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, MetadataOnlyCache: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	b, err := c.cache.Get("GETlocalhost/test" + metaKeySuffix)
+	if err != nil {
+		t.Fatalf("expected a metadata entry: %v", err)
+	}
+
+	var meta cacheData
+	if err = c.unmarshalEntry(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(meta.Body) != 0 || meta.Status != http.StatusOK {
+		t.Errorf("unexpected metadata entry: status %d, body %q", meta.Status, meta.Body)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "http://localhost/test", nil))
+
+	if got := rw.Header().Get(cacheHeader); got != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheHitStatus, got)
+	}
+
+	if got := rw.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("unexpected ETag: %q", got)
+	}
+
+	if rw.Body.Len() != 0 || calls != 1 {
+		t.Errorf("unexpected HEAD response: body %q, %d upstream calls", rw.Body.String(), calls)
+	}
+}
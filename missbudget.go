@@ -0,0 +1,102 @@
+package plugin_simpleforcecache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMissBudgetWindow   = 60
+	defaultMissBudgetCooldown = 60
+)
+
+// keyMisses holds the recent uncacheable misses of a key.
+type keyMisses struct {
+	times        []time.Time
+	blockedUntil time.Time
+}
+
+// missBudget limits how often the upstream is called for keys whose
+// responses can't be cached: once a key misses more than budget times within
+// window, requests for it are rejected for cooldown.
+type missBudget struct {
+	mu       sync.Mutex
+	budget   int
+	window   time.Duration
+	cooldown time.Duration
+	keys     map[string]*keyMisses
+	now      func() time.Time
+}
+
+func newMissBudget(budget int, window, cooldown time.Duration, now func() time.Time) *missBudget {
+	return &missBudget{
+		mu:       sync.Mutex{},
+		budget:   budget,
+		window:   window,
+		cooldown: cooldown,
+		keys:     map[string]*keyMisses{},
+		now:      now,
+	}
+}
+
+// miss records a miss for key whose response could not be cached.
+func (b *missBudget) miss(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	km, ok := b.keys[key]
+	if !ok {
+		if len(b.keys) >= maxTrackedHitKeys {
+			b.keys = map[string]*keyMisses{}
+		}
+
+		km = &keyMisses{times: nil, blockedUntil: time.Time{}}
+		b.keys[key] = km
+	}
+
+	now := b.now()
+
+	// Drop the misses that slid out of the window.
+	i := 0
+	for i < len(km.times) && !km.times[i].After(now.Add(-b.window)) {
+		i++
+	}
+
+	km.times = append(km.times[i:], now)
+
+	if len(km.times) > b.budget {
+		km.times = nil
+		km.blockedUntil = now.Add(b.cooldown)
+	}
+}
+
+// blocked reports whether key exhausted its budget, and how long until it
+// cools down.
+func (b *missBudget) blocked(key string) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	km, ok := b.keys[key]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := km.blockedUntil.Sub(b.now())
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	return remaining, true
+}
+
+// serveOverBudget rejects a request for a key that exhausted its miss
+// budget, asking the client to retry once it cools down.
+func (m *cache) serveOverBudget(w http.ResponseWriter, retryAfter time.Duration) {
+	m.setCacheStatus(w.Header(), cacheErrorStatus)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
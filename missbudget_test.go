@@ -0,0 +1,79 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMissBudget(t *testing.T) {
+	clock := newManualClock(time.Now())
+	b := newMissBudget(2, time.Minute, 30*time.Second, clock.Now)
+
+	b.miss("key")
+	b.miss("key")
+
+	if _, blocked := b.blocked("key"); blocked {
+		t.Fatal("expected the key to be within its budget")
+	}
+
+	// The first misses slide out of the window.
+	clock.Advance(time.Minute)
+	b.miss("key")
+
+	if _, blocked := b.blocked("key"); blocked {
+		t.Fatal("expected misses outside the window not to count")
+	}
+
+	b.miss("key")
+	b.miss("key")
+
+	if retryAfter, blocked := b.blocked("key"); !blocked || retryAfter != 30*time.Second {
+		t.Fatalf("expected the key to be blocked for 30s, got %s, %t", retryAfter, blocked)
+	}
+
+	if _, blocked := b.blocked("other"); blocked {
+		t.Error("expected other keys not to be blocked")
+	}
+
+	clock.Advance(30 * time.Second)
+
+	if _, blocked := b.blocked("key"); blocked {
+		t.Error("expected the key to be unblocked after the cooldown")
+	}
+}
+
+func TestCache_MissBudget(t *testing.T) {
+	callCount := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount++
+
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, MissBudget: 2}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec *httptest.ResponseRecorder
+
+	for i := 0; i < 4; i++ {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/uncacheable", nil))
+	}
+
+	if callCount != 3 {
+		t.Errorf("expected the upstream to be called until the budget is exceeded, got %d calls", callCount)
+	}
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected a 503 with Retry-After, got %d and %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
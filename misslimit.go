@@ -0,0 +1,81 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// keySemaphore bounds the concurrent upstream calls for one key. refs counts
+// the requests holding or waiting for it, so it can be dropped once unused.
+type keySemaphore struct {
+	slots chan struct{}
+	refs  int
+}
+
+// missLimiter limits how many requests can call the upstream for the same
+// key at once, to prevent dog-piling on expired entries.
+type missLimiter struct {
+	mu    sync.Mutex
+	limit int
+	keys  map[string]*keySemaphore
+}
+
+func newMissLimiter(limit int) *missLimiter {
+	return &missLimiter{
+		mu:    sync.Mutex{},
+		limit: limit,
+		keys:  map[string]*keySemaphore{},
+	}
+}
+
+// acquire waits up to timeout for an upstream slot for key. It returns the
+// function releasing the slot, and whether the request had to wait. The
+// request proceeds without a slot when the wait times out.
+func (l *missLimiter) acquire(ctx context.Context, key string, timeout time.Duration) (func(), bool) {
+	l.mu.Lock()
+
+	sem, ok := l.keys[key]
+	if !ok {
+		sem = &keySemaphore{slots: make(chan struct{}, l.limit), refs: 0}
+		l.keys[key] = sem
+	}
+
+	sem.refs++
+
+	l.mu.Unlock()
+
+	done := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if sem.refs--; sem.refs == 0 {
+			delete(l.keys, key)
+		}
+	}
+
+	release := func() {
+		<-sem.slots
+		done()
+	}
+
+	select {
+	case sem.slots <- struct{}{}:
+		return release, false
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case sem.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	done()
+
+	return func() {}, true
+}
@@ -0,0 +1,89 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_MaxConcurrentMissesPerKey(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls atomic.Int32
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("ok"))
+	}
+
+	cfg := &Config{
+		Path:                      dir,
+		MaxExpiry:                 10,
+		Cleanup:                   20,
+		MaxConcurrentMissesPerKey: 1,
+		MissWaitTimeout:           5000,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if rw.Body.String() != "ok" {
+				t.Errorf("unexpected body: %q", rw.Body.String())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected a single upstream call, got %d", n)
+	}
+
+	if n := len(h.(*cache).misses.keys); n != 0 {
+		t.Errorf("expected semaphores to be released, %d left", n)
+	}
+}
+
+func TestMissLimiter_Timeout(t *testing.T) {
+	l := newMissLimiter(1)
+
+	release, waited := l.acquire(context.Background(), "key", time.Second)
+	if waited {
+		t.Error("expected the first request not to wait")
+	}
+
+	start := time.Now()
+
+	releaseLate, waited := l.acquire(context.Background(), "key", 50*time.Millisecond)
+	if !waited || time.Since(start) < 50*time.Millisecond {
+		t.Error("expected the second request to wait for the timeout")
+	}
+
+	releaseLate()
+	release()
+
+	if len(l.keys) != 0 {
+		t.Errorf("expected semaphores to be released, %d left", len(l.keys))
+	}
+}
@@ -0,0 +1,55 @@
+package plugin_simpleforcecache
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const defaultLogKeyMaxLen = 200
+
+type missLogEntry struct {
+	Time           string `json:"time"`
+	Key            string `json:"key"`
+	URL            string `json:"url"`
+	Method         string `json:"method"`
+	Path           string `json:"path"`
+	Query          string `json:"query,omitempty"`
+	UserAgent      string `json:"userAgent,omitempty"`
+	AcceptLanguage string `json:"acceptLanguage,omitempty"`
+}
+
+// logMiss writes one JSON line describing a cache miss, for offline analysis
+// of cache efficiency.
+func (m *cache) logMiss(r *http.Request, key string) {
+	b, err := json.Marshal(missLogEntry{
+		Time:           m.cfg.now().UTC().Format(time.RFC3339),
+		Key:            m.displayKey(key),
+		URL:            requestURL(r),
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Query:          r.URL.RawQuery,
+		UserAgent:      r.UserAgent(),
+		AcceptLanguage: r.Header.Get("Accept-Language"),
+	})
+	if err != nil {
+		return
+	}
+
+	m.missLog.Println(string(b))
+}
+
+// displayKey returns key for logs, truncated to LogKeyMaxLen characters. The
+// key used for storage is never truncated.
+func (m *cache) displayKey(key string) string {
+	if m.cfg.LogKeyMaxLen <= 0 {
+		return key
+	}
+
+	runes := []rune(key)
+	if len(runes) <= m.cfg.LogKeyMaxLen {
+		return key
+	}
+
+	return string(runes[:m.cfg.LogKeyMaxLen]) + "..."
+}
@@ -0,0 +1,97 @@
+package plugin_simpleforcecache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// origins matches the client of a request against IP networks and exact
+// host values.
+type origins struct {
+	networks []*net.IPNet
+	hosts    map[string]bool
+}
+
+// parseOrigins parses CIDR notations, IPs and host names. It returns nil
+// when there are none.
+func parseOrigins(values []string) *origins {
+	if len(values) == 0 {
+		return nil
+	}
+
+	o := &origins{hosts: map[string]bool{}} //nolint:exhaustruct // networks are appended below
+
+	for _, val := range values {
+		val = strings.TrimSpace(val)
+
+		if _, network, err := net.ParseCIDR(val); err == nil {
+			o.networks = append(o.networks, network)
+			continue
+		}
+
+		o.hosts[strings.ToLower(val)] = true
+	}
+
+	return o
+}
+
+// match reports whether the client of r, the first X-Forwarded-For entry or
+// else the remote address, is one of the origins.
+func (o *origins) match(r *http.Request) bool {
+	if o == nil {
+		return false
+	}
+
+	client := clientAddr(r)
+	if o.hosts[strings.ToLower(client)] {
+		return true
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range o.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientAddr returns the address of the client that sent r, taken from
+// X-Forwarded-For when the request was proxied.
+func clientAddr(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		client, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(client)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// clientNoCache reports whether the client asked for a fresh response with
+// Cache-Control or Pragma no-cache, when RespectClientNoCache is set.
+// Requests from TrustedOrigins, such as monitoring tools sending no-cache on
+// every request, are still served from the cache.
+func (m *cache) clientNoCache(r *http.Request) bool {
+	if !m.cfg.RespectClientNoCache || m.trustedOrigins.match(r) {
+		return false
+	}
+
+	if _, ok := parseCacheControl(r.Header.Values("Cache-Control"))["no-cache"]; ok {
+		return true
+	}
+
+	_, ok := parseCacheControl(r.Header.Values("Pragma"))["no-cache"]
+
+	return ok
+}
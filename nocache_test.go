@@ -0,0 +1,73 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_TrustedOrigins(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                 createTempDir(t),
+		MaxExpiry:            10,
+		Cleanup:              20,
+		AddStatusHeader:      true,
+		RespectClientNoCache: true,
+		TrustedOrigins:       []string{"10.0.0.0/8", "monitor.internal"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		fwd        string
+		header     string
+		wantStatus string
+	}{
+		{name: "first request", remoteAddr: "192.168.1.1:1234", wantStatus: cacheMissStatus},
+		{name: "untrusted no-cache", remoteAddr: "192.168.1.1:1234", header: "Cache-Control", wantStatus: cacheMissStatus},
+		{name: "untrusted pragma", remoteAddr: "192.168.1.1:1234", header: "Pragma", wantStatus: cacheMissStatus},
+		{name: "trusted network", remoteAddr: "10.1.2.3:1234", header: "Cache-Control", wantStatus: cacheHitStatus},
+		{name: "trusted forwarded host", remoteAddr: "192.168.1.1:1234", fwd: "monitor.internal, 192.168.1.1", header: "Pragma", wantStatus: cacheHitStatus},
+		{name: "trusted forwarded ip", remoteAddr: "192.168.1.1:1234", fwd: "10.0.0.7", header: "Cache-Control", wantStatus: cacheHitStatus},
+		{name: "no directive", remoteAddr: "192.168.1.1:1234", wantStatus: cacheHitStatus},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		if test.fwd != "" {
+			req.Header.Set("X-Forwarded-For", test.fwd)
+		}
+
+		if test.header != "" {
+			req.Header.Set(test.header, "no-cache")
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.name, test.wantStatus, got)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 upstream calls, got %d", calls)
+	}
+}
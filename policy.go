@@ -0,0 +1,162 @@
+package plugin_simpleforcecache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultUnderstoodStatusCodes = []int{http.StatusOK, http.StatusMovedPermanently, http.StatusNotFound}
+
+const defaultErrorTTL = 10
+
+// IsCacheable reports whether resp would be cached by a middleware using cfg,
+// and for how long. Only 200 responses are cached, along with 4xx responses
+// when cfg.CacheErrorResponses is set and those with the must-understand
+// directive whose status is understood. Unless cfg.Force is set, the
+// Cache-Control (must-understand, no-store, no-cache, private, s-maxage,
+// max-age) and Expires headers are honored; responses without them are cached
+// for cfg.MaxExpiry, or cfg.ErrorTTL for 4xx responses. The returned TTL never
+// exceeds cfg.MaxExpiry, nor cfg.ErrorTTL for 4xx responses. With
+// cfg.PassCloudflareStatus, responses Cloudflare already caches or bypasses
+// are not cached.
+func IsCacheable(cfg *Config, resp *http.Response) (time.Duration, bool) {
+	if cfg.PassCloudflareStatus && !cloudflareCacheable(resp.Header) {
+		return 0, false
+	}
+
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+
+	// must-understand restricts caching to status codes whose semantics the
+	// cache understands, in which case no-store is ignored (RFC 9111 5.2.2.3).
+	_, mustUnderstand := cc["must-understand"]
+	mustUnderstand = mustUnderstand && !cfg.Force
+
+	if mustUnderstand {
+		if !understoodStatus(cfg, resp.StatusCode) {
+			return 0, false
+		}
+
+		delete(cc, "no-store")
+	}
+
+	errorResponse := cfg.CacheErrorResponses && resp.StatusCode >= http.StatusBadRequest && resp.StatusCode < http.StatusInternalServerError
+
+	if resp.StatusCode != http.StatusOK && !errorResponse && !mustUnderstand {
+		return 0, false
+	}
+
+	maxExpiry := time.Duration(cfg.MaxExpiry) * time.Second
+	if errorResponse {
+		maxExpiry = errorTTL(cfg)
+	}
+
+	if cfg.Force {
+		return maxExpiry, true
+	}
+
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+
+	ttl := maxExpiry
+
+	// s-maxage applies to shared caches and takes precedence over max-age.
+	maxAge, ok := cc["s-maxage"]
+	if !ok {
+		maxAge, ok = cc["max-age"]
+	}
+
+	if ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds <= 0 {
+			return 0, false
+		}
+
+		ttl = time.Duration(seconds) * time.Second
+	} else if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+
+		ttl = t.Sub(cfg.now())
+	}
+
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	if ttl > maxExpiry {
+		ttl = maxExpiry
+	}
+
+	return ttl, true
+}
+
+// errorTTL returns how long 4xx responses are cached, within cfg.MaxExpiry.
+func errorTTL(cfg *Config) time.Duration {
+	seconds := cfg.ErrorTTL
+	if seconds <= 0 {
+		seconds = defaultErrorTTL
+	}
+
+	if seconds > cfg.MaxExpiry {
+		seconds = cfg.MaxExpiry
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// understoodStatus reports whether status is listed in
+// cfg.UnderstoodStatusCodes, or in the default list when it is empty.
+func understoodStatus(cfg *Config, status int) bool {
+	codes := cfg.UnderstoodStatusCodes
+	if len(codes) == 0 {
+		codes = defaultUnderstoodStatusCodes
+	}
+
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCacheControl parses Cache-Control header values into a map of
+// lowercase directive names to their unquoted values.
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			directives[name] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+
+	return directives
+}
+
+// cloudflareCacheable reports whether the cf-cache-status header of h allows
+// caching: HIT responses are already cached by Cloudflare and BYPASS ones
+// must not be cached at all.
+func cloudflareCacheable(h http.Header) bool {
+	switch strings.ToUpper(strings.TrimSpace(h.Get("Cf-Cache-Status"))) {
+	case "HIT", "BYPASS":
+		return false
+	default:
+		return true
+	}
+}
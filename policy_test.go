@@ -0,0 +1,191 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsCacheable(t *testing.T) {
+	tests := []struct {
+		name       string
+		force      bool
+		errors     bool
+		understood []int
+		status     int
+		headers    map[string]string
+		wantTTL    time.Duration
+		wantOK     bool
+	}{
+		{
+			name:    "should cache must-understand no-store for understood status",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "must-understand, no-store, max-age=60"},
+			wantTTL: 60 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:       "should not cache must-understand for other status",
+			understood: []int{http.StatusNotFound},
+			status:     http.StatusOK,
+			headers:    map[string]string{"Cache-Control": "must-understand, max-age=60"},
+		},
+		{
+			name:    "should cache must-understand for understood non 200 status",
+			status:  http.StatusMovedPermanently,
+			headers: map[string]string{"Cache-Control": "must-understand, no-store, max-age=60"},
+			wantTTL: 60 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:       "should not cache must-understand 4xx for other status",
+			errors:     true,
+			understood: []int{http.StatusOK},
+			status:     http.StatusNotFound,
+			headers:    map[string]string{"Cache-Control": "must-understand, max-age=60"},
+		},
+		{
+			name:    "should cache 200 without headers for maxExpiry",
+			status:  http.StatusOK,
+			wantTTL: 100 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:   "should not cache non 200",
+			status: http.StatusNotFound,
+		},
+		{
+			name:    "should use max-age",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "public, max-age=60"},
+			wantTTL: 60 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should cap max-age to maxExpiry",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=600"},
+			wantTTL: 100 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should prefer s-maxage over max-age",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60, s-maxage=300"},
+			wantTTL: 100 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should use s-maxage below maxExpiry",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60, s-maxage=90"},
+			wantTTL: 90 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should ignore s-maxage when forced",
+			force:   true,
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60, s-maxage=30"},
+			wantTTL: 100 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should not cache no-store",
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "no-store"},
+		},
+		{
+			name:    "should not cache expired Expires",
+			status:  http.StatusOK,
+			headers: map[string]string{"Expires": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+		},
+		{
+			name:    "should cache 4xx for errorTTL",
+			errors:  true,
+			status:  http.StatusNotFound,
+			wantTTL: 10 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should cap errorTTL with max-age",
+			errors:  true,
+			status:  http.StatusNotFound,
+			headers: map[string]string{"Cache-Control": "max-age=1"},
+			wantTTL: time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should cap 4xx max-age to errorTTL",
+			errors:  true,
+			status:  http.StatusNotFound,
+			headers: map[string]string{"Cache-Control": "s-maxage=60"},
+			wantTTL: 10 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "should not cache 4xx no-store",
+			errors:  true,
+			status:  http.StatusNotFound,
+			headers: map[string]string{"Cache-Control": "no-store"},
+		},
+		{
+			name:    "should not cache private 4xx",
+			errors:  true,
+			status:  http.StatusNotFound,
+			headers: map[string]string{"Cache-Control": "private"},
+		},
+		{
+			name:    "should cache no-store when forced",
+			force:   true,
+			status:  http.StatusOK,
+			headers: map[string]string{"Cache-Control": "no-store"},
+			wantTTL: 100 * time.Second,
+			wantOK:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			for key, val := range test.headers {
+				resp.Header.Set(key, val)
+			}
+
+			cfg := &Config{MaxExpiry: 100, Force: test.force, UnderstoodStatusCodes: test.understood, CacheErrorResponses: test.errors}
+
+			ttl, ok := IsCacheable(cfg, resp)
+			if ok != test.wantOK || ttl != test.wantTTL {
+				t.Errorf("unexpected result: want (%s, %t), got (%s, %t)", test.wantTTL, test.wantOK, ttl, ok)
+			}
+		})
+	}
+}
+
+func TestIsCacheable_PassCloudflareStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		wantOK bool
+	}{
+		{status: "", wantOK: true},
+		{status: "HIT", wantOK: false},
+		{status: "hit", wantOK: false},
+		{status: "BYPASS", wantOK: false},
+		{status: "MISS", wantOK: true},
+		{status: "EXPIRED", wantOK: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+			if test.status != "" {
+				resp.Header.Set("Cf-Cache-Status", test.status)
+			}
+
+			if _, ok := IsCacheable(&Config{MaxExpiry: 100, PassCloudflareStatus: true}, resp); ok != test.wantOK {
+				t.Errorf("unexpected result: want %t, got %t", test.wantOK, ok)
+			}
+		})
+	}
+}
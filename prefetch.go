@@ -0,0 +1,200 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultPrefetchDepth = 1
+	// maxPrefetchLinks bounds the links followed from a single response.
+	maxPrefetchLinks = 100
+	// maxPrefetchRuns bounds the prefetches running at once across requests.
+	maxPrefetchRuns = 16
+)
+
+// htmlLinkPattern matches the href and src attributes of HTML elements.
+var htmlLinkPattern = regexp.MustCompile(`(?i)\b(?:href|src)\s*=\s*["']([^"']+)["']`)
+
+// prefetchLinks warms the cache with the same-host resources linked from a
+// stored response, following links up to PrefetchDepth levels. Links are not
+// followed while maxPrefetchRuns prefetches are running already.
+func (m *cache) prefetchLinks(r *http.Request, h http.Header, body []byte) {
+	base := &url.URL{Scheme: requestScheme(r), Host: r.Host, Path: r.URL.Path} //nolint:exhaustruct // only the base is needed
+
+	links := extractLinks(base, h.Get("Content-Type"), body)
+	if len(links) == 0 {
+		return
+	}
+
+	select {
+	case m.prefetches <- struct{}{}:
+	default:
+		return
+	}
+
+	origin := r.Clone(context.Background())
+
+	go func() {
+		defer func() { <-m.prefetches }()
+
+		m.prefetch(origin, base.String(), links)
+	}()
+}
+
+// prefetch fetches the links level by level with PrefetchConcurrency
+// workers, keeping the headers of the origin request. Links already cached
+// are not fetched again, nor followed.
+func (m *cache) prefetch(r *http.Request, origin string, links []string) {
+	depth := m.cfg.PrefetchDepth
+	if depth <= 0 {
+		depth = defaultPrefetchDepth
+	}
+
+	concurrency := m.cfg.PrefetchConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	seen := map[string]bool{origin: true}
+
+	for level := 0; level < depth && len(links) > 0; level++ {
+		var (
+			mu   sync.Mutex
+			next []string
+			wg   sync.WaitGroup
+		)
+
+		targets := make(chan string)
+
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for target := range targets {
+					found := m.prefetchURL(r, target)
+
+					mu.Lock()
+					next = append(next, found...)
+					mu.Unlock()
+				}
+			}()
+		}
+
+		for _, link := range links {
+			if !seen[link] {
+				seen[link] = true
+				targets <- link
+			}
+		}
+
+		close(targets)
+		wg.Wait()
+
+		links = next
+	}
+}
+
+// prefetchURL caches target unless it is cached already, and returns the
+// links found in its body.
+func (m *cache) prefetchURL(r *http.Request, target string) []string {
+	req, err := warmRequest(r, target)
+	if err != nil {
+		return nil
+	}
+
+	if _, err = m.cache.Get(m.key(req)); err == nil { //nolint:noinlineerr // acceptable inline error
+		return nil
+	}
+
+	rw, err := m.warm(req)
+	if err != nil {
+		log.Printf("Error prefetching %q: %v", target, err)
+		return nil
+	}
+
+	if rw == nil {
+		return nil
+	}
+
+	return extractLinks(req.URL, rw.Header().Get("Content-Type"), rw.body)
+}
+
+// extractLinks returns the absolute URLs on the host of base linked from an
+// HTML body through href and src attributes, or from a JSON body through href
+// fields.
+func extractLinks(base *url.URL, contentType string, body []byte) []string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var refs []string
+
+	switch {
+	case mediaType == "text/html":
+		for _, match := range htmlLinkPattern.FindAllSubmatch(body, -1) {
+			refs = append(refs, string(match[1]))
+		}
+	case isJSON(contentType):
+		var v any
+		if json.Unmarshal(body, &v) == nil {
+			refs = jsonHrefs(v, refs)
+		}
+	}
+
+	links := make([]string, 0, len(refs))
+	seen := map[string]bool{}
+
+	for _, ref := range refs {
+		u, err := base.Parse(ref)
+		if err != nil || u.Host != base.Host || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		u.Fragment = ""
+
+		if link := u.String(); !seen[link] && len(links) < maxPrefetchLinks {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	return links
+}
+
+// jsonHrefs appends the string values of href fields found anywhere in v.
+func jsonHrefs(v any, refs []string) []string {
+	switch val := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+
+		// Sort the keys so links are prefetched in a stable order.
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field := val[key]
+			if s, ok := field.(string); ok && key == "href" {
+				refs = append(refs, s)
+				continue
+			}
+
+			refs = jsonHrefs(field, refs)
+		}
+	case []any:
+		for _, item := range val {
+			refs = jsonHrefs(item, refs)
+		}
+	}
+
+	return refs
+}
@@ -0,0 +1,207 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtractLinks(t *testing.T) {
+	base, _ := url.Parse("http://localhost/docs/index.html")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+	}{
+		{
+			name:        "html",
+			contentType: "text/html; charset=utf-8",
+			body:        `<a href="/a">A</a><img SRC='b.png'><a href="http://other/c">C</a><a href="/a#top">A</a>`,
+			want:        []string{"http://localhost/a", "http://localhost/docs/b.png"},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"href": "/a", "items": [{"href": "http://localhost/b"}, {"name": "/c"}]}`,
+			want:        []string{"http://localhost/a", "http://localhost/b"},
+		},
+		{
+			name:        "ignored content type",
+			contentType: "text/plain",
+			body:        `href="/a"`,
+			want:        []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := extractLinks(base, test.contentType, []byte(test.body)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unexpected links: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_PrefetchLinks(t *testing.T) {
+	pages := map[string]string{
+		"/":  `<a href="/a">A</a>`,
+		"/a": `<a href="/b">B</a>`,
+		"/b": `<a href="/c">C</a>`,
+		"/c": ``,
+	}
+
+	var (
+		mu      sync.Mutex
+		fetched = map[string]int{}
+	)
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(pages[r.URL.Path]))
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		PrefetchLinks:       true,
+		PrefetchDepth:       2,
+		PrefetchConcurrency: 2,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, errA := c.cache.Get("GETlocalhost/a")
+		_, errB := c.cache.Get("GETlocalhost/b")
+
+		if errA == nil && errB == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the linked pages to be prefetched")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give a wrongly followed third level the time to show up.
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := map[string]int{"/": 1, "/a": 1, "/b": 1}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("unexpected upstream fetches: want %v, got %v", want, fetched)
+	}
+}
+
+func TestCache_PrefetchLinksHeaders(t *testing.T) {
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+
+		if r.URL.Path == "/" {
+			_, _ = rw.Write([]byte(`<a href="/a">A</a>`))
+		}
+	}
+
+	cfg := &Config{
+		Path:          createTempDir(t),
+		MaxExpiry:     10,
+		Cleanup:       20,
+		CacheHeaders:  []string{"Accept-Language"},
+		PrefetchLinks: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("Accept-Language", "fr")
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	linked := httptest.NewRequest(http.MethodGet, "http://localhost/a", nil)
+	linked.Header.Set("Accept-Language", "fr")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = c.cache.Get(c.key(linked)); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the linked page to be prefetched with the request headers")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCache_PrefetchLinksLimit(t *testing.T) {
+	var fetched atomic.Int32
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(`<a href="/a">A</a>`))
+	}
+
+	cfg := &Config{
+		Path:          createTempDir(t),
+		MaxExpiry:     10,
+		Cleanup:       20,
+		PrefetchLinks: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	// Take every slot, as if that many prefetches were running.
+	for i := 0; i < maxPrefetchRuns; i++ {
+		c.prefetches <- struct{}{}
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+
+	// Give a wrongly started prefetch the time to show up.
+	time.Sleep(50 * time.Millisecond)
+
+	if got := fetched.Load(); got != 1 {
+		t.Errorf("expected no prefetch while the limit is reached, got %d upstream fetches", got)
+	}
+}
@@ -0,0 +1,137 @@
+package plugin_simpleforcecache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// redisCommandTimeout bounds commands sent with DoTimeout.
+	redisCommandTimeout = 5 * time.Second
+)
+
+// redisConn is a minimal client for the Redis serialization protocol (RESP),
+// covering the few commands the cache needs without external dependencies.
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func dialRedis(addr string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %w", err)
+	}
+
+	return &redisConn{conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Do sends a command and returns its reply.
+func (c *redisConn) Do(args ...string) (any, error) {
+	if err := c.Send(args...); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	return c.Receive()
+}
+
+// DoTimeout sends a command and returns its reply, failing if the exchange
+// takes longer than timeout.
+func (c *redisConn) DoTimeout(timeout time.Duration, args ...string) (any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, fmt.Errorf("error setting redis deadline: %w", err)
+	}
+
+	defer func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}()
+
+	return c.Do(args...)
+}
+
+// Send writes a command without waiting for its reply.
+func (c *redisConn) Send(args ...string) error {
+	var b strings.Builder
+
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil { //nolint:noinlineerr // acceptable inline error
+		return fmt.Errorf("error writing redis command: %w", err)
+	}
+
+	return nil
+}
+
+// Receive reads the next reply. Strings are returned as string, integers as
+// int64, arrays as []any and nil replies as nil.
+func (c *redisConn) Receive() (any, error) {
+	return readRedisReply(c.rd)
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+func readRedisReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading redis reply: %w", err)
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err //nolint:nilnil // nil bulk string
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil { //nolint:noinlineerr // acceptable inline error
+			return nil, fmt.Errorf("error reading redis reply: %w", err)
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err //nolint:nilnil // nil array
+		}
+
+		vals := make([]any, 0, n)
+
+		for i := 0; i < n; i++ {
+			val, err := readRedisReply(rd)
+			if err != nil {
+				return nil, err
+			}
+
+			vals = append(vals, val)
+		}
+
+		return vals, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
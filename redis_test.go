@@ -0,0 +1,181 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a tiny in-process Redis server supporting the commands used by
+// the cache.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	subs  map[string][]net.Conn
+	lists map[string][]string
+}
+
+func newFakeRedis(tb testing.TB) *fakeRedis {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	fr := &fakeRedis{ln: ln, subs: map[string][]net.Conn{}, lists: map[string][]string{}}
+
+	go fr.serve()
+
+	tb.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+
+		args, _ := reply.([]any)
+		if len(args) == 0 {
+			return
+		}
+
+		cmd, _ := args[0].(string)
+
+		switch strings.ToUpper(cmd) {
+		case "SUBSCRIBE":
+			for i, arg := range args[1:] {
+				channel, _ := arg.(string)
+
+				fr.mu.Lock()
+				fr.subs[channel] = append(fr.subs[channel], conn)
+				fr.mu.Unlock()
+
+				_, _ = conn.Write([]byte("*3\r\n" + redisBulk("subscribe") + redisBulk(channel) + ":" + strconv.Itoa(i+1) + "\r\n"))
+			}
+		case "PUBLISH":
+			channel, _ := args[1].(string)
+			payload, _ := args[2].(string)
+
+			fr.mu.Lock()
+			subs := fr.subs[channel]
+			fr.mu.Unlock()
+
+			for _, sub := range subs {
+				_, _ = sub.Write([]byte("*3\r\n" + redisBulk("message") + redisBulk(channel) + redisBulk(payload)))
+			}
+
+			_, _ = conn.Write([]byte(":" + strconv.Itoa(len(subs)) + "\r\n"))
+		case "LRANGE":
+			key, _ := args[1].(string)
+
+			fr.mu.Lock()
+			list := fr.lists[key]
+			fr.mu.Unlock()
+
+			reply := "*" + strconv.Itoa(len(list)) + "\r\n"
+			for _, val := range list {
+				reply += redisBulk(val)
+			}
+
+			_, _ = conn.Write([]byte(reply))
+		case "DEL":
+			key, _ := args[1].(string)
+
+			fr.mu.Lock()
+			_, ok := fr.lists[key]
+			delete(fr.lists, key)
+			fr.mu.Unlock()
+
+			n := 0
+			if ok {
+				n = 1
+			}
+
+			_, _ = conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		default:
+			_, _ = conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func (fr *fakeRedis) setList(key string, vals ...string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	fr.lists[key] = vals
+}
+
+func (fr *fakeRedis) hasList(key string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	_, ok := fr.lists[key]
+
+	return ok
+}
+
+func (fr *fakeRedis) subscribers(channel string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return len(fr.subs[channel])
+}
+
+func redisBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func TestRedisConn(t *testing.T) {
+	fr := newFakeRedis(t)
+
+	conn, err := dialRedis(fr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	reply, err := conn.Do("PUBLISH", "channel", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, ok := reply.(int64); !ok || n != 0 {
+		t.Errorf("unexpected reply: want 0, got %v", reply)
+	}
+
+	if _, err = conn.Do("UNKNOWN"); err == nil {
+		t.Error("expected error reply")
+	}
+}
@@ -0,0 +1,55 @@
+package plugin_simpleforcecache
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// revalidationETag returns the ETag to revalidate cached with, if any.
+func (m *cache) revalidationETag(cached *cacheData) string {
+	if !m.cfg.ConditionalRevalidate || cached == nil {
+		return ""
+	}
+
+	return http.Header(cached.Headers).Get("ETag")
+}
+
+// conditionalRequest returns a copy of r asking the upstream to only send the
+// response if it no longer matches etag.
+func conditionalRequest(r *http.Request, etag string) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Set("If-None-Match", etag)
+
+	return req
+}
+
+// revalidationRetention returns how long an entry with headers h is kept in
+// storage past its expiry so it can be revalidated with its ETag.
+func (m *cache) revalidationRetention(h map[string][]string) time.Duration {
+	if !m.cfg.ConditionalRevalidate || http.Header(h).Get("ETag") == "" {
+		return 0
+	}
+
+	return time.Duration(m.cfg.MaxExpiry) * time.Second
+}
+
+// refresh extends the expiry of the entry stored under key for r by its max
+// expiry after the upstream confirmed it is unchanged.
+func (m *cache) refresh(r *http.Request, key string, cached *cacheData) {
+	maxExpiry := m.maxExpiry(r)
+
+	// marshalEntry modifies the entry, which is still served afterwards.
+	data := *cached
+	data.Expires = m.cfg.now().Add(maxExpiry).Unix()
+
+	entry, err := m.marshalEntry(&data)
+	if err != nil {
+		log.Printf("Error serializing cache item: %v", err)
+		return
+	}
+
+	expiry := maxExpiry + time.Duration(m.cfg.StaleTolerance)*time.Second + m.revalidationRetention(data.Headers)
+
+	m.queueWrite(cacheWriteJob{key: key, entry: entry, expiry: expiry, priority: writePriorityHigh})
+}
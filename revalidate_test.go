@@ -0,0 +1,84 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCache_ConditionalRevalidate(t *testing.T) {
+	clock := newManualClock(time.Now())
+
+	etag := `"v1"`
+	fullResponses := 0
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("ETag", etag)
+
+		if r.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		fullResponses++
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body " + etag))
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		AddStatusHeader:       true,
+		ConditionalRevalidate: true,
+		Clock:                 clock.Now,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		return rec
+	}
+
+	get()
+	clock.Advance(11 * time.Second)
+
+	rec := get()
+	if got := rec.Header().Get("Cache-Status"); got != cacheRevalidatedStatus {
+		t.Errorf("expected the expired entry to be revalidated, got status %q", got)
+	}
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `body "v1"` {
+		t.Errorf("expected the cached response, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if got := get().Header().Get("Cache-Status"); got != cacheHitStatus {
+		t.Errorf("expected the revalidated entry to be extended, got status %q", got)
+	}
+
+	etag = `"v2"`
+
+	clock.Advance(11 * time.Second)
+
+	if rec := get(); rec.Body.String() != `body "v2"` {
+		t.Errorf("expected the changed response, got %q", rec.Body.String())
+	}
+
+	if got := get().Header().Get("Cache-Status"); got != cacheHitStatus {
+		t.Errorf("expected the changed response to replace the entry, got status %q", got)
+	}
+
+	if fullResponses != 2 {
+		t.Errorf("expected 2 full upstream responses, got %d", fullResponses)
+	}
+}
@@ -0,0 +1,179 @@
+package plugin_simpleforcecache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// sendfileThreshold is the body size from which raw bodies are copied from
+// their file instead of being read in memory.
+const sendfileThreshold = 64 << 10
+
+var errNoEntryFile = errors.New("entry not stored in a file")
+
+// fileStorage is implemented by storages keeping each entry in a file.
+type fileStorage interface {
+	// open returns the file of the entry stored under key, positioned after
+	// its expiry.
+	open(key string) (*os.File, error)
+}
+
+// openEntryFile opens the file of the entry stored under key in st. It
+// returns errNoEntryFile when st doesn't keep entries in files.
+func openEntryFile(st storage, key string) (*os.File, error) {
+	if fs, ok := st.(fileStorage); ok {
+		return fs.open(key)
+	}
+
+	return nil, errNoEntryFile
+}
+
+// useSendfile reports whether raw bodies are sent from their file, which net/http
+// turns into a sendfile(2) call. Reads bounded by CacheReadTimeout are kept in
+// memory.
+func (m *cache) useSendfile() bool {
+	return m.cfg.UseSendfile && m.cfg.BodyStorageEncoding == bodyStorageNone && m.cfg.CacheReadTimeout <= 0
+}
+
+// readEntry reads the entry stored under key into data and reports whether
+// there was one. Large raw bodies are left in their file, see useSendfile.
+func (m *cache) readEntry(key string, data *cacheData) (bool, error) {
+	if m.useSendfile() {
+		f, err := openEntryFile(m.cache, key)
+
+		switch {
+		case err == nil:
+			return true, m.readEntryFile(f, data)
+		case !errors.Is(err, errNoEntryFile):
+			return false, nil
+		}
+	}
+
+	b, err := m.get(key)
+	if err != nil {
+		return false, nil //nolint:nilerr // read errors are misses
+	}
+
+	return true, m.unmarshalEntry(b, data)
+}
+
+// readEntryFile reads the metadata of the entry in f. A large raw body is
+// left in f for serveCached to copy, any other body is read in memory.
+func (m *cache) readEntryFile(f *os.File, data *cacheData) error {
+	prefix, meta, bodySize, err := readFileMeta(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := json.Unmarshal(meta, data); err != nil { //nolint:noinlineerr // acceptable inline error
+		_ = f.Close()
+		return err
+	}
+
+	if !data.BodyRaw || data.Compressed || data.Canonical != "" || bodySize < sendfileThreshold {
+		raw, err := io.ReadAll(f)
+		_ = f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading entry file: %w", err)
+		}
+
+		return m.unmarshalEntry(append(append(prefix, meta...), raw...), data)
+	}
+
+	data.BodyRaw = false
+	data.bodyFile = f
+	data.bodySize = bodySize
+
+	return nil
+}
+
+// readFileMeta reads the metadata length prefix and the metadata of the entry
+// in f, leaving f at the start of the body, and returns the body size.
+func readFileMeta(f *os.File) ([]byte, []byte, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error reading entry file: %w", err)
+	}
+
+	size := info.Size() - expirySize
+
+	prefix := make([]byte, entryMetaLenSize)
+	if _, err := io.ReadFull(f, prefix); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, nil, 0, errInvalidEntry
+	}
+
+	n := int64(binary.BigEndian.Uint32(prefix))
+	if n > size-entryMetaLenSize {
+		return nil, nil, 0, errInvalidEntry
+	}
+
+	meta := make([]byte, n)
+	if _, err := io.ReadFull(f, meta); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, nil, 0, errInvalidEntry
+	}
+
+	return prefix, meta, size - entryMetaLenSize - n, nil
+}
+
+// loadBody reads a body left in its file by readEntry.
+func (d *cacheData) loadBody() error {
+	if d.bodyFile == nil {
+		return nil
+	}
+
+	defer d.closeBody()
+
+	body, err := io.ReadAll(d.bodyFile)
+	if err != nil {
+		return fmt.Errorf("error reading entry body: %w", err)
+	}
+
+	d.Body = body
+
+	return nil
+}
+
+// withBody returns d with its body read in memory, or nil if it can't be
+// read, for entries used after the lookup.
+func (d *cacheData) withBody() *cacheData {
+	if err := d.loadBody(); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error reading cache entry: %v", err)
+		return nil
+	}
+
+	return d
+}
+
+// closeBody closes the file of a body left in it by readEntry.
+func (d *cacheData) closeBody() {
+	if d.bodyFile != nil {
+		_ = d.bodyFile.Close()
+		d.bodyFile = nil
+	}
+}
+
+// copyBody writes the body left in its file by readEntry to w, letting
+// net/http send it with sendfile(2), and returns the number of bytes written.
+func copyBody(w http.ResponseWriter, data *cacheData) int64 {
+	n, err := io.Copy(w, data.bodyFile)
+	if err != nil {
+		log.Printf("Error sending cache entry body: %v", err)
+	}
+
+	return n
+}
+
+// setBodyLength sets the Content-Length of a body left in its file, without
+// which net/http chunks the response instead of using sendfile(2).
+func setBodyLength(h http.Header, data *cacheData) {
+	h.Set("Content-Length", strconv.FormatInt(data.bodySize, 10))
+}
@@ -0,0 +1,113 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newSendfileTestCache(tb testing.TB, body []byte, sendfile bool) http.Handler {
+	tb.Helper()
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(body)
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(tb),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		BodyStorageEncoding: bodyStorageNone,
+		UseSendfile:         sendfile,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	return h
+}
+
+func TestCache_Sendfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		sendfile bool
+		wantFile bool
+	}{
+		{name: "large body", size: 1 << 20, sendfile: true, wantFile: true},
+		{name: "small body", size: 1024, sendfile: true, wantFile: false},
+		{name: "disabled", size: 1 << 20, sendfile: false, wantFile: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("a"), test.size)
+			h := newSendfileTestCache(t, body, test.sendfile)
+			c := h.(*cache)
+
+			var data cacheData
+
+			found, err := c.readEntry("GETlocalhost/test", &data)
+			if !found || err != nil {
+				t.Fatalf("expected the entry to be read, got %v", err)
+			}
+
+			if got := data.bodyFile != nil; got != test.wantFile {
+				t.Errorf("unexpected body left in its file: want %t, got %t", test.wantFile, got)
+			}
+
+			data.closeBody()
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+			if state := rec.Header().Get("Cache-Status"); state != cacheHitStatus {
+				t.Errorf("unexpected cache state: want %q, got %q", cacheHitStatus, state)
+			}
+
+			if !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("unexpected body of %d bytes, want %d", rec.Body.Len(), len(body))
+			}
+
+			if test.wantFile && rec.Header().Get("Content-Length") != strconv.Itoa(test.size) {
+				t.Errorf("unexpected Content-Length: want %d, got %q", test.size, rec.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func BenchmarkCache_Sendfile(b *testing.B) {
+	for _, size := range []int{1 << 20, 10 << 20, 100 << 20} {
+		for _, sendfile := range []bool{false, true} {
+			b.Run(strconv.Itoa(size>>20)+"MB/sendfile="+strconv.FormatBool(sendfile), func(b *testing.B) {
+				srv := httptest.NewServer(newSendfileTestCache(b, bytes.Repeat([]byte("a"), size), sendfile))
+				defer srv.Close()
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					resp, err := http.Get(srv.URL + "/test") //nolint:noctx // benchmark requests don't need a context
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// serveShadow forwards a request to a shadow cached path and stores the
+// response in the background. Shadow paths are never served from the cache.
+func (m *cache) serveShadow(w http.ResponseWriter, r *http.Request) requestOutcome {
+	m.setCacheStatus(w.Header(), cacheBypassStatus)
+
+	rw := &responseWriter{ResponseWriter: w} //nolint:exhaustruct // zero values are intentional
+
+	start := time.Now()
+	m.next.ServeHTTP(rw, r)
+	computeDuration := time.Since(start)
+
+	// The client's response and request can't be used once this returns.
+	captured := &responseWriter{ //nolint:exhaustruct // only the response is needed
+		ResponseWriter: &discardWriter{header: rw.Header().Clone()},
+		status:         rw.status,
+		body:           rw.body,
+	}
+	req := r.Clone(context.Background())
+
+	go m.store(m.key(req), req, captured, computeDuration, writePriorityLow)
+
+	return requestOutcome{status: cacheBypassStatus, key: "", upstream: computeDuration}
+}
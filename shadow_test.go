@@ -0,0 +1,81 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_ShadowCachePrefixes(t *testing.T) {
+	var callCount atomic.Int64
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount.Add(1)
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("shadow"))
+	}
+
+	cfg := &Config{
+		Path:                createTempDir(t),
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		CachePathPrefixes:   []string{"/cached"},
+		ShadowCachePrefixes: []string{"/shadow"},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/shadow", nil))
+
+		return rec
+	}
+
+	if rec := serve(); rec.Body.String() != "shadow" || rec.Header().Get("Cache-Status") != cacheBypassStatus {
+		t.Fatalf("expected the upstream response, got %q with status %q", rec.Body.String(), rec.Header().Get("Cache-Status"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		if _, err := c.cache.Get("GETlocalhost/shadow"); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the shadow response to be stored")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rec := serve(); rec.Header().Get("Cache-Status") != cacheBypassStatus {
+		t.Errorf("expected shadow paths never to be served from the cache, got status %q", rec.Header().Get("Cache-Status"))
+	}
+
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("expected every shadow request to reach the upstream, got %d calls", got)
+	}
+
+	// Wait for the second response to be stored before the cache directory
+	// is removed.
+	for c.Stats().Stores < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the second shadow response to be stored")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
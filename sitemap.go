@@ -0,0 +1,94 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSitemapDepth bounds how deeply sitemap indexes are followed.
+const maxSitemapDepth = 5
+
+// sitemap holds both sitemaps (urlset) and sitemap indexes (sitemapindex).
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// warmSitemap warms the cache with every URL listed in the sitemap at
+// sitemapURL, following sitemap indexes.
+func (m *cache) warmSitemap(sitemapURL string) {
+	urls := m.collectSitemap(sitemapURL, map[string]bool{}, 0)
+
+	log.Printf("Warming %d URLs from sitemap %q", len(urls), sitemapURL)
+
+	m.warmURLs(urls)
+
+	log.Printf("Finished warming sitemap %q", sitemapURL)
+}
+
+// collectSitemap returns the page URLs listed in the sitemap at sitemapURL
+// and in the sitemaps it indexes. seen guards against index cycles.
+func (m *cache) collectSitemap(sitemapURL string, seen map[string]bool, depth int) []string {
+	if seen[sitemapURL] || depth > maxSitemapDepth {
+		return nil
+	}
+
+	seen[sitemapURL] = true
+
+	sm, err := fetchSitemap(sitemapURL)
+	if err != nil {
+		log.Printf("Error fetching sitemap %q: %v", sitemapURL, err)
+		return nil
+	}
+
+	urls := make([]string, 0, len(sm.URLs))
+	for _, u := range sm.URLs {
+		urls = append(urls, strings.TrimSpace(u.Loc))
+	}
+
+	for _, nested := range sm.Sitemaps {
+		urls = append(urls, m.collectSitemap(strings.TrimSpace(nested.Loc), seen, depth+1)...)
+	}
+
+	return urls
+}
+
+func fetchSitemap(sitemapURL string) (*sitemap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var sm sitemap
+
+	if err = xml.NewDecoder(resp.Body).Decode(&sm); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	return &sm, nil
+}
@@ -0,0 +1,273 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_SitemapWarm(t *testing.T) {
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			_, _ = rw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>` + srv.URL + `/pages.xml</loc></sitemap>
+  <sitemap><loc>` + srv.URL + `/sitemap.xml</loc></sitemap>
+</sitemapindex>`))
+		case "/pages.xml":
+			_, _ = rw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://example.com/a</loc></url>
+  <url><loc> http://example.com/b </loc></url>
+</urlset>`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                   createTempDir(t),
+		MaxExpiry:              10,
+		Cleanup:                20,
+		SitemapURL:             srv.URL + "/sitemap.xml",
+		SitemapWarmConcurrency: 2,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	for _, key := range []string{"GETexample.com/a", "GETexample.com/b"} {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			if _, err := c.cache.Get(key); err == nil {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q to be warmed from the sitemap", key)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestCache_SitemapWarmupDone(t *testing.T) {
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sitemap.xml" {
+			_, _ = rw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://example.com/a</loc></url>
+  <url><loc>http://example.com/b</loc></url>
+</urlset>`))
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:       createTempDir(t),
+		MaxExpiry:  10,
+		Cleanup:    20,
+		SitemapURL: srv.URL + "/sitemap.xml",
+		WarmupDone: make(chan struct{}),
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cfg.WarmupDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected WarmupDone to be closed")
+	}
+
+	c := h.(*cache)
+
+	for _, key := range []string{"GETexample.com/a", "GETexample.com/b"} {
+		if _, err := c.cache.Get(key); err != nil {
+			t.Errorf("expected %q to be warmed before WarmupDone was closed: %v", key, err)
+		}
+	}
+}
+
+func TestCache_WarmupRedisList(t *testing.T) {
+	fr := newFakeRedis(t)
+	fr.setList("warmup", "http://example.com/a", "http://example.com/b")
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:               createTempDir(t),
+		MaxExpiry:          10,
+		Cleanup:            20,
+		WarmupRedisAddr:    fr.Addr(),
+		WarmupRedisListKey: "warmup",
+		ClearWarmupList:    true,
+		WarmupDone:         make(chan struct{}),
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cfg.WarmupDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected WarmupDone to be closed")
+	}
+
+	c := h.(*cache)
+
+	for _, key := range []string{"GETexample.com/a", "GETexample.com/b"} {
+		if _, err := c.cache.Get(key); err != nil {
+			t.Errorf("expected %q to be warmed from the redis list: %v", key, err)
+		}
+	}
+
+	if fr.hasList("warmup") {
+		t.Error("expected the warmup list to be cleared")
+	}
+}
+
+func TestCache_WarmupDoneWithoutWarmup(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		if disabled {
+			t.Setenv(disableEnv, "1")
+		}
+
+		cfg := &Config{
+			Path:       createTempDir(t),
+			MaxExpiry:  10,
+			Cleanup:    20,
+			WarmupDone: make(chan struct{}),
+		}
+
+		if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "simplecache"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-cfg.WarmupDone:
+		default:
+			t.Errorf("expected WarmupDone to be closed without anything to warm, disabled %t", disabled)
+		}
+	}
+}
+
+func TestCache_WarmConcurrency(t *testing.T) {
+	var active, peak, calls atomic.Int64
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+
+		n := active.Add(1)
+		defer active.Add(-1)
+
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		WarmConcurrency: 3,
+		WarmRateLimit:   1000,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := make([]string, 0, 12)
+	for i := 0; i < 12; i++ {
+		urls = append(urls, "http://example.com/"+strconv.Itoa(i))
+	}
+
+	h.(*cache).warmURLs(urls)
+
+	if got := calls.Load(); got != 12 {
+		t.Errorf("expected every URL to be warmed, got %d calls", got)
+	}
+
+	if got := peak.Load(); got > 3 {
+		t.Errorf("expected at most 3 concurrent requests, got %d", got)
+	}
+
+	if got := peak.Load(); got < 2 {
+		t.Errorf("expected URLs to be warmed concurrently, got %d concurrent requests", got)
+	}
+}
+
+func TestCache_WarmRateLimit(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		WarmConcurrency: 4,
+		WarmRateLimit:   50,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		urls = append(urls, "http://example.com/"+strconv.Itoa(i))
+	}
+
+	start := time.Now()
+
+	h.(*cache).warmURLs(urls)
+
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected 10 requests at 50 per second to take at least 180ms, took %s", elapsed)
+	}
+}
@@ -0,0 +1,140 @@
+package plugin_simpleforcecache
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats is a snapshot of the cache usage counters.
+type CacheStats struct {
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Bypasses int64 `json:"bypasses"`
+	Errors   int64 `json:"errors"`
+	Stores   int64 `json:"stores"`
+
+	// DownstreamBytes is the number of body bytes written to clients for
+	// cache hits and misses, which excludes bypassed requests.
+	DownstreamBytes int64 `json:"downstreamBytes"`
+
+	// StoredBytes is the running count of bytes in storage, incremented on
+	// writes and decremented on deletion and expiry.
+	StoredBytes int64 `json:"storedBytes"`
+
+	// BodySizeHistogram counts the same entries by stored size: bucket i
+	// holds entries under 1KB*10^i, up to 100GB, and the last bucket the
+	// larger ones.
+	BodySizeHistogram [sizeBuckets]int64 `json:"bodySizeHistogram"`
+
+	// MissByStatusCode counts the upstream responses to cache misses by
+	// status code, whether they were stored or not.
+	MissByStatusCode map[int]int64 `json:"missByStatusCode"`
+}
+
+// sizeBuckets is the number of buckets of the entry size histogram.
+const sizeBuckets = 10
+
+// sizeHistogram counts entries by size, in buckets growing tenfold from 1KB.
+type sizeHistogram [sizeBuckets]atomic.Int64
+
+// add adds delta to the bucket of entries of size bytes.
+func (h *sizeHistogram) add(size, delta int64) {
+	limit := int64(1024)
+
+	for i := 0; i < sizeBuckets-1; i++ {
+		if size < limit {
+			h[i].Add(delta)
+			return
+		}
+
+		limit *= 10
+	}
+
+	h[sizeBuckets-1].Add(delta)
+}
+
+func (h *sizeHistogram) snapshot() [sizeBuckets]int64 {
+	var counts [sizeBuckets]int64
+
+	for i := range h {
+		counts[i] = h[i].Load()
+	}
+
+	return counts
+}
+
+type cacheStats struct {
+	hits            atomic.Int64
+	misses          atomic.Int64
+	bypasses        atomic.Int64
+	errors          atomic.Int64
+	stores          atomic.Int64
+	downstreamBytes atomic.Int64
+
+	mu           sync.Mutex
+	missByStatus map[int]int64
+}
+
+// record counts a served request.
+func (s *cacheStats) record(out requestOutcome) {
+	switch out.status {
+	case cacheHitStatus, cacheStaleStatus, cacheRevalidatedStatus:
+		s.hits.Add(1)
+	case cacheMissStatus:
+		s.misses.Add(1)
+	case cacheBypassStatus, cacheSampledStatus, cacheUpgradeStatus:
+		s.bypasses.Add(1)
+	case cacheErrorStatus:
+		s.errors.Add(1)
+	}
+}
+
+// recordMiss counts the status code of the upstream response to a miss.
+func (s *cacheStats) recordMiss(status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.missByStatus == nil {
+		s.missByStatus = map[int]int64{}
+	}
+
+	s.missByStatus[status]++
+}
+
+func (s *cacheStats) snapshot() CacheStats {
+	s.mu.Lock()
+
+	missByStatus := make(map[int]int64, len(s.missByStatus))
+	for status, n := range s.missByStatus {
+		missByStatus[status] = n
+	}
+
+	s.mu.Unlock()
+
+	return CacheStats{
+		Hits:            s.hits.Load(),
+		Misses:          s.misses.Load(),
+		Bypasses:        s.bypasses.Load(),
+		Errors:          s.errors.Load(),
+		Stores:          s.stores.Load(),
+		DownstreamBytes: s.downstreamBytes.Load(),
+		StoredBytes:     0,
+
+		BodySizeHistogram: [sizeBuckets]int64{},
+		MissByStatusCode:  missByStatus,
+	}
+}
+
+// Stats returns the usage counters of the cache.
+func (m *cache) Stats() CacheStats {
+	stats := m.stats.snapshot()
+	stats.StoredBytes = getStoredBytes(m.cache)
+	stats.BodySizeHistogram = getSizeHistogram(m.cache)
+
+	return stats
+}
@@ -0,0 +1,233 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache_Stats(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{
+		Path:              dir,
+		MaxExpiry:         10,
+		Cleanup:           20,
+		CachePathPrefixes: []string{"/cached"},
+		AdminAPI:          true,
+		AdminToken:        "secret",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/cached", "/cached", "/other"} {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+target, nil))
+	}
+
+	diskBytes, err := c.(*cache).cache.(*fileCache).TotalStoredBytes()
+	if err != nil || diskBytes == 0 {
+		t.Fatalf("unexpected bytes on disk: %d, %v", diskBytes, err)
+	}
+
+	want := CacheStats{
+		Hits:              1,
+		Misses:            1,
+		Bypasses:          1,
+		Stores:            1,
+		DownstreamBytes:   10,
+		StoredBytes:       diskBytes,
+		BodySizeHistogram: [sizeBuckets]int64{1},
+		MissByStatusCode:  map[int]int64{http.StatusOK: 1},
+	}
+
+	if stats := c.(*cache).Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("unexpected stats: want %+v, got %+v", want, stats)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, adminRequest(http.MethodGet, adminStatsPath, nil))
+
+	var stats adminStats
+	if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(stats.CacheStats, want) || stats.DiskBytes != diskBytes {
+		t.Errorf("unexpected admin stats: want %+v and %d bytes on disk, got %+v", want, diskBytes, stats)
+	}
+}
+
+func TestCache_MissByStatusCode(t *testing.T) {
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		case "/broken":
+			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			rw.WriteHeader(http.StatusOK)
+		}
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/ok", "/ok", "/missing", "/missing", "/broken"} {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+target, nil))
+	}
+
+	want := map[int]int64{http.StatusOK: 1, http.StatusNotFound: 2, http.StatusInternalServerError: 1}
+	if got := c.(*cache).Stats().MissByStatusCode; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected misses by status code: want %v, got %v", want, got)
+	}
+}
+
+func TestFileCache_StoredBytes(t *testing.T) {
+	fc, err := newFileCache(createTempDir(t), time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	for _, val := range []string{"first", "second value", "third"} {
+		if err = fc.Set(testCacheKey, strings.NewReader(val), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = fc.Set("other", strings.NewReader("other"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := fc.TotalStoredBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each entry holds an expiry timestamp and its value.
+	if want := int64(2 * (8 + 5)); total != want || fc.storedByteCount() != want {
+		t.Errorf("unexpected stored bytes: want %d, got %d on disk and %d counted", want, total, fc.storedByteCount())
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fc.storedByteCount(); got != 8+5 {
+		t.Errorf("unexpected stored bytes after delete: %d", got)
+	}
+
+	if got := fc.sizeHistogram(); got != [sizeBuckets]int64{1} {
+		t.Errorf("unexpected size histogram after delete: %v", got)
+	}
+}
+
+func TestFileCache_StoredBytesAfterRestart(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	if err = fc.Set(testCacheKey, strings.NewReader("first"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	fc, err = newFileCache(dir, time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	if got := fc.storedByteCount(); got != 8+5 {
+		t.Errorf("unexpected stored bytes after restart: %d", got)
+	}
+
+	if err = fc.Set(testCacheKey, strings.NewReader("second"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fc.storedByteCount(); got != 0 {
+		t.Errorf("unexpected stored bytes after replace and delete: %d", got)
+	}
+
+	if got := fc.sizeHistogram(); got != [sizeBuckets]int64{} {
+		t.Errorf("unexpected size histogram after replace and delete: %v", got)
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	var h sizeHistogram
+
+	for _, size := range []int64{0, 1023, 1024, 10 * 1024, 200 * 1024, 1 << 50} {
+		h.add(size, 1)
+	}
+
+	h.add(0, -1)
+
+	if want, got := [sizeBuckets]int64{1, 1, 1, 1, 0, 0, 0, 0, 0, 1}, h.snapshot(); got != want {
+		t.Errorf("unexpected size histogram: want %v, got %v", want, got)
+	}
+}
+
+func TestCache_Expvars(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	// A second instance with the same name, as after a configuration reload,
+	// takes over the published variables.
+	for i := 0; i < 2; i++ {
+		cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20}
+
+		c, err := New(context.Background(), http.HandlerFunc(next), cfg, "expvartest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 2; j++ {
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+		}
+	}
+
+	for name, want := range map[string]string{"hits": "1", "misses": "1", "stores": "1", "entries": "1", "hitRatio": "0.5"} {
+		v := expvar.Get("simplecache.expvartest." + name)
+		if v == nil {
+			t.Errorf("expected %s to be published", name)
+			continue
+		}
+
+		if got := v.String(); got != want {
+			t.Errorf("unexpected %s: want %s, got %s", name, want, got)
+		}
+	}
+}
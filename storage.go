@@ -0,0 +1,778 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVirtualNodes      = 100
+	defaultPromoteMemorySize = 1000
+	maxTrackedHitKeys        = 100000
+
+	defaultWriteBatchFlushInterval = 100
+
+	// replicaQueueSize bounds the replica writes waiting for the worker.
+	replicaQueueSize = 1024
+)
+
+// storage is implemented by cache backends.
+type storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val io.Reader, expiry time.Duration) error
+	Delete(key string) error
+}
+
+// expiryStorage is implemented by storages that can report when an entry
+// expires.
+type expiryStorage interface {
+	GetExpiry(key string) ([]byte, time.Time, error)
+}
+
+// getExpiry reads key from st along with its expiry, which is zero when st
+// cannot report it.
+func getExpiry(st storage, key string) ([]byte, time.Time, error) {
+	if es, ok := st.(expiryStorage); ok {
+		return es.GetExpiry(key)
+	}
+
+	b, err := st.Get(key)
+
+	return b, time.Time{}, err
+}
+
+// storageUsage describes how much a storage holds.
+type storageUsage struct {
+	Entries   int64
+	Bytes     int64
+	Evictions int64
+	// StoredBytes is the running count of stored bytes, which Bytes measures
+	// on disk.
+	StoredBytes int64
+}
+
+// usageStorage is implemented by storages that can report their usage.
+type usageStorage interface {
+	usage() storageUsage
+}
+
+// getUsage returns the usage of st, which is zero when st cannot report it.
+func getUsage(st storage) storageUsage {
+	if us, ok := st.(usageStorage); ok {
+		return us.usage()
+	}
+
+	return storageUsage{Entries: 0, Bytes: 0, Evictions: 0, StoredBytes: 0}
+}
+
+// storedBytesStorage is implemented by storages that keep a running count of
+// the bytes they store.
+type storedBytesStorage interface {
+	storedByteCount() int64
+}
+
+// getStoredBytes returns the running count of bytes stored in st, which is
+// zero when st doesn't keep one. Unlike getUsage, it doesn't walk the disk.
+func getStoredBytes(st storage) int64 {
+	if sb, ok := st.(storedBytesStorage); ok {
+		return sb.storedByteCount()
+	}
+
+	return 0
+}
+
+// sizeHistogramStorage is implemented by storages that count the entries
+// they store by size.
+type sizeHistogramStorage interface {
+	sizeHistogram() [sizeBuckets]int64
+}
+
+// getSizeHistogram returns the entries stored in st counted by size, which
+// is empty when st doesn't count them.
+func getSizeHistogram(st storage) [sizeBuckets]int64 {
+	if sh, ok := st.(sizeHistogramStorage); ok {
+		return sh.sizeHistogram()
+	}
+
+	return [sizeBuckets]int64{}
+}
+
+// newStorage creates the cache backend described by the configuration.
+func newStorage(cfg *Config) (storage, error) {
+	st, err := newDiskStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ReplicaPath != "" {
+		replica, err := newFileCache(cfg.ReplicaPath, time.Duration(cfg.Cleanup)*time.Second, cfg.lockTimeout(), cfg.globalMaxAge(), cfg.CleanupWorkers, cfg.clock())
+		if err != nil {
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+
+		st = newReplicatedStorage(st, replica)
+	}
+
+	if cfg.WriteBatchSize > 0 {
+		interval := cfg.WriteBatchFlushInterval
+		if interval <= 0 {
+			interval = defaultWriteBatchFlushInterval
+		}
+
+		st = newBatchingStorage(st, cfg.WriteBatchSize, time.Duration(interval)*time.Millisecond, cfg.clock())
+	}
+
+	if cfg.MemoryFallbackSize > 0 {
+		st = &memoryFallback{primary: st, memory: newMemoryCache(cfg.MemoryFallbackSize, cfg.clock())}
+	}
+
+	if cfg.PromoteThreshold > 0 {
+		size := cfg.PromoteMemorySize
+		if size <= 0 {
+			size = defaultPromoteMemorySize
+		}
+
+		st = newPromotingStorage(st, size, cfg.PromoteThreshold, cfg.clock())
+	}
+
+	return st, nil
+}
+
+// cacheDirs returns the directories entries are stored in.
+func cacheDirs(cfg *Config) []string {
+	dirs := []string{cfg.Path}
+	if len(cfg.BackendAddresses) > 0 {
+		dirs = append([]string(nil), cfg.BackendAddresses...)
+	}
+
+	if cfg.ReplicaPath != "" {
+		dirs = append(dirs, cfg.ReplicaPath)
+	}
+
+	return dirs
+}
+
+func newDiskStorage(cfg *Config) (storage, error) {
+	vacuum := time.Duration(cfg.Cleanup) * time.Second
+
+	if len(cfg.BackendAddresses) == 0 {
+		return newFileCache(cfg.Path, vacuum, cfg.lockTimeout(), cfg.globalMaxAge(), cfg.CleanupWorkers, cfg.clock())
+	}
+
+	backends := make([]storage, 0, len(cfg.BackendAddresses))
+
+	for _, addr := range cfg.BackendAddresses {
+		if strings.Contains(addr, "://") {
+			return nil, fmt.Errorf("unsupported backend address %q: only local paths are supported", addr)
+		}
+
+		fc, err := newFileCache(addr, vacuum, cfg.lockTimeout(), cfg.globalMaxAge(), cfg.CleanupWorkers, cfg.clock())
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", addr, err)
+		}
+
+		backends = append(backends, fc)
+	}
+
+	return newHashRouter(cfg.BackendAddresses, backends, cfg.VirtualNodes)
+}
+
+// hashRouter distributes keys over several backends using a consistent hash
+// ring, so changing the backend list only moves a fraction of the keys.
+type hashRouter struct {
+	backends []storage
+	points   []uint32
+	owners   map[uint32]int
+}
+
+// newHashRouter places each backend on the ring under its name, so a backend
+// keeps its keys when others are added or removed.
+func newHashRouter(names []string, backends []storage, virtualNodes int) (*hashRouter, error) {
+	if len(backends) == 0 || len(names) != len(backends) {
+		return nil, errors.New("at least one named backend is required")
+	}
+
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	hr := &hashRouter{
+		backends: backends,
+		points:   make([]uint32, 0, len(backends)*virtualNodes),
+		owners:   make(map[uint32]int, len(backends)*virtualNodes),
+	}
+
+	for i, name := range names {
+		for v := 0; v < virtualNodes; v++ {
+			p := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(v)))
+			if _, ok := hr.owners[p]; ok {
+				continue
+			}
+
+			hr.owners[p] = i
+			hr.points = append(hr.points, p)
+		}
+	}
+
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i] < hr.points[j] })
+
+	return hr, nil
+}
+
+func (hr *hashRouter) backend(key string) storage {
+	h := crc32.ChecksumIEEE([]byte(key))
+
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= h })
+	if i == len(hr.points) {
+		i = 0
+	}
+
+	return hr.backends[hr.owners[hr.points[i]]]
+}
+
+func (hr *hashRouter) Get(key string) ([]byte, error) {
+	return hr.backend(key).Get(key)
+}
+
+func (hr *hashRouter) GetExpiry(key string) ([]byte, time.Time, error) {
+	return getExpiry(hr.backend(key), key)
+}
+
+func (hr *hashRouter) open(key string) (*os.File, error) {
+	return openEntryFile(hr.backend(key), key)
+}
+
+func (hr *hashRouter) usage() storageUsage {
+	var total storageUsage
+
+	for _, backend := range hr.backends {
+		u := getUsage(backend)
+		total.Entries += u.Entries
+		total.Bytes += u.Bytes
+		total.Evictions += u.Evictions
+		total.StoredBytes += u.StoredBytes
+	}
+
+	return total
+}
+
+func (hr *hashRouter) storedByteCount() int64 {
+	var total int64
+
+	for _, backend := range hr.backends {
+		total += getStoredBytes(backend)
+	}
+
+	return total
+}
+
+func (hr *hashRouter) sizeHistogram() [sizeBuckets]int64 {
+	var total [sizeBuckets]int64
+
+	for _, backend := range hr.backends {
+		for i, n := range getSizeHistogram(backend) {
+			total[i] += n
+		}
+	}
+
+	return total
+}
+
+func (hr *hashRouter) Set(key string, val io.Reader, expiry time.Duration) error {
+	return hr.backend(key).Set(key, val, expiry)
+}
+
+func (hr *hashRouter) Delete(key string) error {
+	return hr.backend(key).Delete(key)
+}
+
+// memoryFallback mirrors writes to an in-memory cache that is used when the
+// primary storage fails, to degrade gracefully during disk outages.
+type memoryFallback struct {
+	primary storage
+	memory  *memoryCache
+}
+
+func (mf *memoryFallback) Get(key string) ([]byte, error) {
+	b, err := mf.primary.Get(key)
+	if err == nil {
+		return b, nil
+	}
+
+	if b, memErr := mf.memory.Get(key); memErr == nil {
+		return b, nil
+	}
+
+	return nil, err
+}
+
+func (mf *memoryFallback) usage() storageUsage {
+	return getUsage(mf.primary)
+}
+
+func (mf *memoryFallback) storedByteCount() int64 {
+	return getStoredBytes(mf.primary)
+}
+
+func (mf *memoryFallback) sizeHistogram() [sizeBuckets]int64 {
+	return getSizeHistogram(mf.primary)
+}
+
+func (mf *memoryFallback) GetExpiry(key string) ([]byte, time.Time, error) {
+	b, expires, err := getExpiry(mf.primary, key)
+	if err == nil {
+		return b, expires, nil
+	}
+
+	if b, expires, memErr := mf.memory.GetExpiry(key); memErr == nil {
+		return b, expires, nil
+	}
+
+	return nil, time.Time{}, err
+}
+
+func (mf *memoryFallback) Set(key string, val io.Reader, expiry time.Duration) error {
+	b, err := io.ReadAll(val)
+	if err != nil {
+		return fmt.Errorf("error reading cache item: %w", err)
+	}
+
+	mf.memory.setExpires(key, b, mf.memory.now().Add(expiry))
+
+	if err := mf.primary.Set(key, bytes.NewReader(b), expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error setting cache item, kept in memory only: %v", err)
+	}
+
+	return nil
+}
+
+func (mf *memoryFallback) Delete(key string) error {
+	_ = mf.memory.Delete(key)
+
+	return mf.primary.Delete(key)
+}
+
+// replicatedStorage copies entries written to the primary storage to a
+// replica, which serves reads the primary fails. Replica writes are queued
+// for a single worker, and deletes wait for the queued writes of their key so
+// they are not undone.
+type replicatedStorage struct {
+	primary storage
+	replica storage
+
+	writes chan replicaWrite
+
+	mu sync.Mutex
+	// pending counts the queued writes of each key, and written is signaled
+	// whenever one is done.
+	pending map[string]int
+	written *sync.Cond
+}
+
+type replicaWrite struct {
+	key    string
+	val    []byte
+	expiry time.Duration
+}
+
+func newReplicatedStorage(primary, replica storage) *replicatedStorage {
+	rs := &replicatedStorage{ //nolint:exhaustruct // the mutex and cond are set below
+		primary: primary,
+		replica: replica,
+		writes:  make(chan replicaWrite, replicaQueueSize),
+		pending: map[string]int{},
+	}
+
+	rs.written = sync.NewCond(&rs.mu)
+
+	go rs.run()
+
+	return rs
+}
+
+//nolint:funcorder // run is called during initialization
+func (rs *replicatedStorage) run() {
+	for w := range rs.writes {
+		if err := rs.replica.Set(w.key, bytes.NewReader(w.val), w.expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error setting replica cache item: %v", err)
+		}
+
+		rs.done(w.key)
+	}
+}
+
+// done records that a queued write of key finished.
+func (rs *replicatedStorage) done(key string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.pending[key]--; rs.pending[key] <= 0 {
+		delete(rs.pending, key)
+	}
+
+	rs.written.Broadcast()
+}
+
+func (rs *replicatedStorage) Get(key string) ([]byte, error) {
+	b, err := rs.primary.Get(key)
+	if err == nil {
+		return b, nil
+	}
+
+	if b, replicaErr := rs.replica.Get(key); replicaErr == nil {
+		return b, nil
+	}
+
+	return nil, err
+}
+
+func (rs *replicatedStorage) GetExpiry(key string) ([]byte, time.Time, error) {
+	b, expires, err := getExpiry(rs.primary, key)
+	if err == nil {
+		return b, expires, nil
+	}
+
+	if b, expires, replicaErr := getExpiry(rs.replica, key); replicaErr == nil {
+		return b, expires, nil
+	}
+
+	return nil, time.Time{}, err
+}
+
+func (rs *replicatedStorage) Set(key string, val io.Reader, expiry time.Duration) error {
+	b, err := io.ReadAll(val)
+	if err != nil {
+		return fmt.Errorf("error reading cache item: %w", err)
+	}
+
+	if err = rs.primary.Set(key, bytes.NewReader(b), expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+		return err
+	}
+
+	// The replica is written in the background so it never slows down or
+	// fails the primary write. Writes are dropped when the queue is full.
+	rs.mu.Lock()
+	rs.pending[key]++
+	rs.mu.Unlock()
+
+	select {
+	case rs.writes <- replicaWrite{key: key, val: b, expiry: expiry}:
+	default:
+		log.Printf("Error setting replica cache item: queue full")
+		rs.done(key)
+	}
+
+	return nil
+}
+
+func (rs *replicatedStorage) Delete(key string) error {
+	rs.mu.Lock()
+	for rs.pending[key] > 0 {
+		rs.written.Wait()
+	}
+	rs.mu.Unlock()
+
+	if err := rs.replica.Delete(key); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error deleting replica cache item: %v", err)
+	}
+
+	return rs.primary.Delete(key)
+}
+
+func (rs *replicatedStorage) open(key string) (*os.File, error) {
+	f, err := openEntryFile(rs.primary, key)
+	if err == nil {
+		return f, nil
+	}
+
+	if f, replicaErr := openEntryFile(rs.replica, key); replicaErr == nil {
+		return f, nil
+	}
+
+	return nil, err
+}
+
+func (rs *replicatedStorage) usage() storageUsage {
+	return getUsage(rs.primary)
+}
+
+func (rs *replicatedStorage) storedByteCount() int64 {
+	return getStoredBytes(rs.primary)
+}
+
+func (rs *replicatedStorage) sizeHistogram() [sizeBuckets]int64 {
+	return getSizeHistogram(rs.primary)
+}
+
+// promotingStorage copies entries that are read often into memory so that
+// hot keys are served without disk I/O. Entries evicted from memory are
+// demoted back to the primary storage only and need to earn promotion again.
+type promotingStorage struct {
+	primary   storage
+	memory    *memoryCache
+	threshold int
+
+	mu   sync.RWMutex
+	hits map[string]int
+}
+
+func newPromotingStorage(primary storage, size, threshold int, now func() time.Time) *promotingStorage {
+	ps := &promotingStorage{ //nolint:exhaustruct // mu is zero value
+		primary:   primary,
+		memory:    newMemoryCache(size, now),
+		threshold: threshold,
+		hits:      map[string]int{},
+	}
+
+	ps.memory.onEvict = ps.resetHits
+
+	return ps
+}
+
+func (ps *promotingStorage) Get(key string) ([]byte, error) {
+	b, _, err := ps.GetExpiry(key)
+	return b, err
+}
+
+func (ps *promotingStorage) usage() storageUsage {
+	return getUsage(ps.primary)
+}
+
+func (ps *promotingStorage) storedByteCount() int64 {
+	return getStoredBytes(ps.primary)
+}
+
+func (ps *promotingStorage) sizeHistogram() [sizeBuckets]int64 {
+	return getSizeHistogram(ps.primary)
+}
+
+func (ps *promotingStorage) GetExpiry(key string) ([]byte, time.Time, error) {
+	if b, expires, err := ps.memory.GetExpiry(key); err == nil {
+		return b, expires, nil
+	}
+
+	b, expires, err := getExpiry(ps.primary, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if !expires.IsZero() && ps.hit(key) {
+		ps.memory.setExpires(key, b, expires)
+	}
+
+	return b, expires, nil
+}
+
+func (ps *promotingStorage) Set(key string, val io.Reader, expiry time.Duration) error {
+	_ = ps.memory.Delete(key)
+	ps.resetHits(key)
+
+	return ps.primary.Set(key, val, expiry)
+}
+
+func (ps *promotingStorage) Delete(key string) error {
+	_ = ps.memory.Delete(key)
+	ps.resetHits(key)
+
+	return ps.primary.Delete(key)
+}
+
+// hit counts a read of key and reports whether it should be promoted.
+func (ps *promotingStorage) hit(key string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.hits) >= maxTrackedHitKeys {
+		ps.hits = map[string]int{}
+	}
+
+	ps.hits[key]++
+
+	return ps.hits[key] >= ps.threshold
+}
+
+func (ps *promotingStorage) hitCount(key string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return ps.hits[key]
+}
+
+func (ps *promotingStorage) resetHits(key string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.hits, key)
+}
+
+// batchedWrite is an entry waiting to be flushed by a batchingStorage.
+type batchedWrite struct {
+	key     string
+	val     []byte
+	expires time.Time
+}
+
+// batchingStorage buffers writes in memory and flushes them to the primary
+// storage together, once the batch is full or the flush interval elapses.
+// Pending entries are served from the buffer until they are flushed.
+type batchingStorage struct {
+	primary storage
+	size    int
+	now     func() time.Time
+
+	mu       sync.Mutex
+	pending  []batchedWrite
+	flushing []batchedWrite
+
+	flushMu sync.Mutex
+}
+
+func newBatchingStorage(primary storage, size int, interval time.Duration, now func() time.Time) *batchingStorage {
+	bs := &batchingStorage{ //nolint:exhaustruct // mutexes and flushing are zero values
+		primary: primary,
+		size:    size,
+		now:     now,
+		pending: make([]batchedWrite, 0, size),
+	}
+
+	go bs.run(interval)
+
+	return bs
+}
+
+//nolint:funcorder // run is called during initialization
+func (bs *batchingStorage) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		bs.flush()
+	}
+}
+
+func (bs *batchingStorage) Get(key string) ([]byte, error) {
+	b, _, err := bs.GetExpiry(key)
+	return b, err
+}
+
+func (bs *batchingStorage) GetExpiry(key string) ([]byte, time.Time, error) {
+	w, ok := bs.lookup(key)
+	if !ok {
+		return getExpiry(bs.primary, key)
+	}
+
+	if w.expires.Before(bs.now()) {
+		return nil, time.Time{}, errCacheMiss
+	}
+
+	return w.val, w.expires, nil
+}
+
+// lookup returns the latest write for key that is not in the primary storage
+// yet.
+func (bs *batchingStorage) lookup(key string) (batchedWrite, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, writes := range [][]batchedWrite{bs.pending, bs.flushing} {
+		for i := len(writes) - 1; i >= 0; i-- {
+			if writes[i].key == key {
+				return writes[i], true
+			}
+		}
+	}
+
+	return batchedWrite{}, false
+}
+
+func (bs *batchingStorage) Set(key string, val io.Reader, expiry time.Duration) error {
+	b, err := io.ReadAll(val)
+	if err != nil {
+		return fmt.Errorf("error reading cache item: %w", err)
+	}
+
+	bs.mu.Lock()
+	bs.pending = append(bs.pending, batchedWrite{key: key, val: b, expires: bs.now().Add(expiry)})
+	full := len(bs.pending) >= bs.size
+	bs.mu.Unlock()
+
+	if full {
+		bs.flush()
+	}
+
+	return nil
+}
+
+func (bs *batchingStorage) Delete(key string) error {
+	// Wait for a running flush, which may be writing key.
+	bs.flushMu.Lock()
+	defer bs.flushMu.Unlock()
+
+	bs.mu.Lock()
+
+	pending := bs.pending[:0]
+
+	for _, w := range bs.pending {
+		if w.key != key {
+			pending = append(pending, w)
+		}
+	}
+
+	bs.pending = pending
+	bs.mu.Unlock()
+
+	return bs.primary.Delete(key)
+}
+
+func (bs *batchingStorage) usage() storageUsage {
+	return getUsage(bs.primary)
+}
+
+func (bs *batchingStorage) storedByteCount() int64 {
+	return getStoredBytes(bs.primary)
+}
+
+func (bs *batchingStorage) sizeHistogram() [sizeBuckets]int64 {
+	return getSizeHistogram(bs.primary)
+}
+
+// flush writes the pending entries to the primary storage. File storage
+// writes each entry to a temporary file renamed into place, so readers never
+// see partial entries.
+func (bs *batchingStorage) flush() {
+	bs.flushMu.Lock()
+	defer bs.flushMu.Unlock()
+
+	bs.mu.Lock()
+	batch := bs.pending
+	bs.pending = make([]batchedWrite, 0, bs.size)
+	bs.flushing = batch
+	bs.mu.Unlock()
+
+	defer func() {
+		bs.mu.Lock()
+		bs.flushing = nil
+		bs.mu.Unlock()
+	}()
+
+	for _, w := range batch {
+		expiry := w.expires.Sub(bs.now())
+		if expiry <= 0 {
+			continue
+		}
+
+		if err := bs.primary.Set(w.key, bytes.NewReader(w.val), expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error flushing cache item: %v", err)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mapStorage map[string][]byte
+
+func (s mapStorage) Get(key string) ([]byte, error) {
+	b, ok := s[key]
+	if !ok {
+		return nil, errCacheMiss
+	}
+
+	return b, nil
+}
+
+func (s mapStorage) Set(key string, val io.Reader, _ time.Duration) error {
+	b, err := io.ReadAll(val)
+	if err != nil {
+		return err
+	}
+
+	s[key] = b
+
+	return nil
+}
+
+func (s mapStorage) Delete(key string) error {
+	delete(s, key)
+	return nil
+}
+
+func TestHashRouter(t *testing.T) {
+	a, b, c := mapStorage{}, mapStorage{}, mapStorage{}
+
+	hr, err := newHashRouter([]string{"a", "b", "c"}, []storage{a, b, c}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 300; i++ {
+		_ = hr.Set("key"+strconv.Itoa(i), strings.NewReader("val"), time.Minute)
+	}
+
+	for name, s := range map[string]mapStorage{"a": a, "b": b, "c": c} {
+		if len(s) == 0 {
+			t.Errorf("expected backend %s to receive keys", name)
+		}
+	}
+
+	// Removing a backend must not move keys between the remaining ones.
+	smaller, err := newHashRouter([]string{"a", "c"}, []storage{a, c}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range a {
+		if _, err := smaller.Get(key); err != nil {
+			t.Errorf("expected key %q to stay on its backend", key)
+		}
+	}
+
+	for key := range c {
+		if _, err := smaller.Get(key); err != nil {
+			t.Errorf("expected key %q to stay on its backend", key)
+		}
+	}
+}
+
+type failingStorage struct{}
+
+func (failingStorage) Get(string) ([]byte, error) {
+	return nil, errors.New("disk unavailable")
+}
+
+func (failingStorage) Set(string, io.Reader, time.Duration) error {
+	return errors.New("disk unavailable")
+}
+
+func (failingStorage) Delete(string) error {
+	return errors.New("disk unavailable")
+}
+
+// slowStorage delays reads from the wrapped storage.
+type slowStorage struct {
+	storage
+
+	delay time.Duration
+}
+
+func (s slowStorage) Get(key string) ([]byte, error) {
+	time.Sleep(s.delay)
+
+	return s.storage.Get(key)
+}
+
+func TestCache_CacheReadTimeout(t *testing.T) {
+	var callCount atomic.Int64
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		callCount.Add(1)
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("upstream"))
+	}
+
+	cfg := &Config{
+		Path:             createTempDir(t),
+		MaxExpiry:        10,
+		Cleanup:          20,
+		AddStatusHeader:  true,
+		CacheReadTimeout: 20,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		return rec
+	}
+
+	serve()
+
+	if rec := serve(); rec.Header().Get("Cache-Status") != cacheHitStatus {
+		t.Fatalf("expected fast reads to hit, got status %q", rec.Header().Get("Cache-Status"))
+	}
+
+	c.cache = slowStorage{storage: c.cache, delay: time.Second}
+	start := time.Now()
+
+	rec := serve()
+	if rec.Header().Get("Cache-Status") != cacheMissStatus || rec.Body.String() != "upstream" {
+		t.Errorf("expected a slow read to fall back to the upstream, got %q with status %q", rec.Body.String(), rec.Header().Get("Cache-Status"))
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the read to time out, took %s", elapsed)
+	}
+
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("expected 2 upstream calls, got %d", got)
+	}
+}
+
+func TestMemoryFallback(t *testing.T) {
+	mf := &memoryFallback{primary: failingStorage{}, memory: newMemoryCache(10, time.Now)}
+
+	if err := mf.Set(testCacheKey, strings.NewReader("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	got, err := mf.Get(testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	if string(got) != "content" {
+		t.Errorf("unexpected cache content: want %q, got %q", "content", got)
+	}
+}
+
+func TestPromotingStorage(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(fc.Close)
+
+	ps := newPromotingStorage(fc, 1, 2, time.Now)
+
+	_ = ps.Set("a", strings.NewReader("a"), time.Minute)
+	_ = ps.Set("b", strings.NewReader("b"), time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ps.Get("a"); err != nil {
+			t.Fatalf("unexpected cache get error: %v", err)
+		}
+	}
+
+	// Remove the disk copy: a promoted entry is still served from memory.
+	_ = fc.Delete("a")
+
+	if _, err := ps.Get("a"); err != nil {
+		t.Errorf("expected promoted entry to be served from memory: %v", err)
+	}
+
+	// Promoting b evicts a from memory, which resets its hit count.
+	for i := 0; i < 2; i++ {
+		_, _ = ps.Get("b")
+	}
+
+	if _, err := ps.Get("a"); err == nil {
+		t.Error("expected demoted entry to be a miss")
+	}
+
+	if n := ps.hitCount("a"); n != 0 {
+		t.Errorf("unexpected hit count after demotion: want 0, got %d", n)
+	}
+}
+
+func TestReplicatedStorage(t *testing.T) {
+	primary, err := newFileCache(createTempDir(t), time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(primary.Close)
+
+	replica, err := newFileCache(createTempDir(t), time.Minute, 0, 0, 1, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(replica.Close)
+
+	rs := newReplicatedStorage(primary, replica)
+
+	if err = rs.Set("key", strings.NewReader("val"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = replica.Get("key"); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to be replicated")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reads fall back to the replica when the primary misses.
+	if err = primary.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := rs.Get("key")
+	if err != nil || string(b) != "val" {
+		t.Errorf("expected replica to serve the entry, got %q, %v", b, err)
+	}
+
+	if err = rs.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rs.Get("key"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected a miss after delete, got %v", err)
+	}
+}
+
+// gatedStorage is a mapStorage whose writes wait for release.
+type gatedStorage struct {
+	mu      sync.Mutex
+	entries mapStorage
+	release chan struct{}
+}
+
+func (s *gatedStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries.Get(key)
+}
+
+func (s *gatedStorage) Set(key string, val io.Reader, expiry time.Duration) error {
+	<-s.release
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries.Set(key, val, expiry)
+}
+
+func (s *gatedStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries.Delete(key)
+}
+
+func TestReplicatedStorage_DeleteWaitsForWrites(t *testing.T) {
+	replica := &gatedStorage{entries: mapStorage{}, release: make(chan struct{})}
+	rs := newReplicatedStorage(mapStorage{}, replica)
+
+	if err := rs.Set("key", strings.NewReader("val"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := make(chan error)
+
+	go func() {
+		deleted <- rs.Delete("key")
+	}()
+
+	select {
+	case <-deleted:
+		t.Fatal("expected the delete to wait for the replica write")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(replica.release)
+
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rs.Get("key"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected the replica write not to undo the delete, got %v", err)
+	}
+}
+
+func TestBatchingStorage(t *testing.T) {
+	primary := mapStorage{}
+
+	// A long interval so only a full batch triggers a flush.
+	bs := newBatchingStorage(primary, 2, time.Hour, time.Now)
+
+	if err := bs.Set("a", strings.NewReader("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := primary["a"]; ok {
+		t.Error("expected the write to be buffered")
+	}
+
+	if b, err := bs.Get("a"); err != nil || string(b) != "1" {
+		t.Errorf("expected the pending entry to be served, got %q, %v", b, err)
+	}
+
+	if err := bs.Set("b", strings.NewReader("2"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(primary["a"]) != "1" || string(primary["b"]) != "2" {
+		t.Errorf("expected a full batch to be flushed, got %v", primary)
+	}
+
+	if err := bs.Set("c", strings.NewReader("3"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bs.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	bs.flush()
+
+	if _, err := bs.Get("c"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected a miss after delete, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errStreamAborted = errors.New("response aborted")
+
+// canStream reports whether responses can be streamed to storage while they
+// are written, instead of being buffered first. This requires the body to be
+// stored raw and without any transformation of the full body, and the
+// response to be final once written.
+func (m *cache) canStream() bool {
+	return m.cfg.BodyStorageEncoding == bodyStorageNone &&
+		!m.cfg.CompressCache &&
+		!m.cfg.TranscodeCacheEncoding &&
+		!m.cfg.DeduplicateResponses &&
+		m.cfg.UpstreamRetries == 0 &&
+		m.cfg.ValidateResponse == nil &&
+		!m.cfg.AddBodyHashHeader &&
+		!m.cfg.RequestUpstreamGzip &&
+		!m.cfg.RetryOnEmptyBody &&
+		len(m.cfg.BodyTransforms) == 0 &&
+		!m.cfg.PrefetchLinks &&
+		!m.cfg.ConditionalRevalidate &&
+		m.cfg.FallbackURL == ""
+}
+
+// cacheStream pipes a response body into storage.
+type cacheStream struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// startStream starts storing the response written to rw under key. The entry
+// metadata is written first and the body is appended as it is written.
+func (m *cache) startStream(key string, r *http.Request, rw *responseWriter, status int, computeDuration time.Duration) {
+	data, expiry, ok := m.newEntry(key, r, status, rw.Header(), computeDuration)
+	if !ok {
+		return
+	}
+
+	data.BodyRaw = true
+	data.RequestID = rw.requestID
+
+	if m.cfg.MetadataOnlyCache && r.Method == http.MethodGet {
+		m.storeMeta(key, data, expiry)
+	}
+
+	meta, err := entryMeta(&data)
+	if err != nil {
+		log.Printf("Error serializing cache item: %v", err)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	cs := &cacheStream{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		err := m.cache.Set(key, io.MultiReader(bytes.NewReader(meta), pr), expiry)
+		// Unblock the writer if storage gave up early.
+		_ = pr.CloseWithError(err)
+
+		if err == nil {
+			m.stats.stores.Add(1)
+			m.indexFastPath(key, r, data)
+		}
+
+		cs.done <- err
+	}()
+
+	rw.stream = cs
+}
+
+func (cs *cacheStream) Write(p []byte) error {
+	_, err := cs.pw.Write(p)
+	return err
+}
+
+// finishStream completes the stream started for rw, if any. An aborted
+// stream leaves no entry behind.
+func (rw *responseWriter) finishStream(abort bool) {
+	if rw.stream == nil {
+		return
+	}
+
+	cs := rw.stream
+	rw.stream = nil
+
+	if abort {
+		_ = cs.pw.CloseWithError(errStreamAborted)
+	} else {
+		_ = cs.pw.Close()
+	}
+
+	if err := <-cs.done; err != nil && !errors.Is(err, errStreamAborted) { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error setting cache item: %v", err)
+	}
+}
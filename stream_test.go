@@ -0,0 +1,73 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_StreamedWrite(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusOK)
+
+		for i := 0; i < 3; i++ {
+			_, _ = rw.Write([]byte("chunk "))
+		}
+
+		if r.URL.Path == "/panic" {
+			panic("upstream failure")
+		}
+	}
+
+	cfg := &Config{
+		Path:                dir,
+		MaxExpiry:           10,
+		Cleanup:             20,
+		AddStatusHeader:     true,
+		BodyStorageEncoding: bodyStorageNone,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := h.(*cache)
+
+	if !c.canStream() {
+		t.Fatal("expected responses to be streamed")
+	}
+
+	for _, want := range []string{"miss", "hit"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != want {
+			t.Errorf("unexpected cache state: want %q, got: %q", want, state)
+		}
+
+		if body := rw.Body.String(); body != strings.Repeat("chunk ", 3) {
+			t.Errorf("unexpected body: got %q", body)
+		}
+	}
+
+	// A response aborted by a panic must not leave an entry behind.
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/panic", nil))
+	}()
+
+	if _, err := c.cache.Get("GETlocalhost/panic"); err == nil {
+		t.Error("expected aborted response not to be cached")
+	}
+}
@@ -0,0 +1,121 @@
+package plugin_simpleforcecache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expirySize is the length of the expiry timestamp prefixing entry files.
+const expirySize = 8
+
+// cacheTags returns the tags listed in the name header of h, separated by
+// spaces or commas.
+func cacheTags(h http.Header, name string) []string {
+	if name == "" {
+		return nil
+	}
+
+	var tags []string
+
+	for _, val := range h.Values(name) {
+		tags = append(tags, strings.FieldsFunc(val, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+
+	return tags
+}
+
+// PurgeByTag deletes the entries tagged with tag from the cache directories
+// and returns how many were deleted. The purge is announced to the other
+// instances sharing the invalidation channel.
+func (m *cache) PurgeByTag(tag string) (int, error) {
+	m.publishInvalidation(invalidationMessage{value: tag, tag: true})
+
+	return m.purgeTag(tag)
+}
+
+// PurgeDir deletes the entries tagged with tag from the cache directory dir
+// and returns how many were deleted. It does not need a running cache, so
+// entries can be purged from deployment scripts.
+func PurgeDir(dir, tag string) (int, error) {
+	n, _, err := purgeDir(dir, tag)
+
+	return n, err
+}
+
+// purgeDir is PurgeDir, also returning the keys recorded in the deleted
+// entries.
+func purgeDir(dir, tag string) (int, []string, error) {
+	var (
+		n    int
+		keys []string
+	)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir(), strings.HasPrefix(info.Name(), ".tmp-"), info.Name() == lockFileName, info.Name() == walFileName:
+			return nil
+		}
+
+		b, err := os.ReadFile(filepath.Clean(path))
+		if err != nil || len(b) < expirySize {
+			// Skip entries removed or being replaced concurrently.
+			return nil //nolint:nilerr // unreadable entries are skipped
+		}
+
+		key, ok := entryTagged(b[expirySize:], tag)
+		if !ok {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) { //nolint:noinlineerr // acceptable inline error
+			return fmt.Errorf("error deleting file: %w", err)
+		}
+
+		n++
+
+		if key != "" {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return n, keys, fmt.Errorf("error walking cache directory: %w", err)
+	}
+
+	return n, keys, nil
+}
+
+// entryTagged reports whether the stored entry b is tagged with tag, along
+// with the key recorded in it.
+func entryTagged(b []byte, tag string) (string, bool) {
+	meta, _, err := splitEntry(b)
+	if err != nil {
+		return "", false
+	}
+
+	var data struct {
+		Tags []string `json:"tags"`
+		Key  string   `json:"key"`
+	}
+
+	if err := json.Unmarshal(meta, &data); err != nil { //nolint:noinlineerr // acceptable inline error
+		return "", false
+	}
+
+	for _, t := range data.Tags {
+		if t == tag {
+			return data.Key, true
+		}
+	}
+
+	return "", false
+}
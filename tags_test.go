@@ -0,0 +1,109 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCacheTags(t *testing.T) {
+	h := http.Header{}
+	h.Add("X-Cache-Tags", "product-123 brand-456")
+	h.Add("X-Cache-Tags", "a,b")
+
+	want := []string{"product-123", "brand-456", "a", "b"}
+	if got := cacheTags(h, "X-Cache-Tags"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected tags: want %q, got %q", want, got)
+	}
+
+	if got := cacheTags(h, ""); got != nil {
+		t.Errorf("expected no tags without a header name, got %q", got)
+	}
+}
+
+func TestCache_PurgeByTag(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/product" {
+			rw.Header().Set("X-Cache-Tags", "product-123 brand-456")
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, CacheTagHeader: "X-Cache-Tags"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/product", "/other"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	c := h.(*cache)
+
+	n, err := c.PurgeByTag("brand-456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 purged entry, got %d", n)
+	}
+
+	if _, err := c.cache.Get("GETlocalhost/product"); err == nil {
+		t.Error("expected the tagged entry to be purged")
+	}
+
+	if _, err := c.cache.Get("GETlocalhost/other"); err != nil {
+		t.Errorf("expected the untagged entry to be kept: %v", err)
+	}
+
+	if n, err := PurgeDir(dir, "product-123"); err != nil || n != 0 {
+		t.Errorf("expected nothing left to purge, got %d, %v", n, err)
+	}
+}
+
+func TestCache_PurgeByTagMemoryCopies(t *testing.T) {
+	var fetched int
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		fetched++
+
+		rw.Header().Set("X-Cache-Tags", "product-123")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("product"))
+	}
+
+	cfg := &Config{
+		Path:               createTempDir(t),
+		MaxExpiry:          10,
+		Cleanup:            20,
+		CacheTagHeader:     "X-Cache-Tags",
+		MemoryFallbackSize: 10,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/product", nil))
+
+	if n, err := h.(*cache).PurgeByTag("product-123"); err != nil || n != 1 {
+		t.Fatalf("expected 1 purged entry, got %d, %v", n, err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/product", nil))
+
+	if fetched != 2 {
+		t.Errorf("expected the purged entry to be fetched again, got %d upstream calls", fetched)
+	}
+}
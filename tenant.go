@@ -0,0 +1,83 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// HeaderTenantExtractor returns a TenantIDExtractor reading the tenant from
+// the named request header, such as an API key header.
+func HeaderTenantExtractor(headerName string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(headerName)
+	}
+}
+
+// PathSegmentTenantExtractor returns a TenantIDExtractor reading the tenant
+// from the path segment at segmentIndex, counted from 0. For /t/acme/items,
+// index 1 yields "acme".
+func PathSegmentTenantExtractor(segmentIndex int) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if segmentIndex < 0 || segmentIndex >= len(segments) {
+			return ""
+		}
+
+		return segments[segmentIndex]
+	}
+}
+
+// JWTClaimTenantExtractor returns a TenantIDExtractor reading the tenant from
+// the named claim of the bearer token in the Authorization header. The token
+// signature is not verified, so the token must be verified before the
+// middleware, for example by a forward auth middleware.
+func JWTClaimTenantExtractor(claimName string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return bearerClaim(r, claimName)
+	}
+}
+
+// bearerClaim returns the named claim of the bearer token in the
+// Authorization header of r, without verifying the token. It is empty when
+// the token or the claim is missing or invalid.
+func bearerClaim(r *http.Request, name string) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	return jwtClaim(payload, name)
+}
+
+// jwtClaim returns the string or numeric claim name of a JWT payload.
+func jwtClaim(payload []byte, name string) string {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var claims map[string]any
+	if err := dec.Decode(&claims); err != nil { //nolint:noinlineerr // acceptable inline error
+		return ""
+	}
+
+	switch val := claims[name].(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	default:
+		return ""
+	}
+}
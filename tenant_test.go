@@ -0,0 +1,115 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testJWT(payload string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestTenantExtractors(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor func(r *http.Request) string
+		path      string
+		header    string
+		value     string
+		want      string
+	}{
+		{name: "header", extractor: HeaderTenantExtractor("X-Api-Key"), path: "/items", header: "X-Api-Key", value: "acme", want: "acme"},
+		{name: "missing header", extractor: HeaderTenantExtractor("X-Api-Key"), path: "/items"},
+		{name: "path segment", extractor: PathSegmentTenantExtractor(1), path: "/t/acme/items", want: "acme"},
+		{name: "path segment out of range", extractor: PathSegmentTenantExtractor(5), path: "/t/acme/items"},
+		{
+			name: "jwt claim", extractor: JWTClaimTenantExtractor("tenant"), path: "/items",
+			header: "Authorization", value: "Bearer " + testJWT(`{"tenant":"acme"}`), want: "acme",
+		},
+		{
+			name: "numeric jwt claim", extractor: JWTClaimTenantExtractor("org"), path: "/items",
+			header: "Authorization", value: "Bearer " + testJWT(`{"org":12345678901}`), want: "12345678901",
+		},
+		{name: "invalid jwt", extractor: JWTClaimTenantExtractor("tenant"), path: "/items", header: "Authorization", value: "Bearer abc"},
+		{name: "basic auth", extractor: JWTClaimTenantExtractor("tenant"), path: "/items", header: "Authorization", value: "Basic YTpi"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+
+			if got := test.extractor(req); got != test.want {
+				t.Errorf("unexpected tenant: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_TenantIDExtractor(t *testing.T) {
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(r.Header.Get("X-Tenant")))
+	}
+
+	cfg := &Config{
+		Path:              createTempDir(t),
+		MaxExpiry:         10,
+		Cleanup:           20,
+		TenantIDExtractor: HeaderTenantExtractor("X-Tenant"),
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		req.Header.Set("X-Tenant", tenant)
+
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+
+		if rec.Body.String() != tenant {
+			t.Errorf("expected the response of tenant %q, got %q", tenant, rec.Body.String())
+		}
+	}
+
+	if _, err := c.(*cache).cache.Get("tenant:acme|GETlocalhost/test"); err != nil {
+		t.Errorf("expected the entry to be stored under the tenant key: %v", err)
+	}
+}
+
+func TestCacheKey_JWTClaim(t *testing.T) {
+	tests := []struct {
+		name string
+		auth string
+		want string
+	}{
+		{name: "claim", auth: "Bearer " + testJWT(`{"tenant_id":"acme"}`), want: "GETlocalhost/test|JWT:tenant_id=acme"},
+		{name: "missing claim", auth: "Bearer " + testJWT(`{"sub":"user"}`), want: "GETlocalhost/test|JWT:tenant_id="},
+		{name: "invalid token", auth: "Bearer invalid", want: "GETlocalhost/test|JWT:tenant_id="},
+		{name: "no token", want: "GETlocalhost/test|JWT:tenant_id="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+
+			if got := cacheKey(req, &Config{JWTClaimCacheKey: "tenant_id"}); got != test.want {
+				t.Errorf("unexpected cache key: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
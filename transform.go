@@ -0,0 +1,73 @@
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// BodyTransform rewrites a response body before it is stored.
+type BodyTransform interface {
+	Transform(contentType string, body []byte) ([]byte, error)
+}
+
+// JSONMinifyTransform removes insignificant whitespace from JSON bodies.
+type JSONMinifyTransform struct{}
+
+// Transform minifies body if contentType is JSON, and returns it unchanged
+// otherwise.
+func (JSONMinifyTransform) Transform(contentType string, body []byte) ([]byte, error) {
+	if !isJSON(contentType) {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, fmt.Errorf("error minifying JSON: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// isJSON reports whether contentType is application/json or a +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// transformBody applies transforms in order to the body of data. Encoded
+// bodies are left untouched, as transforms work on the plain content.
+func transformBody(transforms []BodyTransform, data *cacheData) error {
+	h := http.Header(data.Headers)
+	if encoding := h.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+
+	body := data.Body
+	contentType := h.Get("Content-Type")
+
+	for _, t := range transforms {
+		var err error
+
+		body, err = t.Transform(contentType, body)
+		if err != nil {
+			return err //nolint:wrapcheck // transforms describe their own errors
+		}
+	}
+
+	if !bytes.Equal(body, data.Body) {
+		h.Del("Content-Length")
+		rehashBody(h, body)
+	}
+
+	data.Body = body
+
+	return nil
+}
@@ -0,0 +1,90 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type upperTransform struct{}
+
+func (upperTransform) Transform(_ string, body []byte) ([]byte, error) {
+	return []byte(strings.ToUpper(string(body))), nil
+}
+
+func TestJSONMinifyTransform(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		wantErr     bool
+	}{
+		{name: "json", contentType: "application/json", body: "{\n  \"a\": [1, 2]\n}", want: `{"a":[1,2]}`},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", body: `{ "a": 1 }`, want: `{"a":1}`},
+		{name: "json suffix", contentType: "application/problem+json", body: `{ "a": 1 }`, want: `{"a":1}`},
+		{name: "not json", contentType: "text/html", body: "<p> a </p>", want: "<p> a </p>"},
+		{name: "invalid json", contentType: "application/json", body: `{"a":`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := JSONMinifyTransform{}.Transform(test.contentType, []byte(test.body))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !test.wantErr && string(got) != test.want {
+				t.Errorf("unexpected body: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_BodyTransforms(t *testing.T) {
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Length", "16")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(`{ "a": "value" }`))
+	}
+
+	cfg := &Config{
+		Path:            createTempDir(t),
+		MaxExpiry:       10,
+		Cleanup:         20,
+		AddStatusHeader: true,
+		BodyTransforms:  []BodyTransform{JSONMinifyTransform{}, upperTransform{}},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Misses are served as sent by the upstream, only the stored body is
+	// transformed.
+	tests := []struct {
+		wantStatus string
+		wantBody   string
+	}{
+		{wantStatus: cacheMissStatus, wantBody: `{ "a": "value" }`},
+		{wantStatus: cacheHitStatus, wantBody: `{"A":"VALUE"}`},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("unexpected cache state: want %q, got %q", test.wantStatus, got)
+		}
+
+		if got := rw.Body.String(); got != test.wantBody {
+			t.Errorf("unexpected body on %s: want %q, got %q", test.wantStatus, test.wantBody, got)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// callUpstream forwards the request to the next handler. When a fallback is
+// configured, panics are recovered and reported so a fallback can be served.
+func (m *cache) callUpstream(rw *responseWriter, r *http.Request) (panicked bool) {
+	if !m.cfg.PropagateContext {
+		// A client disconnecting must not abort the upstream call, so the
+		// response can still be cached.
+		r = r.WithContext(detachedContext{parent: r.Context()})
+	}
+
+	if timeout := m.pathUpstreamTimeout(r.URL.Path); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	requestGzip := m.upstreamGzip(r)
+
+	// Retries keep the ID of the first attempt.
+	if m.cfg.RequestIDHeader != "" && rw.requestID == "" {
+		rw.requestID = m.generateRequestID()
+	}
+
+	if len(m.cfg.UpstreamHeaders) > 0 || len(m.cfg.StripUpstreamRequestHeaders) > 0 || requestGzip ||
+		len(m.cfg.UpstreamQueryParams) > 0 || rw.requestID != "" {
+		// Clone so header changes never leak into the client's request.
+		r = r.Clone(r.Context())
+
+		if len(m.cfg.UpstreamQueryParams) > 0 {
+			r.URL.RawQuery = forwardedQuery(r.URL.Query(), m.cfg.UpstreamQueryParams)
+			if r.RequestURI != "" {
+				r.RequestURI = r.URL.RequestURI()
+			}
+		}
+
+		for _, name := range m.cfg.StripUpstreamRequestHeaders {
+			r.Header.Del(name)
+		}
+
+		for name, val := range m.cfg.UpstreamHeaders {
+			r.Header.Set(name, val)
+		}
+
+		if requestGzip {
+			r.Header.Set("Accept-Encoding", gzipEncoding)
+		}
+
+		if rw.requestID != "" {
+			r.Header.Set(m.cfg.RequestIDHeader, rw.requestID)
+		}
+	}
+
+	if m.cfg.FallbackURL != "" {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler { //nolint:errorlint,err113 // sentinel panic value
+					panic(p)
+				}
+
+				log.Printf("Upstream handler panicked: %v", p)
+
+				panicked = true
+			}
+		}()
+	}
+
+	m.next.ServeHTTP(rw, r)
+
+	return false
+}
+
+// detachedContext keeps the values of its parent but not its deadline or
+// cancellation.
+type detachedContext struct {
+	parent context.Context //nolint:containedctx // the context only provides values
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// generateRequestID returns a new ID for an upstream request.
+func (m *cache) generateRequestID() string {
+	if m.cfg.GenerateRequestID != nil {
+		return m.cfg.GenerateRequestID()
+	}
+
+	var b [16]byte
+
+	_, _ = rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
+
+// forwardedQuery encodes the query parameters listed in params, dropping any
+// other parameter.
+func forwardedQuery(query url.Values, params []string) string {
+	forwarded := url.Values{}
+
+	for _, name := range params {
+		if vals, ok := query[name]; ok {
+			forwarded[name] = vals
+		}
+	}
+
+	return forwarded.Encode()
+}
+
+// safeMethod reports whether requests with method can be replayed: their
+// body, if any, is not consumed and they have no side effects.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// callUpstreamWithRetries calls the upstream again with exponential backoff
+// while it answers with a server error, up to UpstreamRetries times. Only
+// GET and HEAD requests are retried. rw must be buffered.
+func (m *cache) callUpstreamWithRetries(rw *responseWriter, r *http.Request) bool {
+	panicked := m.callUpstream(rw, r)
+
+	delay := time.Duration(m.cfg.UpstreamRetryDelay) * time.Millisecond
+
+	for attempt := 0; attempt < m.cfg.UpstreamRetries; attempt++ {
+		if panicked || rw.status < http.StatusInternalServerError || !safeMethod(r.Method) {
+			break
+		}
+
+		timer := time.NewTimer(delay << attempt)
+
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return panicked
+		case <-timer.C:
+		}
+
+		log.Printf("Retrying upstream for %q after status %d", requestURL(r), rw.status)
+
+		rw.reset()
+
+		panicked = m.callUpstream(rw, r)
+	}
+
+	if m.cfg.RetryOnEmptyBody && !panicked && safeMethod(r.Method) {
+		panicked = m.retryEmptyBody(rw, r)
+	}
+
+	return panicked
+}
+
+// retryEmptyBody calls the upstream again while it answers 200 with an empty
+// body, up to EmptyBodyRetries times, and reports whether a retry panicked.
+// Only GET and HEAD requests may be retried. rw must be buffered.
+func (m *cache) retryEmptyBody(rw *responseWriter, r *http.Request) bool {
+	delay := time.Duration(m.cfg.EmptyBodyRetryDelay) * time.Millisecond
+
+	for attempt := 0; emptyBody(rw); attempt++ {
+		log.Printf("Warning: empty response body from upstream for %q", requestURL(r))
+
+		if attempt >= m.cfg.EmptyBodyRetries {
+			return false
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		rw.reset()
+
+		if m.callUpstream(rw, r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emptyBody reports whether rw holds a 200 response without a body.
+func emptyBody(rw *responseWriter) bool {
+	return (rw.status == http.StatusOK || rw.status == 0) && len(rw.body) == 0
+}
+
+func (m *cache) upstreamTimeout() time.Duration {
+	return time.Duration(m.cfg.UpstreamTimeout) * time.Second
+}
+
+// pathUpstreamTimeout returns the upstream timeout for the longest matching
+// prefix in PathUpstreamTimeouts, or the global UpstreamTimeout.
+func (m *cache) pathUpstreamTimeout(path string) time.Duration {
+	match := ""
+	timeout := m.upstreamTimeout()
+
+	for prefix, seconds := range m.cfg.PathUpstreamTimeouts {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match = prefix
+			timeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return timeout
+}
+
+// serveFallback fetches FallbackURL and writes its response without caching
+// it. It reports whether a fallback response was written.
+func (m *cache) serveFallback(w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+
+	if m.cfg.UpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, m.upstreamTimeout())
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.cfg.FallbackURL, nil)
+	if err != nil {
+		log.Printf("Error creating fallback request: %v", err)
+		return false
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error fetching fallback: %v", err)
+		return false
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading fallback: %v", err)
+		return false
+	}
+
+	for key, vals := range resp.Header {
+		if key == "Transfer-Encoding" || key == "Connection" || key == "Content-Length" {
+			continue
+		}
+
+		w.Header()[key] = vals
+	}
+
+	m.setCacheStatus(w.Header(), cacheFallbackStatus)
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(body)
+
+	return true
+}
@@ -0,0 +1,111 @@
+package plugin_simpleforcecache
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// varyIndex records the Vary header of upstream responses by path, so the
+// listed request headers can be added to the cache key of later requests.
+type varyIndex struct {
+	mu      sync.RWMutex
+	headers map[string][]string
+}
+
+func newVaryIndex() *varyIndex {
+	return &varyIndex{
+		mu:      sync.RWMutex{},
+		headers: map[string][]string{},
+	}
+}
+
+// learn records the request headers listed in the Vary values for path.
+func (vi *varyIndex) learn(path string, vary []string) {
+	var headers []string
+
+	for _, val := range vary {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || name == "*" {
+				continue
+			}
+
+			headers = append(headers, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	sort.Strings(headers)
+
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	if len(headers) == 0 {
+		delete(vi.headers, path)
+		return
+	}
+
+	if _, ok := vi.headers[path]; !ok && len(vi.headers) >= maxTrackedHitKeys {
+		vi.headers = map[string][]string{}
+	}
+
+	vi.headers[path] = headers
+}
+
+// lookup returns the request headers the responses for path vary on.
+func (vi *varyIndex) lookup(path string) []string {
+	vi.mu.RLock()
+	defer vi.mu.RUnlock()
+
+	return vi.headers[path]
+}
+
+// varyPath returns the path the Vary header of a response is recorded by.
+func (m *cache) varyPath(r *http.Request) string {
+	return r.Host + templatedPath(r.URL.Path, m.cfg.PathTemplates)
+}
+
+// varyKey returns the part of the cache key for the headers the responses
+// for r are known to vary on, leaving out those already in CacheHeaders.
+func (m *cache) varyKey(r *http.Request) string {
+	var builder strings.Builder
+
+	for _, name := range m.vary.lookup(m.varyPath(r)) {
+		if containsHeader(m.cfg.CacheHeaders, name) {
+			continue
+		}
+
+		if val := r.Header.Get(name); val != "" {
+			builder.WriteString("|")
+			builder.WriteString(name)
+			builder.WriteString(":")
+			builder.WriteString(val)
+		}
+	}
+
+	return builder.String()
+}
+
+// learnVary records the Vary header of the upstream response for r and
+// returns the key to store the response under, which includes the headers it
+// varies on.
+func (m *cache) learnVary(key string, r *http.Request, h http.Header) string {
+	if m.vary == nil {
+		return key
+	}
+
+	m.vary.learn(m.varyPath(r), h.Values("Vary"))
+
+	return m.key(r)
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_AutoVary(t *testing.T) {
+	calls := 0
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+
+		rw.Header().Set("Vary", "Accept-Language")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(r.Header.Get("Accept-Language")))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, AutoVary: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lang       string
+		wantStatus string
+	}{
+		{lang: "en", wantStatus: cacheMissStatus},
+		{lang: "en", wantStatus: cacheHitStatus},
+		{lang: "fr", wantStatus: cacheMissStatus},
+		{lang: "fr", wantStatus: cacheHitStatus},
+		{lang: "en", wantStatus: cacheHitStatus},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/test", nil)
+		req.Header.Set("Accept-Language", test.lang)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get(cacheHeader); got != test.wantStatus {
+			t.Errorf("request %d: unexpected cache state: want %q, got %q", i, test.wantStatus, got)
+		}
+
+		if got := rw.Body.String(); got != test.lang {
+			t.Errorf("request %d: unexpected body: want %q, got %q", i, test.lang, got)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("expected 2 upstream calls, got %d", calls)
+	}
+}
+
+func TestVaryIndex_Learn(t *testing.T) {
+	vi := newVaryIndex()
+
+	vi.learn("localhost/test", []string{"accept-language, *", "X-Device"})
+
+	got := vi.lookup("localhost/test")
+	if len(got) != 2 || got[0] != "Accept-Language" || got[1] != "X-Device" {
+		t.Errorf("unexpected vary headers: %q", got)
+	}
+
+	vi.learn("localhost/test", nil)
+
+	if got := vi.lookup("localhost/test"); got != nil {
+		t.Errorf("expected vary headers to be forgotten, got %q", got)
+	}
+}
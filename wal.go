@@ -0,0 +1,281 @@
+package plugin_simpleforcecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walCompactInterval is how often the write-ahead log is rewritten without
+// its committed records.
+const walCompactInterval = time.Minute
+
+// Write-ahead log records start with their type and ID. Set records are
+// followed by the key, the absolute expiry in Unix nanoseconds and the entry.
+const (
+	walSetRecord    byte = 'S'
+	walCommitRecord byte = 'C'
+)
+
+// writeAheadLog persists queued writes so that they survive a crash. Each
+// queued write is logged before it is queued and marked as committed once
+// stored.
+type writeAheadLog struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	nextID  uint64
+	pending map[uint64][]byte
+}
+
+// openWriteAheadLog opens the log at path, truncating it: its records must
+// have been replayed already.
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	f, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening write-ahead log: %w", err)
+	}
+
+	return &writeAheadLog{path: path, f: f, nextID: 1, pending: map[uint64][]byte{}}, nil //nolint:exhaustruct // zero mutex is ready to use
+}
+
+// append logs job and returns it with its log ID and an entry that can
+// still be read.
+func (w *writeAheadLog) append(job cacheWriteJob, now time.Time) (cacheWriteJob, error) {
+	entry, err := io.ReadAll(job.entry)
+	if err != nil {
+		return job, fmt.Errorf("error reading cache entry: %w", err)
+	}
+
+	job.entry = bytes.NewReader(entry)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextID
+	w.nextID++
+
+	rec := walRecord(walSetRecord, id)
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(job.key))) //nolint:gosec // keys are far below 4GB
+	rec = append(rec, job.key...)
+	rec = binary.BigEndian.AppendUint64(rec, uint64(now.Add(job.expiry).UnixNano())) //nolint:gosec // safe conversion
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(entry)))                     //nolint:gosec // entries are far below 4GB
+	rec = append(rec, entry...)
+
+	if _, err := w.f.Write(rec); err != nil { //nolint:noinlineerr // acceptable inline error
+		return job, fmt.Errorf("error writing write-ahead log: %w", err)
+	}
+
+	w.pending[id] = rec
+	job.walID = id
+
+	return job, nil
+}
+
+// commit marks the write logged under id as stored.
+func (w *writeAheadLog) commit(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.pending, id)
+
+	if _, err := w.f.Write(walRecord(walCommitRecord, id)); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error writing write-ahead log: %v", err)
+	}
+}
+
+// compact rewrites the log with only the writes that are not committed yet.
+func (w *writeAheadLog) compact() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), tempFilePattern)
+	if err != nil {
+		return fmt.Errorf("error compacting write-ahead log: %w", err)
+	}
+
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	for _, rec := range w.pending {
+		if _, err := tmp.Write(rec); err != nil { //nolint:noinlineerr // acceptable inline error
+			_ = tmp.Close()
+			return fmt.Errorf("error compacting write-ahead log: %w", err)
+		}
+	}
+
+	if err := tmp.Close(); err != nil { //nolint:noinlineerr // acceptable inline error
+		return fmt.Errorf("error compacting write-ahead log: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), w.path); err != nil { //nolint:noinlineerr // acceptable inline error
+		return fmt.Errorf("error compacting write-ahead log: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Clean(w.path), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening write-ahead log: %w", err)
+	}
+
+	_ = w.f.Close()
+	w.f = f
+
+	return nil
+}
+
+// compactPeriodically compacts the log every interval.
+func (w *writeAheadLog) compactPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := w.compact(); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error compacting write-ahead log: %v", err)
+		}
+	}
+}
+
+func walRecord(kind byte, id uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{kind}, id)
+}
+
+// walWrite is a write read back from the log.
+type walWrite struct {
+	key     string
+	expires time.Time
+	entry   []byte
+}
+
+// readWriteAheadLog returns the writes logged at path that were not
+// committed, in log order. A record cut short by a crash ends the log.
+func readWriteAheadLog(path string) ([]walWrite, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening write-ahead log: %w", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rd := bufio.NewReader(f)
+
+	var ids []uint64
+
+	writes := map[uint64]walWrite{}
+
+	for {
+		kind, id, write, err := readWALRecord(rd)
+		if err != nil {
+			break
+		}
+
+		switch kind {
+		case walSetRecord:
+			ids = append(ids, id)
+			writes[id] = write
+		case walCommitRecord:
+			delete(writes, id)
+		}
+	}
+
+	res := make([]walWrite, 0, len(writes))
+
+	for _, id := range ids {
+		if write, ok := writes[id]; ok {
+			res = append(res, write)
+		}
+	}
+
+	return res, nil
+}
+
+func readWALRecord(rd io.Reader) (byte, uint64, walWrite, error) {
+	var write walWrite
+
+	head := make([]byte, 9)
+	if _, err := io.ReadFull(rd, head); err != nil { //nolint:noinlineerr // acceptable inline error
+		return 0, 0, write, err
+	}
+
+	kind, id := head[0], binary.BigEndian.Uint64(head[1:])
+	if kind != walSetRecord {
+		return kind, id, write, nil
+	}
+
+	key, err := readWALBytes(rd)
+	if err != nil {
+		return 0, 0, write, err
+	}
+
+	expires := make([]byte, 8)
+	if _, err := io.ReadFull(rd, expires); err != nil { //nolint:noinlineerr // acceptable inline error
+		return 0, 0, write, err
+	}
+
+	entry, err := readWALBytes(rd)
+	if err != nil {
+		return 0, 0, write, err
+	}
+
+	write.key = string(key)
+	write.expires = time.Unix(0, int64(binary.BigEndian.Uint64(expires))) //nolint:gosec // safe conversion
+	write.entry = entry
+
+	return kind, id, write, nil
+}
+
+// readWALBytes reads a length-prefixed byte string.
+func readWALBytes(rd io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(rd, size); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(rd, b); err != nil { //nolint:noinlineerr // acceptable inline error
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// replayWriteAheadLog stores the writes logged at path that were not
+// committed before the previous shutdown, skipping expired ones.
+func (m *cache) replayWriteAheadLog(path string) {
+	writes, err := readWriteAheadLog(path)
+	if err != nil {
+		log.Printf("Error replaying write-ahead log: %v", err)
+		return
+	}
+
+	now := m.cfg.now()
+
+	for _, write := range writes {
+		if !write.expires.After(now) {
+			continue
+		}
+
+		if err := m.cache.Set(write.key, bytes.NewReader(write.entry), write.expires.Sub(now)); err != nil { //nolint:noinlineerr // acceptable inline error
+			log.Printf("Error replaying cache item: %v", err)
+			continue
+		}
+
+		m.stats.stores.Add(1)
+	}
+
+	if len(writes) > 0 {
+		log.Printf("Replayed %d writes from the write-ahead log", len(writes))
+	}
+}
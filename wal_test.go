@@ -0,0 +1,121 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	path := filepath.Join(createTempDir(t), walFileName)
+	now := time.Now()
+
+	w, err := openWriteAheadLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := w.append(cacheWriteJob{key: "a", entry: bytes.NewReader([]byte("A")), expiry: time.Minute}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.append(cacheWriteJob{key: "b", entry: bytes.NewReader([]byte("B")), expiry: time.Minute}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	w.commit(a.walID)
+
+	if err = w.compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of a write.
+	if _, err = w.f.Write([]byte{walSetRecord, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	writes, err := readWriteAheadLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writes) != 1 || writes[0].key != "b" || string(writes[0].entry) != "B" {
+		t.Fatalf("unexpected pending writes: %+v", writes)
+	}
+
+	if got := writes[0].expires.Unix(); got != now.Add(time.Minute).Unix() {
+		t.Errorf("unexpected expiry: want %d, got %d", now.Add(time.Minute).Unix(), got)
+	}
+}
+
+func TestCache_PersistWriteQueue(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("ok"))
+	}
+
+	// Fill the log of a cache that crashes before storing the entry.
+	src := &Config{Path: createTempDir(t), MaxExpiry: 10, Cleanup: 20}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), src, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	entry, err := h.(*cache).cache.Get("GETlocalhost/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := createTempDir(t)
+
+	w, err := openWriteAheadLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := cacheWriteJob{key: "GETlocalhost/test", entry: bytes.NewReader(entry), expiry: 10 * time.Second}
+	if _, err = w.append(job, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, WriteQueueSize: 8, PersistWriteQueue: true}
+
+	h, err = New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if got := rw.Header().Get(cacheHeader); got != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheHitStatus, got)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected the replayed entry to be served, got %d upstream calls", calls)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 0 {
+		t.Errorf("expected the replayed log to be truncated, got %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,290 @@
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// discardWriter is the response writer used for synthetic upstream requests
+// whose responses are only stored, never sent to a client.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
+
+// fetch sends a synthetic request upstream and returns the buffered response
+// along with the time the upstream took to produce it.
+func (m *cache) fetch(r *http.Request) (*responseWriter, time.Duration) {
+	rw := &responseWriter{ //nolint:exhaustruct // zero values are intentional
+		ResponseWriter: &discardWriter{header: http.Header{}},
+		buffered:       true,
+	}
+
+	start := time.Now()
+
+	m.callUpstream(rw, r)
+
+	return rw, time.Since(start)
+}
+
+// syntheticRequest derives a GET request for target from base, keeping the
+// headers of base so the cache key is computed the same way.
+func syntheticRequest(ctx context.Context, base *http.Request, target *url.URL) *http.Request {
+	req := base.Clone(ctx)
+	req.Method = http.MethodGet
+	req.URL = target
+	req.Host = target.Host
+	req.RequestURI = target.RequestURI()
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	return req
+}
+
+// warmRequest returns the GET request for target, derived from base if it is
+// set.
+func warmRequest(base *http.Request, target string) (*http.Request, error) {
+	if base == nil {
+		req, err := http.NewRequest(http.MethodGet, target, nil) //nolint:noctx // the context is set when warming
+		if err != nil {
+			return nil, err
+		}
+
+		req.RequestURI = req.URL.RequestURI()
+
+		return req, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return syntheticRequest(context.Background(), base, u), nil
+}
+
+// warmURLs warms the cache with urls, fetching up to WarmConcurrency of them
+// at once, or SitemapWarmConcurrency if unset, and at most WarmRateLimit per
+// second. Each worker pauses SitemapWarmDelay between requests.
+func (m *cache) warmURLs(urls []string) {
+	concurrency := m.cfg.WarmConcurrency
+	if concurrency <= 0 {
+		concurrency = m.cfg.SitemapWarmConcurrency
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	delay := time.Duration(m.cfg.SitemapWarmDelay) * time.Millisecond
+
+	var limit <-chan time.Time
+
+	if interval := time.Duration(float64(time.Second) / m.cfg.WarmRateLimit); m.cfg.WarmRateLimit > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		limit = ticker.C
+	}
+
+	var warmed, skipped, failed atomic.Int64
+
+	targets := make(chan string)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for target := range targets {
+				if limit != nil {
+					<-limit
+				}
+
+				req, err := warmRequest(nil, target)
+
+				var rw *responseWriter
+				if err == nil {
+					rw, err = m.warm(req)
+				}
+
+				switch {
+				case err != nil:
+					failed.Add(1)
+					log.Printf("Error warming %q: %v", target, err)
+				case rw == nil:
+					skipped.Add(1)
+					log.Printf("Skipped warming %q: path is not cached", target)
+				default:
+					warmed.Add(1)
+					log.Printf("Warmed %q", target)
+				}
+
+				time.Sleep(delay)
+			}
+		}()
+	}
+
+	for _, target := range urls {
+		targets <- target
+	}
+
+	close(targets)
+	wg.Wait()
+
+	log.Printf("Warming finished: %d warmed, %d skipped, %d failed", warmed.Load(), skipped.Load(), failed.Load())
+}
+
+// warm fetches req upstream, caches the response and returns it. The
+// response is nil for paths that are not cached.
+func (m *cache) warm(req *http.Request) (*responseWriter, error) {
+	if m.cfg.UpstreamTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), m.upstreamTimeout())
+		defer cancel()
+
+		req = req.WithContext(ctx)
+	}
+
+	if !m.matchesPathPrefix(req.URL.Path) {
+		return nil, nil //nolint:nilnil // paths that are not cached are skipped
+	}
+
+	rw, computeDuration := m.fetch(req)
+	if rw.status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", rw.status)
+	}
+
+	m.store(m.key(req), req, rw, computeDuration, writePriorityLow)
+
+	return rw, nil
+}
+
+// warmRedisList warms the cache with the URLs of the Redis list key, which
+// deployment pipelines fill while building. The list is deleted afterwards
+// if ClearWarmupList is set.
+func (m *cache) warmRedisList(addr, key string) error {
+	conn, err := dialRedis(addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	reply, err := conn.Do("LRANGE", key, "0", "-1")
+	if err != nil {
+		return err
+	}
+
+	vals, _ := reply.([]any)
+	urls := make([]string, 0, len(vals))
+
+	for _, val := range vals {
+		target, _ := val.(string)
+		if target = strings.TrimSpace(target); target != "" {
+			urls = append(urls, target)
+		}
+	}
+
+	log.Printf("Warming %d URLs from redis list %q", len(urls), key)
+
+	m.warmURLs(urls)
+
+	if m.cfg.ClearWarmupList {
+		if _, err := conn.Do("DEL", key); err != nil { //nolint:noinlineerr // acceptable inline error
+			return err
+		}
+	}
+
+	return nil
+}
+
+// warmCanonical fetches the canonical URL advertised by a 404 response in the
+// background and caches it under both the canonical key and the key of the
+// alias. Each alias is warmed once at a time.
+func (m *cache) warmCanonical(r *http.Request, aliasKey string, h http.Header) {
+	headerName := m.cfg.CanonicalURLHeader
+	if headerName == "" {
+		headerName = "Link"
+	}
+
+	link := canonicalLink(h.Get(headerName))
+	if link == "" {
+		return
+	}
+
+	base := &url.URL{Scheme: requestScheme(r), Host: r.Host, Path: r.URL.Path} //nolint:exhaustruct // only the base is needed
+
+	target, err := base.Parse(link)
+	if err != nil || target.Host != r.Host || !m.canonicalWarms.add(aliasKey) {
+		return
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if m.cfg.UpstreamTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.upstreamTimeout())
+	}
+
+	req := syntheticRequest(ctx, r, target)
+	alias := r.Clone(context.Background())
+
+	go func() {
+		defer m.canonicalWarms.remove(aliasKey)
+		defer cancel()
+
+		rw, computeDuration := m.fetch(req)
+		if rw.status != http.StatusOK {
+			log.Printf("Error warming canonical URL %q: status %d", target, rw.status)
+			return
+		}
+
+		m.store(m.key(req), req, rw, computeDuration, writePriorityLow)
+		m.store(aliasKey, alias, rw, computeDuration, writePriorityLow)
+	}()
+}
+
+// canonicalLink extracts the canonical URL from a Link header value such as
+// `<https://example.com/page>; rel="canonical"`. A value that is not in Link
+// format is treated as a bare URL.
+func canonicalLink(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "<") {
+		return value
+	}
+
+	for _, link := range strings.Split(value, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ">")
+		if !ok {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "rel") && strings.EqualFold(strings.Trim(val, `"`), "canonical") {
+				return strings.TrimPrefix(target, "<")
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,58 @@
+package plugin_simpleforcecache
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// statusWriter records the status code of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(p) //nolint:wrapcheck // pass through the client's error unchanged
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// invalidateWrite deletes the GET entries made stale by the successful write
+// request r: the entry of its own path, or those returned by
+// InvalidationURLMapper.
+func (m *cache) invalidateWrite(r *http.Request) {
+	paths := []string{r.URL.Path}
+	if m.cfg.InvalidationURLMapper != nil {
+		paths = m.cfg.InvalidationURLMapper(r.Method, r.URL.Path)
+	}
+
+	for _, path := range paths {
+		target, err := url.Parse(path)
+		if err != nil {
+			continue
+		}
+
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		get.URL = &url.URL{Path: target.Path, RawQuery: target.RawQuery} //nolint:exhaustruct // only the path is keyed
+
+		m.invalidate(m.key(get))
+	}
+}
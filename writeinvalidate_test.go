@@ -0,0 +1,79 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_AutoInvalidateOnWrite(t *testing.T) {
+	status := http.StatusCreated
+
+	next := func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(status)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:                  createTempDir(t),
+		MaxExpiry:             10,
+		Cleanup:               20,
+		AutoInvalidateOnWrite: true,
+		InvalidationURLMapper: func(method, path string) []string {
+			if method == http.MethodDelete {
+				return []string{path, "/api/products"}
+			}
+
+			return []string{path}
+		},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	get := func(path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	cached := func(path string) bool {
+		_, err := c.cache.Get("GETlocalhost" + path)
+		return err == nil
+	}
+
+	get("/api/products")
+	get("/api/products/1")
+
+	status = http.StatusInternalServerError
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://localhost/api/products", nil))
+
+	if !cached("/api/products") {
+		t.Error("expected failed writes to keep the entry")
+	}
+
+	status = http.StatusCreated
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://localhost/api/products", nil))
+
+	if cached("/api/products") {
+		t.Error("expected a successful POST to delete the GET entry")
+	}
+
+	get("/api/products")
+
+	status = http.StatusNoContent
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "http://localhost/api/products/1", nil))
+
+	if cached("/api/products/1") || cached("/api/products") {
+		t.Error("expected a successful DELETE to delete the mapped GET entries")
+	}
+}
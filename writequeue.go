@@ -0,0 +1,120 @@
+package plugin_simpleforcecache
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// writePriority orders queued cache writes.
+type writePriority int
+
+const (
+	// writePriorityHigh is used for responses stored on a client miss.
+	writePriorityHigh writePriority = iota
+	// writePriorityLow is used for background writes, such as warming.
+	writePriorityLow
+)
+
+// cacheWriteJob is a serialized entry waiting to be written to storage.
+type cacheWriteJob struct {
+	key      string
+	entry    io.Reader
+	expiry   time.Duration
+	priority writePriority
+	// walID identifies the job in the write-ahead log, zero when not logged.
+	walID uint64
+}
+
+// writeQueue decouples response latency from storage writes. Workers always
+// drain high priority jobs before low priority ones, so background writes
+// never hold up entries stored on a miss.
+type writeQueue struct {
+	high chan cacheWriteJob
+	low  chan cacheWriteJob
+}
+
+func newWriteQueue(size int) *writeQueue {
+	return &writeQueue{
+		high: make(chan cacheWriteJob, size),
+		low:  make(chan cacheWriteJob, size),
+	}
+}
+
+// enqueue adds job to the queue, reporting false when the queue is full.
+func (q *writeQueue) enqueue(job cacheWriteJob) bool {
+	ch := q.high
+	if job.priority == writePriorityLow {
+		ch = q.low
+	}
+
+	select {
+	case ch <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// next blocks until a job is available, preferring high priority jobs.
+func (q *writeQueue) next() cacheWriteJob {
+	select {
+	case job := <-q.high:
+		return job
+	default:
+	}
+
+	select {
+	case job := <-q.high:
+		return job
+	case job := <-q.low:
+		return job
+	}
+}
+
+// startWriteWorkers starts the goroutines draining the write queue.
+func (m *cache) startWriteWorkers(workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				m.write(m.writeQueue.next())
+			}
+		}()
+	}
+}
+
+// queueWrite writes the entry through the write queue when one is
+// configured. Entries are written directly when the queue is disabled or full.
+func (m *cache) queueWrite(job cacheWriteJob) {
+	if m.wal != nil {
+		var err error
+
+		job, err = m.wal.append(job, m.cfg.now())
+		if err != nil {
+			log.Printf("Error logging cache item: %v", err)
+		}
+	}
+
+	if m.writeQueue != nil && m.writeQueue.enqueue(job) {
+		return
+	}
+
+	m.write(job)
+}
+
+func (m *cache) write(job cacheWriteJob) {
+	if err := m.cache.Set(job.key, job.entry, job.expiry); err != nil { //nolint:noinlineerr // acceptable inline error
+		log.Printf("Error setting cache item: %v", err)
+		return
+	}
+
+	if job.walID != 0 {
+		m.wal.commit(job.walID)
+	}
+
+	m.stats.stores.Add(1)
+}
@@ -0,0 +1,80 @@
+//nolint:exhaustruct,varnamelen // test files don't need to specify all struct fields or long names
+package plugin_simpleforcecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue_PrefersHighPriority(t *testing.T) {
+	q := newWriteQueue(4)
+
+	for _, job := range []cacheWriteJob{
+		{key: "low1", priority: writePriorityLow},
+		{key: "high1", priority: writePriorityHigh},
+		{key: "low2", priority: writePriorityLow},
+		{key: "high2", priority: writePriorityHigh},
+	} {
+		if !q.enqueue(job) {
+			t.Fatalf("expected %s to be queued", job.key)
+		}
+	}
+
+	want := []string{"high1", "high2", "low1", "low2"}
+	for _, key := range want {
+		if got := q.next().key; got != key {
+			t.Errorf("unexpected job: want %q, got %q", key, got)
+		}
+	}
+}
+
+func TestWriteQueue_Full(t *testing.T) {
+	q := newWriteQueue(1)
+
+	if !q.enqueue(cacheWriteJob{key: "a"}) {
+		t.Fatal("expected the first job to be queued")
+	}
+
+	if q.enqueue(cacheWriteJob{key: "b"}) {
+		t.Error("expected a full queue to reject the job")
+	}
+
+	if !q.enqueue(cacheWriteJob{key: "c", priority: writePriorityLow}) {
+		t.Error("expected low priority jobs to have their own buffer")
+	}
+}
+
+func TestCache_WriteQueue(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("ok"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true, WriteQueueSize: 8, WriteWorkers: 2}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Stores == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/test", nil))
+
+	if got := rw.Header().Get(cacheHeader); got != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got %q", cacheHitStatus, got)
+	}
+}